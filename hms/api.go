@@ -1,15 +1,19 @@
 package hms
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
 )
 
 const API_BATCH_AMT = 100
@@ -17,6 +21,22 @@ const API_BATCH_AMT = 100
 type AddSuccessResponse struct {
 	Success   bool
 	ResultURL string
+	Warnings  []string       `json:",omitempty"`
+	Audit     *CreationAudit `json:",omitempty"`
+	// The link's Version, after an edit.
+	Version int64 `json:",omitempty"`
+}
+
+type GetOrCreateResponse struct {
+	Success   bool
+	Created   bool
+	ResultURL string
+	Result    *Link
+}
+
+type ScheduleResponse struct {
+	Success   bool
+	PublishAt time.Time
 }
 
 type ResolveResponse struct {
@@ -24,6 +44,9 @@ type ResolveResponse struct {
 	Result  *Link
 	Chat    *Chat
 	Error   string
+	// The link's PrivateNotes and Metadata, only for its owner.
+	PrivateNotes string            `json:",omitempty"`
+	Metadata     map[string]string `json:",omitempty"`
 }
 
 type ListResponse struct {
@@ -33,88 +56,140 @@ type ListResponse struct {
 	Error   string
 }
 
+type ShareResponse struct {
+	Success bool
+	Result  *Link
+	Error   string
+}
+
+// Sent with a 409 when the requested path is already taken.
+type ConflictResponse struct {
+	Success bool
+	// Always "path_taken", for clients to check instead of Error.
+	ErrorCode string
+	Error     string
+	Path      string
+	// The link that already has the path. It's in the same chat the
+	// caller asked for, so they could resolve it anyway.
+	Existing *Link
+}
+
+func writeConflict(w http.ResponseWriter, e *pathTakenError) {
+	respJSON, _ := json.Marshal(&ConflictResponse{false, "path_taken", e.Error(), e.Path, e.Existing})
+	w.WriteHeader(http.StatusConflict)
+	w.Write(respJSON)
+}
+
 type RemoveResponse struct {
 	Success    bool
 	NumRemoved int
 	Error      string
 }
 
-type apiHandler func(http.ResponseWriter, *http.Request, APIKey) *appError
+// API handlers get their context passed in, rather than deriving it from the
+// request, so that /api/batch can run them on requests it builds itself.
+type apiHandler func(context.Context, http.ResponseWriter, *http.Request, APIKey) *appError
 
 var apiRoutes = map[string]apiHandler{
-	"/api/add":     handleAdd,
-	"/api/resolve": handleResolve,
-	"/api/list":    handleList,
-	"/api/remove":  handleRemove,
+	"/api/add":         creationRateLimited(handleAdd),
+	"/api/resolve":     handleResolve,
+	"/api/list":        handleList,
+	"/api/links":       handleLinks,
+	"/api/search":      handleSearch,
+	"/api/link":        creationRateLimited(handleCreateLink),
+	"/api/remove":      handleRemove,
+	"/api/share":       handleShare,
+	"/api/getorcreate": creationRateLimited(handleGetOrCreate),
+	"/api/schedule":    creationRateLimited(handleSchedule),
+	"/api/batch":       handleBatch,
+	"/api/export":      handleExport,
+	"/api/alias":       creationRateLimited(handleAlias),
+	"/api/card":        handleCard,
+
+	"/api/links/expiry": handleLinksExpiry,
+
+	"/api/domains/register": handleRegisterDomain,
+	"/api/domains/verify":   handleVerifyDomain,
 }
 
-func handleAdd(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+func handleAdd(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
 	if r.Method != "POST" {
 		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
 	}
 
-	fbChatID := int64(-1)
-
 	strChatID := r.FormValue("chatID")
-
-	if strChatID != "" {
-		var err error
-		fbChatID, err = strconv.ParseInt(strChatID, 10, 64)
-		if err != nil {
-			return &appError{err, "Invalid chat ID: " + err.Error(), 400}
-		}
-	} else {
-		fbChatID = -1
+	chatID, err := parseChatID(strChatID)
+	if err != nil {
+		return &appError{err, "Invalid chat ID: " + err.Error(), 400}
 	}
 
-	resURL, err := createShortenedURL(r, fbChatID)
-	if err != nil {
+	result, err := createShortenedURL(c, r, chatID, &apiKey)
+	if taken, ok := err.(*pathTakenError); ok {
+		writeConflict(w, taken)
+		return nil
+	} else if err == errNoCreator {
+		return &appError{err, err.Error(), 401}
+	} else if err != nil {
 		// TODO handle this case better by distinguishing between
 		// bad requests and e.g. datastore errors
 		return &appError{err, err.Error(), 400}
 	}
 
-	absResURL := fmt.Sprintf("http://%s/%s", r.Host, resURL)
+	absResURL := result.ShortURL
 	if strChatID != "" {
 		absResURL += "?chatID=" + strChatID
 	}
 
-	resp := &AddSuccessResponse{true, absResURL}
+	resp := &AddSuccessResponse{true, absResURL, result.Warnings, result.Audit, 0}
 	respJSON, _ := json.Marshal(resp)
 	w.Write(respJSON)
 	return nil
 }
 
-func handleResolve(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
-	if r.Method != "GET" {
+// Resolves a path to its link. Besides the usual GET, this accepts a POST
+// with the path in the body, so that sensitive codes stay out of URLs (and
+// therefore out of access logs and referers).
+func handleResolve(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	var reqPath, strChatID string
+	switch r.Method {
+	case "GET":
+		reqPath = r.FormValue("path")
+		strChatID = r.FormValue("chatID")
+	case "POST":
+		reqPath = r.PostFormValue("path")
+		strChatID = r.PostFormValue("chatID")
+		w.Header().Set("Cache-Control", "no-store")
+	default:
 		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
 	}
 
-	reqPath := r.FormValue("path")
 	if reqPath == "" {
 		return &appError{nil, "The `path` parameter is required. ", 401}
 	}
-	c := appengine.NewContext(r)
-	linkResult, err := getMatchingLinkChatString(c, r.FormValue("chatID"), reqPath)
+	linkResult, err := getMatchingLinkChatString(c, strChatID, reqPath)
 
 	var resp *ResolveResponse
 
 	if err != nil {
-		resp = &ResolveResponse{false, nil, nil, "Not Found"}
+		resp = &ResolveResponse{false, nil, nil, "Not Found", "", nil}
 	} else {
 		var resultChat Chat
 
-		if linkResult.ChatKey != nil {
-			err = datastore.Get(c, linkResult.ChatKey, &resultChat)
+		if chatKey := linkResult.PrimaryChatKey(); chatKey != nil {
+			err = datastore.Get(c, chatKey, &resultChat)
+		}
+		resp = &ResolveResponse{true, linkResult, &resultChat, "", "", nil}
+		if isLinkOwner(c, linkResult, apiKey) {
+			resp.PrivateNotes = linkResult.PrivateNotes
+			resp.Metadata = linkResult.metadata()
 		}
-		resp = &ResolveResponse{true, linkResult, &resultChat, ""}
 	}
 	respJSON, _ := json.Marshal(resp)
 	w.Write(respJSON)
 	return nil
 }
 
-func handleList(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+func handleList(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
 	if r.Method != "GET" {
 		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
 	}
@@ -123,14 +198,9 @@ func handleList(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError
 	sOffset := r.FormValue("offset")
 	strChatID := r.FormValue("chatID")
 
-	fbChatID := int64(-1)
-
-	var err error
-	if strChatID != "" {
-		fbChatID, err = strconv.ParseInt(strChatID, 10, 64)
-		if err != nil {
-			return &appError{nil, "Bad chat ID", 400}
-		}
+	chatID, err := parseChatID(strChatID)
+	if err != nil {
+		return &appError{nil, "Bad chat ID", 400}
 	}
 
 	var limit, offset int
@@ -165,13 +235,12 @@ func handleList(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError
 		limit = API_BATCH_AMT
 	}
 
-	c := appengine.NewContext(r)
 	var chat *Chat
 	var chatKey *datastore.Key
-	if fbChatID != -1 {
+	if chatID.Valid {
 		chatResults := make([]Chat, 0, 1)
 		chatKeys, err := datastore.NewQuery("Chat").
-			Filter("FacebookChatID =", fbChatID).Limit(1).GetAll(c, &chatResults)
+			Filter("FacebookChatID =", chatID.ID).Limit(1).GetAll(c, &chatResults)
 		if err != nil {
 			return &appError{err, "Datastore error: " + err.Error(), 500}
 		} else if len(chatKeys) == 0 {
@@ -187,7 +256,7 @@ func handleList(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError
 
 	results := make([]Link, 0)
 	q := datastore.NewQuery("Link").
-		Filter("ChatKey =", chatKey).
+		Filter("ChatKeys =", chatKey).
 		Order("-Created").Offset(offset).Limit(limit)
 	_, err = q.GetAll(c, &results)
 
@@ -207,12 +276,78 @@ func handleList(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError
 	return nil
 }
 
-func handleRemove(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
-	if r.Method != "DELETE" {
+type LinksPageResponse struct {
+	Success bool
+	Links   []Link
+	// Pass back as `cursor` for the next page. Empty on the last page.
+	Cursor string
+}
+
+// Lists links newest first, a page of up to `limit` at a time. With
+// `has_music`, only links with (or without) music info are listed.
+func handleLinks(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "GET" {
 		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
 	}
 
-	c := appengine.NewContext(r)
+	limit := API_BATCH_AMT
+	if sLimit := r.FormValue("limit"); sLimit != "" {
+		n, err := strconv.Atoi(sLimit)
+		if err != nil || n <= 0 {
+			return &appError{err, "Bad limit.", 400}
+		} else if n < limit {
+			limit = n
+		}
+	}
+
+	q := datastore.NewQuery("Link")
+	if hasMusic := r.FormValue("has_music"); hasMusic != "" {
+		v, err := strconv.ParseBool(hasMusic)
+		if err != nil {
+			return &appError{err, "has_music must be true or false.", 400}
+		}
+		q = q.Filter("HasMusic =", v)
+	}
+	q = q.Order("-Created")
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return &appError{err, "Bad cursor.", 400}
+		}
+		q = q.Start(decoded)
+	}
+
+	resp := LinksPageResponse{Success: true, Links: make([]Link, 0, limit)}
+	it := q.Limit(limit).Run(c)
+	for {
+		var link Link
+		_, err := it.Next(&link)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return &appError{err, "Datastore error: " + err.Error(), 500}
+		}
+		resp.Links = append(resp.Links, link)
+	}
+
+	if len(resp.Links) == limit {
+		next, err := it.Cursor()
+		if err != nil {
+			return &appError{err, "Datastore error: " + err.Error(), 500}
+		}
+		resp.Cursor = next.String()
+	}
+
+	setPaginationLinks(w, r, resp.Cursor)
+	respJSON, _ := json.Marshal(&resp)
+	w.Write(respJSON)
+	return nil
+}
+
+func handleRemove(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "DELETE" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
 
 	strChatID := r.FormValue("chatID")
 	rmPath := r.FormValue("path")
@@ -221,16 +356,14 @@ func handleRemove(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appErr
 		return &appError{nil, "Missing path.", 401}
 	}
 
-	var fbChatID int64 = -1
 	var chatKey *datastore.Key
-	var err error
+	chatID, err := parseChatID(strChatID)
+	if err != nil {
+		return &appError{nil, "Bad chat ID", 400}
+	}
 
-	if strChatID != "" {
-		fbChatID, err = strconv.ParseInt(strChatID, 10, 64)
-		if err != nil {
-			return &appError{nil, "Bad chat ID", 400}
-		}
-		chatKeys, err := datastore.NewQuery("Chat").Filter("FacebookChatID =", fbChatID).
+	if chatID.Valid {
+		chatKeys, err := datastore.NewQuery("Chat").Filter("FacebookChatID =", chatID.ID).
 			KeysOnly().GetAll(c, nil)
 
 		if err != nil {
@@ -246,7 +379,7 @@ func handleRemove(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appErr
 
 	deleted := make([]Link, 0)
 	keysToRemove, err := datastore.NewQuery("Link").
-		Filter("Path =", rmPath).Filter("ChatKey =", chatKey).GetAll(c, &deleted)
+		Filter("Path =", rmPath).Filter("ChatKeys =", chatKey).GetAll(c, &deleted)
 
 	if len(keysToRemove) != 0 {
 		newKeys := make([]*datastore.Key, len(keysToRemove))
@@ -263,6 +396,12 @@ func handleRemove(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appErr
 			return
 		}, nil)
 
+		if err == nil {
+			uncacheLinks(c, keysToRemove...)
+			for _, link := range deleted {
+				adjustCreatorLinkCount(c, link.Creator, -1)
+			}
+		}
 	}
 
 	var resp RemoveResponse
@@ -285,6 +424,244 @@ func handleRemove(w http.ResponseWriter, r *http.Request, apiKey APIKey) *appErr
 	return nil
 }
 
+// Returns the link to `target` (in `chatID`, if given), creating it with the
+// usual add parameters if there isn't one yet.
+func handleGetOrCreate(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	strChatID := r.FormValue("chatID")
+	chatID, err := parseChatID(strChatID)
+	if err != nil {
+		return &appError{err, "Invalid chat ID: " + err.Error(), 400}
+	}
+
+	u, err := newLinkFromRequest(c, r, chatID, &apiKey)
+	if taken, ok := err.(*pathTakenError); ok {
+		writeConflict(w, taken)
+		return nil
+	} else if err == errNoCreator {
+		return &appError{err, err.Error(), 401}
+	} else if err != nil {
+		return &appError{err, err.Error(), 400}
+	}
+
+	_, link, created, err := getOrCreateLink(c, u)
+	if err != nil {
+		return &appError{err, "Datastore error: " + err.Error(), 500}
+	}
+
+	absResURL := shortURL(linkHost(r), link.Path)
+	if strChatID != "" {
+		absResURL += "?chatID=" + strChatID
+	}
+
+	respJSON, _ := json.Marshal(GetOrCreateResponse{true, created, absResURL, link})
+	w.Write(respJSON)
+	return nil
+}
+
+// Accepts the same parameters as /api/add, plus `publishAt` (RFC 3339), and
+// stores them to be created at that time by PublishPendingLinksHandler. The
+// parameters are validated now, and again when the link is published.
+func handleSchedule(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	publishAt, err := time.Parse(time.RFC3339, r.FormValue("publishAt"))
+	if err != nil {
+		return &appError{err, "Invalid publishAt: " + err.Error(), 400}
+	}
+
+	chatID, err := parseChatID(r.FormValue("chatID"))
+	if err != nil {
+		return &appError{err, "Invalid chat ID: " + err.Error(), 400}
+	}
+
+	u, err := newLinkFromRequest(c, r, chatID, &apiKey)
+	if taken, ok := err.(*pathTakenError); ok {
+		writeConflict(w, taken)
+		return nil
+	} else if err == errNoCreator {
+		return &appError{err, err.Error(), 401}
+	} else if err != nil {
+		return &appError{err, err.Error(), 400}
+	}
+
+	pending := newPendingLink(r.Form, linkHost(r), chatID, u, publishAt)
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "PendingLink", nil), &pending)
+	if err != nil {
+		return &appError{err, "Datastore error: " + err.Error(), 500}
+	}
+
+	respJSON, _ := json.Marshal(ScheduleResponse{true, publishAt})
+	w.Write(respJSON)
+	return nil
+}
+
+// Streams every link created by the API key's owner as CSV.
+func handleExport(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "GET" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+	if format := r.FormValue("format"); format != "" && format != "csv" {
+		return &appError{nil, fmt.Sprintf("Unsupported export format: %s", format), 400}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="links.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "target", "created", "privateNotes", "clicks"})
+
+	results := datastore.NewQuery("Link").
+		Filter("Creator =", apiKey.OwnerEmail).Order("-Created").Run(c)
+	for {
+		var link Link
+		_, err := results.Next(&link)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			// Headers are long gone, so all we can do is stop.
+			log.Errorf(c, "Export for %v failed: %v", apiKey.OwnerEmail, err)
+			break
+		}
+
+		cw.Write([]string{link.Path, link.TargetURL, link.Created.UTC().Format(time.RFC3339), link.PrivateNotes, strconv.FormatInt(link.ClickCount, 10)})
+	}
+	cw.Flush()
+	return nil
+}
+
+// Adds `alias` as another custom path for the link at `path` (in `chatID`,
+// if given). Both keep resolving to the same target. Only the link's creator
+// or an admin can alias it.
+func handleAlias(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	path := r.FormValue("path")
+	alias := r.FormValue("alias")
+	if path == "" || alias == "" {
+		return &appError{nil, "Both `path` and `alias` are required.", 401}
+	}
+	if !isValidPath(alias) || !IsLowercase(alias[0]) {
+		return &appError{nil, "Custom paths must begin with a lowercase letter, can't contain slashes, and can't be valid auto-generated codes.", 400}
+	}
+
+	strChatID := r.FormValue("chatID")
+	chatID, err := parseChatID(strChatID)
+	if err != nil {
+		return &appError{nil, "Bad chat ID", 400}
+	}
+
+	key, link, err := getMatchingLinkKey(c, chatID, path)
+	if err != nil {
+		return &appError{err, "No matching link", 404}
+	}
+	if !isLinkOwner(c, link, apiKey) {
+		return &appError{nil, "Only the link's creator or an admin can alias it.", 403}
+	}
+	if existing, err := getMatchingLink(c, chatID, alias); err == nil {
+		writeConflict(w, &pathTakenError{alias, existing})
+		return nil
+	}
+
+	// Point at the original rather than at another alias, so chains
+	// never form.
+	if link.AliasOf != nil {
+		key = link.AliasOf
+	}
+
+	aliasLink := Link{
+		TargetURL:     link.TargetURL,
+		Creator:       apiKey.OwnerEmail,
+		Created:       time.Now(),
+		ChatKeys:      link.ChatKeys,
+		AliasOf:       key,
+		SchemaVersion: LINK_SCHEMA_VERSION,
+		Version:       1,
+	}
+	aliasLink.setPath(alias)
+	if _, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Link", nil), &aliasLink); err != nil {
+		return &appError{err, "Datastore error: " + err.Error(), 500}
+	}
+	adjustCreatorLinkCount(c, aliasLink.Creator, 1)
+
+	absResURL := shortURL(linkHost(r), alias)
+	if strChatID != "" {
+		absResURL += "?chatID=" + strChatID
+	}
+	respJSON, _ := json.Marshal(&AddSuccessResponse{true, absResURL, nil, nil, 0})
+	w.Write(respJSON)
+	return nil
+}
+
+// Makes an existing link (found by `path` in `chatID`, or outside any chat if
+// that's omitted) resolvable from `targetChatID` as well. Only its creator or
+// an admin may share it.
+func handleShare(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	path := r.FormValue("path")
+	if path == "" {
+		return &appError{nil, "Missing path.", 401}
+	}
+
+	chatID, err := parseChatID(r.FormValue("chatID"))
+	if err != nil {
+		return &appError{nil, "Bad chat ID", 400}
+	}
+	targetChatID, err := strconv.ParseInt(r.FormValue("targetChatID"), 10, 64)
+	if err != nil {
+		return &appError{nil, "Bad target chat ID", 400}
+	}
+
+	linkKey, existing, err := getMatchingLinkKey(c, chatID, path)
+	if err != nil {
+		return &appError{err, "No matching link", 404}
+	}
+	if !isLinkOwner(c, existing, apiKey) {
+		return &appError{nil, "Only the link's creator or an admin can share it.", 403}
+	}
+
+	if _, err = getMatchingLink(c, SomeChat(targetChatID), path); err == nil {
+		return &appError{nil, "The target chat already has a link with that path.", 400}
+	}
+
+	var targetChatKey *datastore.Key
+	if _, err = getOrCreateChat(c, targetChatID, &targetChatKey); err != nil {
+		return &appError{err, "Datastore error: " + err.Error(), 500}
+	}
+
+	var link Link
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		if err := datastore.Get(tc, linkKey, &link); err != nil {
+			return err
+		}
+		if link.InChat(targetChatKey) {
+			return nil
+		}
+		link.ChatKeys = append(link.ChatKeys, targetChatKey)
+		link.Version++
+		_, err := datastore.Put(tc, linkKey, &link)
+		return err
+	}, nil)
+	if err != nil {
+		return &appError{err, "Datastore error: " + err.Error(), 500}
+	}
+	uncacheLinks(c, linkKey)
+
+	respJSON, _ := json.Marshal(ShareResponse{true, &link, ""})
+	w.Write(respJSON)
+	return nil
+}
+
 // General handler function for all requests to the API
 // In addition to calling the handler function according to the API routes,
 // verifies that a valid API key was provided as a parameter, and
@@ -297,20 +674,29 @@ func APIHandler(w http.ResponseWriter, r *http.Request) *appError {
 
 	c := appengine.NewContext(r)
 	results := make([]APIKey, 0, 1)
-	_, err := datastore.NewQuery("APIKey").Filter("APIKey =", apiKey).GetAll(c, &results)
+	keys, err := datastore.NewQuery("APIKey").Filter("APIKey =", apiKey).GetAll(c, &results)
 	if err != nil {
 		return &appError{err, "Error validating API key", 500}
 	} else if len(results) == 0 {
 		return &appError{nil, "Invalid API key.", 401}
+	} else if results[0].isRevoked() {
+		return &appError{nil, "This API key has been revoked.", 401}
 	}
 
 	apiKeyStruct := results[0]
+	apiKeyStruct.key = keys[0]
 	handler, ok := apiRoutes[r.URL.Path]
+	if !ok && strings.HasPrefix(r.URL.Path, "/api/link/") {
+		handler, ok = handleLink, true
+	}
 	if !ok {
 		return &appError{nil, fmt.Sprintf("No API handler for %s", r.URL.Path), 404}
 	}
+	if e := checkScope(&apiKeyStruct, r.URL.Path, r.Method); e != nil {
+		return e
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	return handler(w, r, apiKeyStruct)
+	return handler(c, w, r, apiKeyStruct)
 }
@@ -0,0 +1,191 @@
+package hms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Values of the backup handlers' `format` param for JSON output: an array
+// of BackupRecords, or one per line.
+const (
+	BACKUP_FORMAT_JSON  = "json"
+	BACKUP_FORMAT_JSONL = "jsonl"
+)
+
+// A link in a JSON backup. Aliases are backed up as plain links, and
+// credentials aren't backed up at all.
+type BackupRecord struct {
+	ID   int64  `json:"id"`
+	Code string `json:"code"`
+	// The chats the link is in; null means it can be resolved without a
+	// chat.
+	Chats        []*Chat           `json:"chats"`
+	PrivateNotes string            `json:"privateNotes,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	// Datastore ID of the API key the link was created through, if any.
+	APIKeyID int64 `json:"apiKeyID,omitempty"`
+	// Only with ?include=analytics.
+	Analytics *BackupAnalytics `json:"analytics,omitempty"`
+	Link
+}
+
+type BackupAnalytics struct {
+	Clicks int64 `json:"clicks"`
+	// Omitted if the link was never clicked.
+	LastClicked    *time.Time `json:"lastClicked,omitempty"`
+	UniqueEstimate int64      `json:"uniqueEstimate"`
+}
+
+// Values of the backup handlers' comma-separated `include` param.
+const BACKUP_INCLUDE_ANALYTICS = "analytics"
+
+// Parses `include`, returning whether analytics are included.
+func parseBackupInclude(include string) (bool, error) {
+	analytics := false
+	for _, part := range strings.Split(include, ",") {
+		switch strings.TrimSpace(part) {
+		case "":
+		case BACKUP_INCLUDE_ANALYTICS:
+			analytics = true
+		default:
+			return false, fmt.Errorf("Unknown include %q", part)
+		}
+	}
+	return analytics, nil
+}
+
+func newBackupAnalytics(link *Link) *BackupAnalytics {
+	analytics := BackupAnalytics{Clicks: link.ClickCount, UniqueEstimate: link.UniqueVisitors()}
+	if !link.LastClickedAt.IsZero() {
+		lastClicked := link.LastClickedAt
+		analytics.LastClicked = &lastClicked
+	}
+	return &analytics
+}
+
+// Parses the optional `since` and `until` RFC 3339 times bounding the
+// Created times of links in a backup. Zero times mean unbounded.
+func parseBackupRange(since string, until string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	var err error
+	if since != "" {
+		if start, err = time.Parse(time.RFC3339, since); err != nil {
+			return start, end, fmt.Errorf("Invalid since %q: use an RFC 3339 time", since)
+		}
+	}
+	if until != "" {
+		if end, err = time.Parse(time.RFC3339, until); err != nil {
+			return start, end, fmt.Errorf("Invalid until %q: use an RFC 3339 time", until)
+		}
+	}
+	if !start.IsZero() && !end.IsZero() && !start.Before(end) {
+		return start, end, fmt.Errorf("since has to be before until")
+	}
+	return start, end, nil
+}
+
+// Writes a BackupRecord for each link created at or after since and before
+// until, oldest first: as a JSON array if asArray is set, and otherwise as
+// JSON Lines, so incremental backups can be appended to the last one.
+func writeBackupJSON(c context.Context, w http.ResponseWriter, since time.Time, until time.Time, includeNotes bool, includeAnalytics bool, asArray bool) {
+	if asArray {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("["))
+		defer w.Write([]byte("]\n"))
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	q := datastore.NewQuery("Link")
+	if !since.IsZero() {
+		q = q.Filter("Created >=", since)
+	}
+	if !until.IsZero() {
+		q = q.Filter("Created <", until)
+	}
+
+	// Chats by encoded key, since most links share a handful of chats.
+	chats := make(map[string]*Chat)
+	enc := json.NewEncoder(w)
+	results := q.Order("Created").Run(c)
+	for first := true; ; first = false {
+		var link Link
+		key, err := results.Next(&link)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			log.Errorf(c, "JSON backup stopped early: %v", err)
+			return
+		}
+
+		// Links not migrated yet still have their chat in ChatKey.
+		// Migrating this copy (not the stored link) puts it in ChatKeys.
+		migrateLink(&link)
+		record := BackupRecord{ID: key.IntID(), Code: autoLinkPath(key.IntID()), Metadata: link.metadata(), Link: link}
+		// Written as [] rather than null for links in no chats.
+		record.Chats = make([]*Chat, 0, len(link.ChatKeys))
+		if includeNotes {
+			record.PrivateNotes = link.PrivateNotes
+		}
+		if includeAnalytics {
+			record.Analytics = newBackupAnalytics(&link)
+		}
+		if link.APIKeyID != nil {
+			record.APIKeyID = link.APIKeyID.IntID()
+		}
+		for _, chatKey := range link.ChatKeys {
+			if chatKey == nil {
+				record.Chats = append(record.Chats, nil)
+				continue
+			}
+			chat, ok := chats[chatKey.Encode()]
+			if !ok {
+				chat = new(Chat)
+				if err = datastore.Get(c, chatKey, chat); err != nil {
+					continue
+				}
+				chats[chatKey.Encode()] = chat
+			}
+			record.Chats = append(record.Chats, chat)
+		}
+		if asArray && !first {
+			w.Write([]byte(","))
+		}
+		enc.Encode(&record)
+	}
+}
+
+// Writes the backup in the format r asks for: the text format by default, or
+// JSON with format=json or format=jsonl, optionally limited by `since` and
+// `until`. With include=analytics, each link's click count, last click and
+// estimated distinct visitors are added.
+func serveBackup(c context.Context, w http.ResponseWriter, r *http.Request, includeNotes bool) {
+	includeAnalytics, err := parseBackupInclude(r.FormValue("include"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	format := r.FormValue("format")
+	if format != BACKUP_FORMAT_JSON && format != BACKUP_FORMAT_JSONL {
+		writeBackup(c, w, includeNotes, includeAnalytics)
+		return
+	}
+
+	since, until, err := parseBackupRange(r.FormValue("since"), r.FormValue("until"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeBackupJSON(c, w, since, until, includeNotes, includeAnalytics, format == BACKUP_FORMAT_JSON)
+}
@@ -0,0 +1,75 @@
+package hms
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBackupRange(t *testing.T) {
+	since, until, err := parseBackupRange("2016-03-01T00:00:00Z", "")
+	if err != nil || !since.Equal(time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)) || !until.IsZero() {
+		t.Errorf("Unexpected range %v to %v, %v", since, until, err)
+	}
+
+	for _, bad := range [][2]string{
+		{"yesterday", ""},
+		{"", "2016-03-01"},
+		{"2016-03-02T00:00:00Z", "2016-03-01T00:00:00Z"},
+	} {
+		if _, _, err = parseBackupRange(bad[0], bad[1]); err == nil {
+			t.Errorf("Expected since %q and until %q to be refused", bad[0], bad[1])
+		}
+	}
+}
+
+func TestBackupRecordJSON(t *testing.T) {
+	record := BackupRecord{ID: 5, Code: "yF", Link: Link{Path: "docs", PrivateNotes: "secret", AuthMode: AUTH_MODE_URL}}
+	encoded, _ := json.Marshal(&record)
+	s := string(encoded)
+	if !strings.Contains(s, `"id":5`) || !strings.Contains(s, `"Path":"docs"`) {
+		t.Errorf("Expected the record's ID and link fields, got %s", s)
+	}
+	if strings.Contains(s, "secret") || strings.Contains(s, AUTH_MODE_URL) {
+		t.Errorf("Expected notes and credentials to be left out unless set on the record, got %s", s)
+	}
+}
+
+func TestParseBackupInclude(t *testing.T) {
+	cases := map[string]bool{"": false, "analytics": true, " analytics ,": true}
+	for include, expected := range cases {
+		if analytics, err := parseBackupInclude(include); err != nil || analytics != expected {
+			t.Errorf("For %q, expected %v but got %v, %v", include, expected, analytics, err)
+		}
+	}
+	if _, err := parseBackupInclude("analytics,secrets"); err == nil {
+		t.Errorf("Expected an unknown include to be refused")
+	}
+}
+
+func TestBackupAnalytics(t *testing.T) {
+	link := Link{ClickCount: 7}
+	if fields := backupAnalyticsFields(&link, "|||"); fields != "7||||||0" {
+		t.Errorf("Unexpected fields for a link never clicked: %q", fields)
+	}
+	if analytics := newBackupAnalytics(&link); analytics.Clicks != 7 || analytics.LastClicked != nil {
+		t.Errorf("Unexpected analytics for a link never clicked: %+v", analytics)
+	}
+
+	link.LastClickedAt = time.Unix(1456833600, 0)
+	link.ClickVisitors = addClickVisitor(nil, 42)
+	if fields := backupAnalyticsFields(&link, "|||"); fields != "7|||1456833600|||1" {
+		t.Errorf("Unexpected fields: %q", fields)
+	}
+	analytics := newBackupAnalytics(&link)
+	if analytics.UniqueEstimate != 1 || analytics.LastClicked == nil || !analytics.LastClicked.Equal(link.LastClickedAt) {
+		t.Errorf("Unexpected analytics: %+v", analytics)
+	}
+
+	// Left out of the record's link itself, so default backups stay lean.
+	data, _ := json.Marshal(&BackupRecord{Link: link})
+	if strings.Contains(string(data), "LastClickedAt") || strings.Contains(string(data), "ClickVisitors") || strings.Contains(string(data), "analytics") {
+		t.Errorf("Expected no analytics in a default record, got %s", data)
+	}
+}
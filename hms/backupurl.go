@@ -0,0 +1,118 @@
+package hms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+const (
+	// The only scope download tokens are issued for so far.
+	DOWNLOAD_SCOPE_BACKUP = "backup"
+
+	DEFAULT_DOWNLOAD_TOKEN_TTL = time.Hour
+	MAX_DOWNLOAD_TOKEN_TTL     = 24 * time.Hour
+)
+
+// Signs a token allowing downloads in scope until expires:
+//
+//	scope.expires.hex(HMAC-SHA256(secret, "download\n" + scope + "\n" + expires))
+//
+// where expires is a Unix time.
+func signDownloadToken(secret string, scope string, expires time.Time) string {
+	payload := scope + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + downloadTokenMAC(secret, payload)
+}
+
+func downloadTokenMAC(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("download\n" + strings.Replace(payload, ".", "\n", 1)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks that token was signed with secret, is for scope, and hasn't expired
+// by now.
+func verifyDownloadToken(secret string, token string, scope string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(downloadTokenMAC(secret, payload))) {
+		return errors.New("signature mismatch")
+	}
+	if parts[0] != scope {
+		return fmt.Errorf("token is for %q, not %q", parts[0], scope)
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.New("malformed token")
+	} else if !now.Before(time.Unix(expires, 0)) {
+		return errors.New("token has expired")
+	}
+	return nil
+}
+
+// Responds with a URL that downloads the backup without logging in, for
+// off-site backup scripts. It's valid for `ttl` (a duration like "30m", at
+// most MAX_DOWNLOAD_TOKEN_TTL). Needs config.AdminSigningSecret, which the
+// tokens are signed with.
+func BackupURLHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+	if config.AdminSigningSecret == "" {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("Signed downloads need HMS_ADMIN_SECRET to be set."))
+		return
+	}
+
+	ttl := DEFAULT_DOWNLOAD_TOKEN_TTL
+	if v := r.FormValue("ttl"); v != "" {
+		var err error
+		ttl, err = time.ParseDuration(v)
+		if err != nil || ttl <= 0 || ttl > MAX_DOWNLOAD_TOKEN_TTL {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("ttl must be a duration of at most %v.", MAX_DOWNLOAD_TOKEN_TTL)))
+			return
+		}
+	}
+
+	token := signDownloadToken(config.AdminSigningSecret, DOWNLOAD_SCOPE_BACKUP, time.Now().Add(ttl))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(backupDownloadURL(requestBaseURL(r), config.BasePath, token)))
+}
+
+// Returns the URL downloading the backup with token, on baseURL under
+// basePath. It's always https: anyone who sees the token can download the
+// backup until it expires.
+func backupDownloadURL(baseURL string, basePath string, token string) string {
+	if strings.HasPrefix(baseURL, "http://") {
+		baseURL = "https://" + strings.TrimPrefix(baseURL, "http://")
+	}
+	return baseURL + basePath + "/backup/download?token=" + url.QueryEscape(token)
+}
+
+// Serves the backup to anyone with a valid token from BackupURLHandler.
+func BackupDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if config.AdminSigningSecret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	err := verifyDownloadToken(config.AdminSigningSecret, r.FormValue("token"), DOWNLOAD_SCOPE_BACKUP, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Bad download token: " + err.Error()))
+		return
+	}
+	serveBackup(appengine.NewContext(r), w, r, false)
+}
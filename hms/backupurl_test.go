@@ -0,0 +1,53 @@
+package hms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDownloadToken(t *testing.T) {
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	token := signDownloadToken("secret", DOWNLOAD_SCOPE_BACKUP, now.Add(time.Hour))
+
+	if err := verifyDownloadToken("secret", token, DOWNLOAD_SCOPE_BACKUP, now); err != nil {
+		t.Errorf("Expected a fresh token to verify, got %v", err)
+	}
+	if err := verifyDownloadToken("secret", token, DOWNLOAD_SCOPE_BACKUP, now.Add(time.Hour)); err == nil {
+		t.Errorf("Expected the token to expire")
+	}
+	if err := verifyDownloadToken("other", token, DOWNLOAD_SCOPE_BACKUP, now); err == nil {
+		t.Errorf("Expected a token signed with another secret to be refused")
+	}
+	if err := verifyDownloadToken("secret", token, "export", now); err == nil {
+		t.Errorf("Expected the token to be refused for another scope")
+	}
+
+	// Moving the expiry or scope breaks the signature.
+	tampered := []string{
+		"backup.9999999999" + token[len("backup.")+10:],
+		"export" + token[len("backup"):],
+		"",
+		"backup",
+	}
+	for _, bad := range tampered {
+		if err := verifyDownloadToken("secret", bad, DOWNLOAD_SCOPE_BACKUP, now); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestBackupDownloadURL(t *testing.T) {
+	cases := []struct {
+		baseURL  string
+		basePath string
+		expected string
+	}{
+		{"http://hms.space", "", "https://hms.space/backup/download?token=a.1%2Bb"},
+		{"https://hms.space", "/s", "https://hms.space/s/backup/download?token=a.1%2Bb"},
+	}
+	for _, tc := range cases {
+		if u := backupDownloadURL(tc.baseURL, tc.basePath, "a.1+b"); u != tc.expected {
+			t.Errorf("Expected %s for %s%s but got %s", tc.expected, tc.baseURL, tc.basePath, u)
+		}
+	}
+}
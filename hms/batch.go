@@ -0,0 +1,118 @@
+package hms
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"golang.org/x/net/context"
+)
+
+const MAX_BATCH_OPS = 25
+
+// One operation in a /api/batch request.
+type BatchOp struct {
+	Op     string            `json:"op"`
+	Params map[string]string `json:"params"`
+}
+
+type BatchOpResult struct {
+	Success bool
+	// The JSON the op's handler would have responded with on its own.
+	Result json.RawMessage `json:",omitempty"`
+	Error  string          `json:",omitempty"`
+	Code   int             `json:",omitempty"`
+}
+
+type BatchResponse struct {
+	Success bool
+	Results []BatchOpResult
+}
+
+type batchRoute struct {
+	method  string
+	path    string
+	handler apiHandler
+}
+
+var batchRoutes = map[string]batchRoute{
+	"create": {"POST", "/api/add", creationRateLimited(handleAdd)},
+	"delete": {"DELETE", "/api/remove", handleRemove},
+	"lookup": {"GET", "/api/resolve", handleResolve},
+	"list":   {"GET", "/api/list", handleList},
+	"share":  {"POST", "/api/share", handleShare},
+}
+
+// Runs a JSON array of {op, params} objects in order, each through the same
+// handler it'd use as a standalone API call and with the batch's API key,
+// and responds with their results in the same order. A failing op doesn't
+// stop the ones after it.
+func handleBatch(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return &appError{err, "Failed to read request body", 400}
+	}
+
+	var ops []BatchOp
+	if err = json.Unmarshal(body, &ops); err != nil {
+		return &appError{err, "Invalid batch: " + err.Error(), 400}
+	}
+	if len(ops) > MAX_BATCH_OPS {
+		return &appError{nil, fmt.Sprintf("Batches are limited to %d operations", MAX_BATCH_OPS), 400}
+	}
+
+	results := make([]BatchOpResult, len(ops))
+	for i, op := range ops {
+		results[i] = runBatchOp(c, r, apiKey, op)
+	}
+
+	respJSON, _ := json.Marshal(BatchResponse{true, results})
+	w.Write(respJSON)
+	return nil
+}
+
+func runBatchOp(c context.Context, r *http.Request, apiKey APIKey, op BatchOp) BatchOpResult {
+	route, ok := batchRoutes[op.Op]
+	if !ok {
+		return BatchOpResult{Error: fmt.Sprintf("Unknown op %q", op.Op), Code: 400}
+	}
+	if e := checkScope(&apiKey, route.path, route.method); e != nil {
+		return BatchOpResult{Error: e.Message, Code: e.Code}
+	}
+
+	form := url.Values{}
+	for name, value := range op.Params {
+		form.Set(name, value)
+	}
+
+	sub, err := http.NewRequest(route.method, route.path, nil)
+	if err != nil {
+		return BatchOpResult{Error: err.Error(), Code: 500}
+	}
+	sub.Host = r.Host
+	sub.Form = form
+	sub.PostForm = form
+
+	rec := httptest.NewRecorder()
+	if e := route.handler(c, rec, sub, apiKey); e != nil {
+		return BatchOpResult{Error: e.Message, Code: e.Code}
+	}
+	return recordedBatchResult(rec)
+}
+
+// Returns the result of an op whose handler succeeded in writing rec. Some
+// handlers write their own error responses, like writeConflict's 409, which
+// still count as failures.
+func recordedBatchResult(rec *httptest.ResponseRecorder) BatchOpResult {
+	if rec.Code >= 400 {
+		return BatchOpResult{Code: rec.Code, Result: rec.Body.Bytes()}
+	}
+	return BatchOpResult{Success: true, Result: rec.Body.Bytes()}
+}
@@ -0,0 +1,20 @@
+package hms
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordedBatchResult(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeConflict(rec, &pathTakenError{Path: "docs"})
+	if result := recordedBatchResult(rec); result.Success || result.Code != 409 || len(result.Result) == 0 {
+		t.Errorf("Expected a taken path to fail with its conflict body, got %+v", result)
+	}
+
+	rec = httptest.NewRecorder()
+	rec.Write([]byte(`{"Success":true}`))
+	if result := recordedBatchResult(rec); !result.Success || result.Code != 0 {
+		t.Errorf("Expected success, got %+v", result)
+	}
+}
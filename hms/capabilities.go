@@ -0,0 +1,98 @@
+package hms
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"google.golang.org/appengine"
+)
+
+// What /api/capabilities reports: the limits and features clients can rely
+// on. Only non-sensitive settings belong here, since anyone may read it.
+type Capabilities struct {
+	Success bool
+	// Feature flags by name, as currently in effect.
+	Flags map[string]bool
+	// Target schemes new links may use.
+	Schemes  []string
+	BasePath string
+	// Which lookup wins for paths valid as both kinds; see
+	// config.AmbiguousPaths.
+	AmbiguousPaths       string
+	CaseInsensitiveCodes bool
+
+	CredentialLinks    bool
+	AnonymousRedirects bool
+	PublicFeed         bool
+	SafeBrowsing       bool
+	// One in how many clicks is recorded for links that don't set their
+	// own ClickSampleEvery.
+	ClickSampleEvery int
+
+	Limits CapabilityLimits
+}
+
+type CapabilityLimits struct {
+	// Links an API key may create an hour, unless the key has its own limit.
+	APIKeyRateLimit      int
+	FeedRateLimit        int
+	BatchOps             int
+	InjectedParams       int
+	PrivateNotesLength   int
+	MetadataBytes        int
+	RedirectBudgetMs     int
+	MinQRSize, MaxQRSize int
+	// Codes per /qr_zip archive.
+	QRZipCodes int
+}
+
+// Builds the Capabilities of a server configured with cfg, whose flags are
+// currently as given.
+func capabilitiesFor(cfg Config, flags map[string]bool) Capabilities {
+	schemes := []string{"http", "https"}
+	if cfg.SchemePolicy == SCHEME_POLICY_HTTPS_ONLY {
+		schemes = []string{"https"}
+	}
+
+	return Capabilities{
+		Success:              true,
+		Flags:                flags,
+		Schemes:              schemes,
+		BasePath:             cfg.BasePath,
+		AmbiguousPaths:       cfg.AmbiguousPaths,
+		CaseInsensitiveCodes: cfg.CaseInsensitiveCodes,
+		CredentialLinks:      cfg.BasicAuthLinks,
+		AnonymousRedirects:   cfg.AnonymousRedirects,
+		PublicFeed:           cfg.PublicFeed,
+		SafeBrowsing:         cfg.SafeBrowsingKey != "",
+		ClickSampleEvery:     clampClickSampleEvery(cfg.ClickSampleEvery),
+		Limits: CapabilityLimits{
+			APIKeyRateLimit:    API_KEY_RATE_LIMIT,
+			FeedRateLimit:      cfg.FeedRateLimit,
+			BatchOps:           MAX_BATCH_OPS,
+			InjectedParams:     MAX_INJECTED_PARAMS,
+			PrivateNotesLength: MAX_PRIVATE_NOTES_LENGTH,
+			MetadataBytes:      MAX_METADATA_SIZE,
+			RedirectBudgetMs:   MAX_REDIRECT_BUDGET_MS,
+			MinQRSize:          QR_MIN_SIZE,
+			MaxQRSize:          QR_MAX_SIZE,
+			QRZipCodes:         QR_ZIP_MAX_CODES,
+		},
+	}
+}
+
+// Describes what this server supports, for clients to adapt to. Needs no
+// API key.
+func CapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	flags := make(map[string]bool)
+	for name := range flagDefaults {
+		flags[name] = isFeatureEnabled(c, name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	respJSON, _ := json.Marshal(capabilitiesFor(config, flags))
+	w.Write(respJSON)
+}
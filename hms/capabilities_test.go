@@ -0,0 +1,28 @@
+package hms
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCapabilitiesFor(t *testing.T) {
+	cfg := Config{
+		SchemePolicy:    SCHEME_POLICY_HTTPS_ONLY,
+		SafeBrowsingKey: "sb-secret",
+		CredentialsKey:  "creds-secret",
+		BasicAuthLinks:  true,
+	}
+	caps := capabilitiesFor(cfg, map[string]bool{FLAG_OEMBED: false})
+	if !reflect.DeepEqual(caps.Schemes, []string{"https"}) || !caps.SafeBrowsing || !caps.CredentialLinks {
+		t.Errorf("Unexpected capabilities %+v", caps)
+	}
+
+	asJSON, _ := json.Marshal(caps)
+	for _, secret := range []string{"sb-secret", "creds-secret"} {
+		if strings.Contains(string(asJSON), secret) {
+			t.Errorf("Capabilities contain a secret: %s", asJSON)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package hms
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// What a link's card shows.
+type linkCard struct {
+	Title     string
+	ShortURL  string
+	TargetURL string
+	Creator   string
+	Created   time.Time
+}
+
+func newLinkCard(link *Link, shortURL string) linkCard {
+	title := link.MusicInfo.Title
+	if title == "" {
+		title = link.OEmbedInfo.Title
+	}
+	if title == "" {
+		title = link.Path
+	}
+	return linkCard{title, shortURL, link.TargetURL, link.Creator, link.Created}
+}
+
+// Escapes a vCard text value (RFC 6350, section 3.4).
+func vCardEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+func (card linkCard) VCard() string {
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"FN:" + vCardEscape(card.Title),
+		"URL:" + card.ShortURL,
+		"NOTE:" + vCardEscape(fmt.Sprintf("Goes to %s. Created by %s.", card.TargetURL, card.Creator)),
+		"END:VCARD",
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func (card linkCard) JSONLD() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"@context":    "https://schema.org",
+		"@type":       "WebPage",
+		"name":        card.Title,
+		"url":         card.ShortURL,
+		"sameAs":      card.TargetURL,
+		"author":      map[string]string{"@type": "Person", "email": card.Creator},
+		"dateCreated": card.Created.Format(time.RFC3339),
+	})
+}
+
+// Exports the link at `path` (in `chatID`, if given) as a card for contact
+// apps: JSON-LD by default, or a vCard with `format=vcard`.
+func handleCard(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "GET" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	path := r.FormValue("path")
+	if path == "" {
+		return &appError{nil, "The `path` parameter is required. ", 401}
+	}
+	link, err := getMatchingLinkChatString(c, r.FormValue("chatID"), path)
+	if err != nil {
+		return &appError{err, "No matching link", 404}
+	}
+
+	cardURL := shortURL(linkHost(r), link.Path)
+	if strChatID := r.FormValue("chatID"); strChatID != "" {
+		cardURL += "?chatID=" + strChatID
+	}
+	card := newLinkCard(link, cardURL)
+
+	switch r.FormValue("format") {
+	case "", "jsonld":
+		body, err := card.JSONLD()
+		if err != nil {
+			return &appError{err, err.Error(), 500}
+		}
+		w.Header().Set("Content-Type", "application/ld+json")
+		w.Write(body)
+	case "vcard":
+		w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+		w.Header().Set("Content-Disposition", vcardDisposition(link.Path))
+		w.Write([]byte(card.VCard()))
+	default:
+		return &appError{nil, fmt.Sprintf("Unsupported card format: %s", r.FormValue("format")), 400}
+	}
+	return nil
+}
+
+// Returns the Content-Disposition of the vCard for the link at path, naming
+// the file after it. The path is quoted and escaped, since it may hold any
+// character.
+func vcardDisposition(path string) string {
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": path + ".vcf"})
+	if disposition == "" {
+		return "attachment"
+	}
+	return disposition
+}
@@ -0,0 +1,55 @@
+package hms
+
+import (
+	"mime"
+	"strings"
+	"testing"
+)
+
+func TestNewLinkCardTitle(t *testing.T) {
+	link := Link{Path: "song"}
+	if card := newLinkCard(&link, ""); card.Title != "song" {
+		t.Errorf("Expected the path as the title, got %q", card.Title)
+	}
+
+	link.OEmbedInfo.Title = "A Video"
+	if card := newLinkCard(&link, ""); card.Title != "A Video" {
+		t.Errorf("Expected the oEmbed title, got %q", card.Title)
+	}
+
+	link.MusicInfo.Title = "A Song"
+	if card := newLinkCard(&link, ""); card.Title != "A Song" {
+		t.Errorf("Expected the music title to win, got %q", card.Title)
+	}
+}
+
+func TestVCard(t *testing.T) {
+	card := linkCard{
+		Title:     "Songs; Vol. 1, Part 2",
+		ShortURL:  "http://hms.space/songs",
+		TargetURL: "http://example.com/",
+		Creator:   "test@example.com",
+	}
+	vcard := card.VCard()
+
+	for _, line := range []string{
+		"BEGIN:VCARD\r\n",
+		`FN:Songs\; Vol. 1\, Part 2` + "\r\n",
+		"URL:http://hms.space/songs\r\n",
+		"END:VCARD\r\n",
+	} {
+		if !strings.Contains(vcard, line) {
+			t.Errorf("Expected %q in the vCard, got:\n%s", line, vcard)
+		}
+	}
+}
+
+func TestVCardDisposition(t *testing.T) {
+	disposition := vcardDisposition(`a"b\c`)
+	if _, params, err := mime.ParseMediaType(disposition); err != nil || params["filename"] != `a"b\c.vcf` {
+		t.Errorf("Expected %q to name the file after the path, got %v, %v", disposition, params, err)
+	}
+	if _, params, err := mime.ParseMediaType(vcardDisposition("café")); err != nil || params["filename"] != "café.vcf" {
+		t.Errorf("Expected non-ASCII paths to be kept, got %v, %v", params, err)
+	}
+}
@@ -0,0 +1,217 @@
+package hms
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// Most clicks a single recorded click may stand for.
+const MAX_CLICK_SAMPLE_EVERY = 1000
+
+// Returns how many clicks each recorded click on the link stands for.
+func (l *Link) clickSampleEvery() int {
+	if l.ClickSampleEvery > 0 {
+		return clampClickSampleEvery(l.ClickSampleEvery)
+	}
+	return clampClickSampleEvery(config.ClickSampleEvery)
+}
+
+func clampClickSampleEvery(every int) int {
+	if every < 1 {
+		return 1
+	} else if every > MAX_CLICK_SAMPLE_EVERY {
+		return MAX_CLICK_SAMPLE_EVERY
+	}
+	return every
+}
+
+// Registers in a link's ClickVisitors, a HyperLogLog sketch of who clicked
+// it. 64 registers estimate to within about 13%.
+const (
+	CLICK_VISITOR_BITS      = 6
+	CLICK_VISITOR_REGISTERS = 1 << CLICK_VISITOR_BITS
+)
+
+// Returns a hash standing for the client making r, from its address and user
+// agent. Only the hash is passed on, and only its effect on ClickVisitors is
+// stored.
+func clickVisitor(r *http.Request) uint64 {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	sum := sha256.Sum256([]byte(host + "\n" + r.UserAgent()))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Adds the visitor hash to the sketch, which is created if it's empty.
+func addClickVisitor(sketch []byte, visitor uint64) []byte {
+	if len(sketch) != CLICK_VISITOR_REGISTERS {
+		sketch = make([]byte, CLICK_VISITOR_REGISTERS)
+	}
+	register := visitor >> (64 - CLICK_VISITOR_BITS)
+	// One more than the leading zeros of the remaining bits.
+	rank := byte(1)
+	for rest := visitor << CLICK_VISITOR_BITS; rest&(1<<63) == 0 && rank <= 64-CLICK_VISITOR_BITS; rest <<= 1 {
+		rank++
+	}
+	if rank > sketch[register] {
+		sketch[register] = rank
+	}
+	return sketch
+}
+
+// Estimates how many distinct visitors were added to the sketch.
+func estimateClickVisitors(sketch []byte) int64 {
+	if len(sketch) != CLICK_VISITOR_REGISTERS {
+		return 0
+	}
+	m := float64(CLICK_VISITOR_REGISTERS)
+	sum, zeros := 0.0, 0
+	for _, rank := range sketch {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.709 * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small counts.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// Returns the link's estimated distinct visitors. With sampling, only the
+// visitors of recorded clicks are counted.
+func (l *Link) UniqueVisitors() int64 {
+	return estimateClickVisitors(l.ClickVisitors)
+}
+
+// Returns whether clicks on the link are counted at all. A link with
+// NoAnalytics only has its ClickCount kept if config.CountOptedOutClicks.
+func (l *Link) countsClicks() bool {
+	return !l.NoAnalytics || config.CountOptedOutClicks
+}
+
+// Adds count clicks, made at clickedAt, to the link. Unless it has
+// NoAnalytics, also records when and (if hasVisitor) by whom. Returns whether
+// the link changed.
+func (l *Link) addClicks(count int, clickedAt time.Time, visitor uint64, hasVisitor bool) bool {
+	if !l.countsClicks() {
+		return false
+	}
+	l.ClickCount += int64(count)
+	if l.NoAnalytics {
+		return true
+	}
+	if clickedAt.After(l.LastClickedAt) {
+		l.LastClickedAt = clickedAt
+	}
+	if hasVisitor {
+		l.ClickVisitors = addClickVisitor(l.ClickVisitors, visitor)
+	}
+	return true
+}
+
+// Queues a task to count a click on the link by r's client, so the redirect
+// doesn't wait on the write. With sampling, only a random one in
+// clickSampleEvery clicks is queued, counting for all of them. A click that
+// can't be queued just goes uncounted. Links with NoAnalytics don't pass on
+// anything about the client.
+func queueClick(c context.Context, r *http.Request, key *datastore.Key, link *Link) {
+	if !link.countsClicks() {
+		return
+	}
+	every := link.clickSampleEvery()
+	if every > 1 && rand.Intn(every) != 0 {
+		return
+	}
+
+	values := url.Values{
+		"id":    {strconv.FormatInt(key.IntID(), 10)},
+		"count": {strconv.Itoa(every)},
+	}
+	if !link.NoAnalytics {
+		values.Set("visitor", strconv.FormatUint(clickVisitor(r), 16))
+	}
+	t := taskqueue.NewPOSTTask("/record_click", values)
+	if _, err := taskqueue.Add(c, t, ""); err != nil {
+		log.Errorf(c, "Failed to queue click for link %v: %v", key, err)
+	}
+}
+
+// Adds `count` (default 1) to a link's ClickCount, and records when it was
+// clicked and (if given) by which `visitor`; see addClicks. Failures are
+// retried by the task queue.
+func RecordClickHandler(w http.ResponseWriter, r *http.Request) {
+	if !isInternalRequest(r) && !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid link ID."))
+		return
+	}
+	count := 1
+	if v := r.FormValue("count"); v != "" {
+		count, err = strconv.Atoi(v)
+		if err != nil || count < 1 || count > MAX_CLICK_SAMPLE_EVERY {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid count."))
+			return
+		}
+	}
+	var visitor uint64
+	hasVisitor := r.FormValue("visitor") != ""
+	if hasVisitor {
+		if visitor, err = strconv.ParseUint(r.FormValue("visitor"), 16, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid visitor."))
+			return
+		}
+	}
+	clickedAt := time.Now()
+	key := datastore.NewKey(c, "Link", "", id, nil)
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		var link Link
+		if err := datastore.Get(tc, key, &link); err != nil {
+			return err
+		}
+		// The link may have opted out since the click was queued.
+		if !link.addClicks(count, clickedAt, visitor, hasVisitor) {
+			return nil
+		}
+		_, err := datastore.Put(tc, key, &link)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		// Deleted since the click; nothing to count.
+		w.Write([]byte("No such link."))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+	w.Write([]byte("Success!"))
+}
@@ -0,0 +1,70 @@
+package hms
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClickSampleEvery(t *testing.T) {
+	defer func(every int) { config.ClickSampleEvery = every }(config.ClickSampleEvery)
+
+	config.ClickSampleEvery = 0
+	if every := (&Link{}).clickSampleEvery(); every != 1 {
+		t.Errorf("Expected every click to be recorded by default, got 1 in %d", every)
+	}
+
+	config.ClickSampleEvery = 10
+	cases := map[int]int{0: 10, 1: 1, 50: 50, MAX_CLICK_SAMPLE_EVERY + 1: MAX_CLICK_SAMPLE_EVERY}
+	for linkEvery, expected := range cases {
+		if every := (&Link{ClickSampleEvery: linkEvery}).clickSampleEvery(); every != expected {
+			t.Errorf("For a link sampling 1 in %d, expected 1 in %d but got 1 in %d", linkEvery, expected, every)
+		}
+	}
+}
+
+func TestAddClicks(t *testing.T) {
+	defer func(count bool) { config.CountOptedOutClicks = count }(config.CountOptedOutClicks)
+	clickedAt := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var link Link
+	if !link.addClicks(2, clickedAt, 1, true) || link.ClickCount != 2 || !link.LastClickedAt.Equal(clickedAt) ||
+		link.UniqueVisitors() != 1 {
+		t.Errorf("Expected the clicks and their visitor to be recorded, got %+v", link)
+	}
+
+	config.CountOptedOutClicks = true
+	link = Link{NoAnalytics: true}
+	if !link.addClicks(2, clickedAt, 1, true) || link.ClickCount != 2 || !link.LastClickedAt.IsZero() ||
+		link.ClickVisitors != nil {
+		t.Errorf("Expected only the count of an opted-out link's clicks to be recorded, got %+v", link)
+	}
+
+	config.CountOptedOutClicks = false
+	link = Link{NoAnalytics: true}
+	if link.addClicks(2, clickedAt, 1, true) || link.ClickCount != 0 {
+		t.Errorf("Expected an opted-out link's clicks not to be counted, got %+v", link)
+	}
+}
+
+func TestEstimateClickVisitors(t *testing.T) {
+	if n := estimateClickVisitors(nil); n != 0 {
+		t.Errorf("Expected no visitors for an empty sketch, got %d", n)
+	}
+
+	var sketch []byte
+	for i := 0; i < 1000; i++ {
+		visitor := clickVisitor(&http.Request{RemoteAddr: fmt.Sprintf("10.0.%d.%d:443", i/256, i%256)})
+		// Repeat visits don't count again.
+		sketch = addClickVisitor(addClickVisitor(sketch, visitor), visitor)
+		if i == 9 {
+			if n := estimateClickVisitors(sketch); n < 8 || n > 12 {
+				t.Errorf("Expected about 10 visitors, got %d", n)
+			}
+		}
+	}
+	if n := estimateClickVisitors(sketch); n < 700 || n > 1300 {
+		t.Errorf("Expected about 1000 visitors, got %d", n)
+	}
+}
@@ -0,0 +1,120 @@
+package hms
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Wraps h so that its responses are gzipped for clients that accept it.
+// Responses smaller than config.CompressionThreshold are sent as-is, since
+// compressing them isn't worth it.
+func gzipHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		gw := newGzipResponseWriter(w, config.CompressionThreshold)
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// Returns whether an Accept-Encoding header value allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		refused := false
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				refused = err == nil && q == 0
+			}
+		}
+		if !refused {
+			return true
+		}
+	}
+	return false
+}
+
+// Holds back the start of the response until it's clear whether it'll be
+// big enough to compress, then either streams it through a gzip.Writer or
+// passes it along untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	threshold int
+	status    int
+	buf       []byte
+	gz        *gzip.Writer
+	flushed   bool
+}
+
+func newGzipResponseWriter(w http.ResponseWriter, threshold int) *gzipResponseWriter {
+	return &gzipResponseWriter{
+		ResponseWriter: w,
+		threshold:      threshold,
+		status:         http.StatusOK,
+	}
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.flushed {
+		if w.gz != nil {
+			return w.gz.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.threshold {
+		if err := w.flush(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *gzipResponseWriter) flush(compress bool) error {
+	w.flushed = true
+	header := w.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if compress && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.ResponseWriter.WriteHeader(w.status)
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+		_, err := w.gz.Write(w.buf)
+		w.buf = nil
+		return err
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// Finishes the response. Must be called once the handler is done.
+func (w *gzipResponseWriter) Close() error {
+	if !w.flushed {
+		return w.flush(false)
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package hms
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := map[string]bool{
+		"":                      false,
+		"gzip":                  true,
+		"deflate, gzip":         true,
+		"GZIP;q=0.5":            true,
+		"gzip;q=0":              false,
+		"gzip; q=0.000":         false,
+		"deflate":               false,
+		"*":                     true,
+		"identity, *;q=0":       false,
+		"br;q=1.0, gzip;q=0.8":  true,
+		"x-gzip-but-not-really": false,
+	}
+
+	for header, expected := range cases {
+		if acceptsGzip(header) != expected {
+			t.Errorf("For Accept-Encoding %q, expected %v", header, expected)
+		}
+	}
+}
+
+func TestGzipResponseWriterSkipsSmallResponses(t *testing.T) {
+	rec := httptest.NewRecorder()
+	gw := newGzipResponseWriter(rec, 100)
+	gw.WriteHeader(404)
+	gw.Write([]byte("small"))
+	gw.Close()
+
+	if rec.Code != 404 {
+		t.Errorf("Expected status 404, got %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected a small response not to be compressed")
+	}
+	if rec.Body.String() != "small" {
+		t.Errorf("Expected the body to pass through, got %q", rec.Body.String())
+	}
+}
+
+func TestGzipResponseWriterCompressesLargeResponses(t *testing.T) {
+	rec := httptest.NewRecorder()
+	gw := newGzipResponseWriter(rec, 100)
+	body := strings.Repeat("0123456789", 50)
+	for i := 0; i < len(body); i += 7 {
+		end := i + 7
+		if end > len(body) {
+			end = len(body)
+		}
+		gw.Write([]byte(body[i:end]))
+	}
+	gw.Close()
+
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a large response to be compressed")
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Invalid gzip stream: %v", err)
+	}
+	decoded, _ := ioutil.ReadAll(gr)
+	if string(decoded) != body {
+		t.Errorf("Body didn't survive compression")
+	}
+}
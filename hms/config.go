@@ -0,0 +1,246 @@
+package hms
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deployment-level settings. These are read from environment variables, which
+// can be set under `env_variables` in app.yaml.
+type Config struct {
+	// Order in which creatorSources are consulted when attributing a new
+	// link. Leaving out CREATOR_SOURCE_FORM disables the anonymous,
+	// self-declared creator.
+	CreatorPrecedence []string
+
+	// Secret used to sign admin requests from automation. Signed requests
+	// are refused when this is empty.
+	AdminSigningSecret string
+
+	// Whether the "does not exist" page suggests similar existing paths.
+	SuggestSimilarPaths bool
+
+	// API and backup responses smaller than this many bytes aren't gzipped.
+	CompressionThreshold int
+
+	// Hosts whose pages embed the creation form; links created from them
+	// get the minimal "embed" response instead of the full index.
+	EmbedReferrers []string
+
+	// Default for Link.RedirectBudgetMs. 0 means no budget: redirects always
+	// get all of their processing.
+	RedirectBudget time.Duration
+
+	// Whether each link creation is logged with its creator and client.
+	LogCreations bool
+
+	// Scheme and host, like "https://hms.space", of URLs we hand out for
+	// clients to follow, like pagination links. Empty uses http:// and the
+	// request's host.
+	BaseURL string
+
+	// Hosts generated links may use. A request for any other host gets
+	// links on CanonicalHost (or the first allowed host if that's unset),
+	// so a forged Host header can't point them elsewhere. Empty allows any
+	// host.
+	AllowedHosts  []string
+	CanonicalHost string
+
+	// Path prefix, like "/s", the shortener is served under when it
+	// shares a domain with other apps. Empty serves it at the root.
+	BasePath string
+
+	// Which lookup wins for paths that are valid both as an auto-encoded
+	// code and as a manual path: AMBIGUOUS_PREFER_AUTO or
+	// AMBIGUOUS_PREFER_MANUAL. The other is tried if the first finds
+	// nothing.
+	AmbiguousPaths string
+
+	// Auto-encoded paths of new links are padded to at least this many
+	// characters. Existing links keep their paths.
+	AutoCodeMinLength int
+
+	// Whether auto-encoded codes are found whatever letter case they're
+	// typed in; see normalizeAutoCode. Off by default, since y and Y are
+	// different digits and can't be folded.
+	CaseInsensitiveCodes bool
+
+	// Which target schemes new links may use: SCHEME_POLICY_HTTP_HTTPS
+	// or SCHEME_POLICY_HTTPS_ONLY.
+	SchemePolicy string
+	// Whether targets are checked against SchemePolicy (and
+	// dangerousSchemes) on every redirect too, so tightening the policy
+	// applies to existing links. Off checks only at creation.
+	RecheckSchemes bool
+
+	// Request headers templated targets may use.
+	TemplateHeaders []string
+
+	// Whether links keep their target as submitted, alongside the
+	// normalized one they redirect to.
+	StoreOriginalTarget bool
+
+	// Whether /api/feed lists recent public links, and how many requests a
+	// minute each client may make to it.
+	PublicFeed    bool
+	FeedRateLimit int
+
+	// Default for Link.ClickSampleEvery; 1 records every click.
+	ClickSampleEvery int
+
+	// Default for Link.NoAnalytics, and whether links with it still have
+	// their clicks counted.
+	NoAnalytics         bool
+	CountOptedOutClicks bool
+
+	// Default for Link.InterstitialSnippet, and whether snippets may use
+	// <script>; see parseSnippet.
+	InterstitialSnippet string
+	AllowSnippetScripts bool
+
+	// How many of the most clicked links get their own /metrics series.
+	MetricsTopLinks int
+
+	// DNS-over-HTTPS JSON endpoint used to look up custom domains'
+	// verification records.
+	DNSResolverURL string
+
+	// How long the music provider's answer for a target is reused. 0
+	// turns the cache off.
+	MusicCacheTTL time.Duration
+
+	// Whether index form POSTs must carry a CSRF token.
+	CSRFProtection bool
+
+	// Secret CSRF tokens are signed with. When empty, one is generated and
+	// kept in the datastore.
+	CSRFSecret string
+
+	// Whether links may carry Basic Auth credentials for their target, and
+	// the base64-encoded 32-byte key they're encrypted with. Off by default:
+	// anyone with the link gets through the target's auth.
+	BasicAuthLinks bool
+	CredentialsKey string
+
+	// Whether links marked AllowAnonymous redirect without a login. Off
+	// means every redirect needs an authorized user.
+	AnonymousRedirects bool
+
+	// API key for Google Safe Browsing lookups of new targets. Empty skips
+	// the lookups.
+	SafeBrowsingKey string
+}
+
+var config = loadConfig()
+
+func loadConfig() Config {
+	return Config{
+		CreatorPrecedence: envList("HMS_CREATOR_PRECEDENCE",
+			[]string{CREATOR_SOURCE_USER, CREATOR_SOURCE_FORM, CREATOR_SOURCE_API_KEY}),
+		AdminSigningSecret:   os.Getenv("HMS_ADMIN_SECRET"),
+		SuggestSimilarPaths:  envBool("HMS_SUGGEST_SIMILAR_PATHS", false),
+		CompressionThreshold: envInt("HMS_GZIP_MIN_BYTES", 1024),
+		EmbedReferrers:       envList("HMS_EMBED_REFERRERS", nil),
+		RedirectBudget:       envDuration("HMS_REDIRECT_BUDGET", 0),
+		LogCreations:         envBool("HMS_LOG_CREATIONS", true),
+		BaseURL:              strings.TrimSuffix(os.Getenv("HMS_BASE_URL"), "/"),
+		AllowedHosts:         envList("HMS_ALLOWED_HOSTS", nil),
+		CanonicalHost:        os.Getenv("HMS_CANONICAL_HOST"),
+		BasePath:             envPathPrefix("HMS_BASE_PATH"),
+		AmbiguousPaths:       envString("HMS_AMBIGUOUS_PATHS", AMBIGUOUS_PREFER_AUTO),
+		AutoCodeMinLength:    envInt("HMS_AUTO_CODE_MIN_LENGTH", 0),
+		CaseInsensitiveCodes: envBool("HMS_CASE_INSENSITIVE_CODES", false),
+		SchemePolicy:         envString("HMS_SCHEME_POLICY", SCHEME_POLICY_HTTP_HTTPS),
+		RecheckSchemes:       envBool("HMS_RECHECK_SCHEMES", false),
+		TemplateHeaders:      envList("HMS_TEMPLATE_HEADERS", []string{"Accept-Language"}),
+		StoreOriginalTarget:  envBool("HMS_STORE_ORIGINAL_TARGET", true),
+		PublicFeed:           envBool("HMS_PUBLIC_FEED", false),
+		FeedRateLimit:        envInt("HMS_FEED_RATE_LIMIT", 30),
+		ClickSampleEvery:     envInt("HMS_CLICK_SAMPLE_EVERY", 1),
+		NoAnalytics:          envBool("HMS_NO_ANALYTICS", false),
+		CountOptedOutClicks:  envBool("HMS_COUNT_OPTED_OUT_CLICKS", true),
+		InterstitialSnippet:  os.Getenv("HMS_INTERSTITIAL_SNIPPET"),
+		AllowSnippetScripts:  envBool("HMS_ALLOW_SNIPPET_SCRIPTS", false),
+		MetricsTopLinks:      envInt("HMS_METRICS_TOP_LINKS", 50),
+		DNSResolverURL:       envString("HMS_DNS_RESOLVER_URL", "https://dns.google/resolve"),
+		MusicCacheTTL:        envDuration("HMS_MUSIC_CACHE_TTL", 24*time.Hour),
+		CSRFProtection:       envBool("HMS_CSRF_PROTECTION", true),
+		CSRFSecret:           os.Getenv("HMS_CSRF_SECRET"),
+		BasicAuthLinks:       envBool("HMS_BASIC_AUTH_LINKS", false),
+		CredentialsKey:       os.Getenv("HMS_CREDENTIALS_KEY"),
+		SafeBrowsingKey:      os.Getenv("HMS_SAFE_BROWSING_KEY"),
+		AnonymousRedirects:   envBool("HMS_ANONYMOUS_REDIRECTS", false),
+	}
+}
+
+const REDACTED = "[redacted]"
+
+// Returns a copy of cfg that's safe to show, with every secret replaced by
+// REDACTED. New secret fields have to be added here.
+func (cfg Config) redacted() Config {
+	for _, secret := range []*string{&cfg.AdminSigningSecret, &cfg.CSRFSecret, &cfg.CredentialsKey, &cfg.SafeBrowsingKey} {
+		if *secret != "" {
+			*secret = REDACTED
+		}
+	}
+	return cfg
+}
+
+func envString(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envBool(name string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Reads a duration like "250ms".
+func envDuration(name string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Reads a path prefix, normalized to start with a slash and not end with one.
+func envPathPrefix(name string) string {
+	v := strings.Trim(os.Getenv(name), "/")
+	if v == "" {
+		return ""
+	}
+	return "/" + v
+}
+
+// Reads a comma-separated list.
+func envList(name string, def []string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	list := make([]string, 0)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,24 @@
+package hms
+
+import "testing"
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := Config{
+		AdminSigningSecret: "admin secret",
+		LogCreations:       true,
+	}
+
+	redacted := cfg.redacted()
+	if redacted.AdminSigningSecret != REDACTED {
+		t.Errorf("AdminSigningSecret wasn't redacted: %q", redacted.AdminSigningSecret)
+	}
+	if redacted.CSRFSecret != "" {
+		t.Errorf("An unset secret should stay empty, got %q", redacted.CSRFSecret)
+	}
+	if !redacted.LogCreations {
+		t.Errorf("Redacting changed a setting that isn't secret")
+	}
+	if cfg.AdminSigningSecret != "admin secret" {
+		t.Errorf("Redacting changed the original config")
+	}
+}
@@ -0,0 +1,62 @@
+package hms
+
+import (
+	"errors"
+	"time"
+
+	"google.golang.org/appengine/user"
+)
+
+const (
+	CREATOR_SOURCE_API_KEY = "apikey"
+	CREATOR_SOURCE_USER    = "user"
+	CREATOR_SOURCE_FORM    = "form"
+	// The creator was resolved earlier, e.g. when a link was scheduled.
+	CREATOR_SOURCE_PRESET = "preset"
+)
+
+var errNoCreator = errors.New("No creator provided.")
+
+// Picks who a new link should be attributed to, trying each source in
+// precedence order: the owner of the API key used, the logged-in user, or the
+// `creator` value submitted with the request. Any of these may be absent.
+// Returns the creator along with the source it came from.
+func resolveCreator(precedence []string, apiKey *APIKey, u *user.User, formCreator string) (string, string, error) {
+	for _, source := range precedence {
+		switch source {
+		case CREATOR_SOURCE_API_KEY:
+			if apiKey != nil && apiKey.OwnerEmail != "" {
+				return apiKey.OwnerEmail, source, nil
+			}
+		case CREATOR_SOURCE_USER:
+			if u != nil {
+				return u.Email, source, nil
+			}
+		case CREATOR_SOURCE_FORM:
+			if formCreator != "" {
+				return formCreator, source, nil
+			}
+		}
+	}
+	return "", "", errNoCreator
+}
+
+// Who a new link was attributed to and how, returned to its creator so they
+// can check it.
+type CreationAudit struct {
+	Creator string    `json:"creator"`
+	Source  string    `json:"source"`
+	Created time.Time `json:"created"`
+}
+
+// Returns the audit info for a link just created, or nil when precedence
+// leaves out CREATOR_SOURCE_FORM: then the creator is always the caller's
+// own identity and echoing it back tells them nothing.
+func creationAudit(precedence []string, l *Link) *CreationAudit {
+	for _, source := range precedence {
+		if source == CREATOR_SOURCE_FORM {
+			return &CreationAudit{l.Creator, l.creatorSource, l.Created}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package hms
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/user"
+)
+
+func TestResolveCreator(t *testing.T) {
+	apiKey := &APIKey{OwnerEmail: "owner@example.com"}
+	u := &user.User{Email: "user@example.com"}
+	all := []string{CREATOR_SOURCE_API_KEY, CREATOR_SOURCE_USER, CREATOR_SOURCE_FORM}
+	noForm := []string{CREATOR_SOURCE_API_KEY, CREATOR_SOURCE_USER}
+
+	cases := []struct {
+		precedence []string
+		apiKey     *APIKey
+		user       *user.User
+		form       string
+		expected   string
+		source     string
+	}{
+		{all, apiKey, u, "form", "owner@example.com", CREATOR_SOURCE_API_KEY},
+		{all, nil, u, "form", "user@example.com", CREATOR_SOURCE_USER},
+		{all, nil, nil, "form", "form", CREATOR_SOURCE_FORM},
+		{all, apiKey, nil, "", "owner@example.com", CREATOR_SOURCE_API_KEY},
+		{all, &APIKey{}, nil, "form", "form", CREATOR_SOURCE_FORM},
+		{noForm, nil, u, "form", "user@example.com", CREATOR_SOURCE_USER},
+		{[]string{CREATOR_SOURCE_FORM, CREATOR_SOURCE_USER}, apiKey, u, "form", "form", CREATOR_SOURCE_FORM},
+		{[]string{CREATOR_SOURCE_USER, CREATOR_SOURCE_FORM, CREATOR_SOURCE_API_KEY}, apiKey, nil, "form", "form", CREATOR_SOURCE_FORM},
+	}
+
+	for i, tc := range cases {
+		creator, source, err := resolveCreator(tc.precedence, tc.apiKey, tc.user, tc.form)
+		if err != nil {
+			t.Errorf("Case %d: unexpected error %v", i, err)
+		} else if creator != tc.expected || source != tc.source {
+			t.Errorf("Case %d: expected %s from %s, got %s from %s", i, tc.expected, tc.source, creator, source)
+		}
+	}
+}
+
+func TestResolveCreatorFailsWithoutSource(t *testing.T) {
+	noForm := []string{CREATOR_SOURCE_API_KEY, CREATOR_SOURCE_USER}
+	if _, _, err := resolveCreator(noForm, nil, nil, "form"); err != errNoCreator {
+		t.Errorf("Expected errNoCreator with the form fallback disabled, got %v", err)
+	}
+	if _, _, err := resolveCreator(nil, &APIKey{OwnerEmail: "a@b.c"}, nil, "form"); err != errNoCreator {
+		t.Errorf("Expected errNoCreator with no sources, got %v", err)
+	}
+}
+
+func TestCreationAudit(t *testing.T) {
+	link := &Link{Creator: "user@example.com", creatorSource: CREATOR_SOURCE_USER}
+	audit := creationAudit([]string{CREATOR_SOURCE_USER, CREATOR_SOURCE_FORM}, link)
+	if audit == nil || audit.Creator != "user@example.com" || audit.Source != CREATOR_SOURCE_USER {
+		t.Errorf("Unexpected audit %+v", audit)
+	}
+	if audit = creationAudit([]string{CREATOR_SOURCE_API_KEY, CREATOR_SOURCE_USER}, link); audit != nil {
+		t.Errorf("Expected no audit without anonymous creators but got %+v", audit)
+	}
+}
@@ -0,0 +1,77 @@
+package hms
+
+import (
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// How many links someone has created, keyed by their Creator value. Kept up
+// to date as links are created and removed, so showing it doesn't mean
+// counting every link of theirs.
+type CreatorStats struct {
+	LinkCount int64
+}
+
+func creatorStatsKey(c context.Context, creator string) *datastore.Key {
+	return datastore.NewKey(c, "CreatorStats", creator, 0, nil)
+}
+
+// Returns how many links creator has. The first time, this counts them
+// (keys only) and stores the result for adjustCreatorLinkCount to keep up
+// to date.
+func getCreatorLinkCount(c context.Context, creator string) (int64, error) {
+	key := creatorStatsKey(c, creator)
+	var stats CreatorStats
+	err := datastore.Get(c, key, &stats)
+	if err == nil {
+		return stats.LinkCount, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return 0, err
+	}
+
+	count, err := datastore.NewQuery("Link").Filter("Creator =", creator).KeysOnly().Count(c)
+	if err != nil {
+		return 0, err
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		err := datastore.Get(tc, key, &stats)
+		if err == nil {
+			// Someone else got here first; theirs is as good as ours.
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		stats.LinkCount = int64(count)
+		_, err = datastore.Put(tc, key, &stats)
+		return err
+	}, nil)
+	return stats.LinkCount, err
+}
+
+// Adds delta to creator's link count, if it's being kept yet. Failures are
+// only logged: the count is for display, and shouldn't fail creations.
+func adjustCreatorLinkCount(c context.Context, creator string, delta int64) {
+	if creator == "" {
+		return
+	}
+
+	key := creatorStatsKey(c, creator)
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		var stats CreatorStats
+		if err := datastore.Get(tc, key, &stats); err != nil {
+			return err
+		}
+		stats.LinkCount += delta
+		if stats.LinkCount < 0 {
+			stats.LinkCount = 0
+		}
+		_, err := datastore.Put(tc, key, &stats)
+		return err
+	}, nil)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "Failed to update link count for %v: %v", creator, err)
+	}
+}
@@ -0,0 +1,176 @@
+package hms
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/urlfetch"
+)
+
+// Values for Link.AuthMode: how a link's Basic Auth credentials get to its
+// target.
+const (
+	// The redirect is replaced by fetching the target with an
+	// Authorization header and serving the response.
+	AUTH_MODE_PROXY = "proxy"
+	// The credentials are put in the target URL's userinfo. Some browsers
+	// ignore or refuse these.
+	AUTH_MODE_URL = "url"
+)
+
+// Headers copied from the target's response when proxying.
+var proxiedHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Disposition", "Cache-Control", "ETag", "Last-Modified",
+}
+
+var errCredentialsDisabled = errors.New("Links with credentials aren't enabled.")
+
+func isValidAuthMode(mode string) bool {
+	return mode == AUTH_MODE_PROXY || mode == AUTH_MODE_URL
+}
+
+// Returns the key credentials are encrypted with, from config.CredentialsKey.
+func credentialsKey() ([]byte, error) {
+	if !config.BasicAuthLinks {
+		return nil, errCredentialsDisabled
+	}
+	key, err := base64.StdEncoding.DecodeString(config.CredentialsKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("HMS_CREDENTIALS_KEY must be 32 base64-encoded bytes.")
+	}
+	return key, nil
+}
+
+// Encrypts username and password with key (AES-256-GCM). The nonce is stored
+// in front of the ciphertext.
+func sealCredentials(key []byte, username string, password string) ([]byte, error) {
+	gcm, err := newCredentialsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	plaintext := []byte(username + ":" + password)
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Reverses sealCredentials.
+func openCredentials(key []byte, sealed []byte) (string, string, error) {
+	gcm, err := newCredentialsCipher(key)
+	if err != nil {
+		return "", "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", "", errors.New("Stored credentials are truncated.")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	parts := strings.SplitN(string(plaintext), ":", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("Stored credentials are malformed.")
+	}
+	return parts[0], parts[1], nil
+}
+
+func newCredentialsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts and stores the credentials the link's target needs.
+func (l *Link) setCredentials(username string, password string, mode string) error {
+	if strings.Contains(username, ":") {
+		return errors.New("The username can't contain a colon.")
+	}
+	if mode == "" {
+		mode = AUTH_MODE_PROXY
+	} else if !isValidAuthMode(mode) {
+		return fmt.Errorf("authMode must be %q or %q", AUTH_MODE_PROXY, AUTH_MODE_URL)
+	}
+
+	key, err := credentialsKey()
+	if err != nil {
+		return err
+	}
+	sealed, err := sealCredentials(key, username, password)
+	if err != nil {
+		return err
+	}
+	l.AuthCredentials = sealed
+	l.AuthMode = mode
+	return nil
+}
+
+// Removes the link's credentials.
+func (l *Link) clearCredentials() {
+	l.AuthCredentials = nil
+	l.AuthMode = ""
+}
+
+// Returns the link's decrypted credentials.
+func (l *Link) credentials() (string, string, error) {
+	key, err := credentialsKey()
+	if err != nil {
+		return "", "", err
+	}
+	return openCredentials(key, l.AuthCredentials)
+}
+
+// Returns target with the credentials in its userinfo.
+func injectCredentials(target string, username string, password string) (string, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	parsed.User = url.UserPassword(username, password)
+	return parsed.String(), nil
+}
+
+// Fetches target with the credentials and writes its response to w. Only
+// GET and HEAD are proxied, and none of the client's own headers (like
+// cookies) are passed on.
+func proxyWithCredentials(c context.Context, w http.ResponseWriter, r *http.Request, target string, username string, password string) *appError {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), http.StatusMethodNotAllowed}
+	}
+
+	req, err := http.NewRequest(r.Method, target, nil)
+	if err != nil {
+		return &appError{err, err.Error(), 500}
+	}
+	req.SetBasicAuth(username, password)
+
+	resp, err := urlfetch.Client(c).Do(req)
+	if err != nil {
+		return &appError{err, "Couldn't reach this link's target.", 502}
+	}
+	defer resp.Body.Close()
+
+	for _, header := range proxiedHeaders {
+		if v := resp.Header.Get(header); v != "" {
+			w.Header().Set(header, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return nil
+}
@@ -0,0 +1,100 @@
+package hms
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/xsrftoken"
+
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	// Form field the index form's CSRF token is sent in.
+	CSRF_FIELD = "csrfToken"
+
+	// xsrftoken action ID for creating links from the index form.
+	CSRF_ACTION_CREATE = "create"
+)
+
+// Secret stored in the datastore, for when config.CSRFSecret isn't set.
+type CSRFSecret struct {
+	Secret string `datastore:",noindex"`
+}
+
+var (
+	csrfSecretMu     sync.Mutex
+	cachedCSRFSecret string
+)
+
+// Returns the secret index form tokens are signed with: config.CSRFSecret if
+// set, and otherwise one generated on first use and kept in the datastore so
+// that every instance agrees on it.
+func getCSRFSecret(c context.Context) (string, error) {
+	if config.CSRFSecret != "" {
+		return config.CSRFSecret, nil
+	}
+
+	csrfSecretMu.Lock()
+	defer csrfSecretMu.Unlock()
+	if cachedCSRFSecret != "" {
+		return cachedCSRFSecret, nil
+	}
+
+	key := datastore.NewKey(c, "CSRFSecret", "default", 0, nil)
+	var secret CSRFSecret
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		err := datastore.Get(tc, key, &secret)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if secret.Secret, err = newSecret(32); err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, key, &secret)
+		return err
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	cachedCSRFSecret = secret.Secret
+	return cachedCSRFSecret, nil
+}
+
+// Returns n bytes from crypto/rand, base64-encoded. randomString isn't
+// meant for secrets: math/rand's seed is just the instance's start time.
+func newSecret(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Returns a token for the index form, tied to userID (empty for anonymous
+// users).
+func newCSRFToken(c context.Context, userID string) (string, error) {
+	secret, err := getCSRFSecret(c)
+	if err != nil {
+		return "", err
+	}
+	return xsrftoken.Generate(secret, userID, CSRF_ACTION_CREATE), nil
+}
+
+// Returns whether token is a current index form token for userID. Always true
+// when CSRF protection is turned off.
+func checkCSRFToken(c context.Context, token string, userID string) (bool, error) {
+	if !config.CSRFProtection {
+		return true, nil
+	}
+
+	secret, err := getCSRFSecret(c)
+	if err != nil {
+		return false, err
+	}
+	return xsrftoken.Valid(token, secret, userID, CSRF_ACTION_CREATE), nil
+}
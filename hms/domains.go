@@ -0,0 +1,326 @@
+package hms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/idna"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	// Ownership of a domain is shown with a TXT record at this name under
+	// it, or a file at DOMAIN_VERIFICATION_PATH on it, holding the token.
+	DOMAIN_VERIFICATION_RECORD = "_hms-verification"
+	DOMAIN_VERIFICATION_PATH   = "/.well-known/hms-verification.txt"
+
+	DOMAIN_CHECK_TIMEOUT   = 10 * time.Second
+	DOMAIN_CHECK_MAX_BYTES = 16 * 1024
+
+	// How long a registration holds a domain without being verified.
+	// After that, someone else can register it.
+	DOMAIN_UNVERIFIED_TTL = 7 * 24 * time.Hour
+)
+
+// A custom domain someone wants links served under. Keyed by the domain's
+// ASCII name. Nothing may be served under it until Verified.
+type Domain struct {
+	Owner      string
+	Token      string `datastore:",noindex"`
+	Verified   bool
+	Created    time.Time
+	VerifiedAt time.Time
+}
+
+// Returns whether an unverified registration has held the domain for longer
+// than DOMAIN_UNVERIFIED_TTL by now, so it no longer blocks anyone.
+func (d *Domain) isAbandonedAt(now time.Time) bool {
+	return !d.Verified && now.Sub(d.Created) > DOMAIN_UNVERIFIED_TTL
+}
+
+// Returns whether name (from normalizeDomainName) is one of hosts, the
+// hosts the service itself is reached at.
+func isOwnDomain(name string, hosts []string) bool {
+	for _, host := range hosts {
+		if host != "" && hostName(host) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns every host the service is configured or known to be reached at.
+func ownHosts(c context.Context, r *http.Request) []string {
+	hosts := []string{r.Host, appengine.DefaultVersionHostname(c), config.CanonicalHost}
+	hosts = append(hosts, config.AllowedHosts...)
+	if base, err := url.Parse(config.BaseURL); err == nil {
+		hosts = append(hosts, base.Host)
+	}
+	return hosts
+}
+
+// Returns host without its port, lowercased.
+func hostName(host string) string {
+	host = strings.ToLower(host)
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return host
+}
+
+// Returns the host links generated for r should use: r.Host if it's in
+// config.AllowedHosts, and the canonical host otherwise.
+func linkHost(r *http.Request) string {
+	return allowedLinkHost(r.Host, config.AllowedHosts, config.CanonicalHost)
+}
+
+func allowedLinkHost(host string, allowed []string, canonical string) string {
+	if len(allowed) == 0 {
+		return host
+	}
+	for _, a := range allowed {
+		if hostName(a) == hostName(host) {
+			return host
+		}
+	}
+	if canonical != "" {
+		return canonical
+	}
+	return allowed[0]
+}
+
+func domainCacheKey(name string) string {
+	return "domain:" + name
+}
+
+// Returns whether links may be served on host. A registered domain has to be
+// verified first; hosts that were never registered, like the service's own,
+// are always allowed. Cached like feature flags.
+func isHostAllowed(c context.Context, host string) bool {
+	name := hostName(host)
+	if item, err := memcache.Get(c, domainCacheKey(name)); err == nil {
+		return string(item.Value) == "1"
+	}
+
+	allowed := true
+	var domain Domain
+	err := datastore.Get(c, datastore.NewKey(c, "Domain", name, 0, nil), &domain)
+	if err == nil {
+		allowed = domain.Verified
+	} else if err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "Failed to look up domain %v: %v", name, err)
+		return allowed
+	}
+
+	value := "0"
+	if allowed {
+		value = "1"
+	}
+	memcache.Set(c, &memcache.Item{
+		Key:        domainCacheKey(name),
+		Value:      []byte(value),
+		Expiration: FLAG_CACHE_TTL,
+	})
+	return allowed
+}
+
+type DomainResponse struct {
+	Success  bool
+	Domain   string
+	Verified bool
+	// What to publish to prove ownership; either works.
+	Token        string
+	TXTRecord    string
+	WellKnownURL string
+}
+
+// Returns the ASCII form of a domain name, or an error if it isn't one.
+func normalizeDomainName(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" || strings.ContainsAny(name, ":/@") || !strings.Contains(name, ".") {
+		return "", fmt.Errorf("Invalid domain %q", name)
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("Invalid domain %q: %v", name, err)
+	}
+	return ascii, nil
+}
+
+func writeDomainResponse(w http.ResponseWriter, name string, domain *Domain) {
+	respJSON, _ := json.Marshal(&DomainResponse{
+		Success:      true,
+		Domain:       name,
+		Verified:     domain.Verified,
+		Token:        domain.Token,
+		TXTRecord:    DOMAIN_VERIFICATION_RECORD + "." + name,
+		WellKnownURL: "http://" + name + DOMAIN_VERIFICATION_PATH,
+	})
+	w.Write(respJSON)
+}
+
+// Registers `domain` to the API key's owner and responds with the token that
+// verifies it. Registering a domain again returns the same token. A domain
+// someone else registered can only be taken over once their registration
+// has gone unverified for DOMAIN_UNVERIFIED_TTL.
+func handleRegisterDomain(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	name, err := normalizeDomainName(r.FormValue("domain"))
+	if err != nil {
+		return &appError{err, err.Error(), 400}
+	}
+	// Registering the service's own domain would stop it serving links
+	// until "verified".
+	if isOwnDomain(name, ownHosts(c, r)) {
+		return &appError{nil, "This service's own domain can't be registered.", 400}
+	}
+
+	key := datastore.NewKey(c, "Domain", name, 0, nil)
+	var domain Domain
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		err := datastore.Get(tc, key, &domain)
+		if err == nil {
+			if domain.Owner == apiKey.OwnerEmail {
+				return nil
+			} else if !domain.isAbandonedAt(time.Now()) {
+				return errDomainTaken
+			}
+			// Left unverified too long; it's the new registrant's now,
+			// with a new token.
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		domain = Domain{
+			Owner:   apiKey.OwnerEmail,
+			Token:   randomString(32),
+			Created: time.Now(),
+		}
+		_, err = datastore.Put(tc, key, &domain)
+		return err
+	}, nil)
+	memcache.Delete(c, domainCacheKey(name))
+	if err == errDomainTaken {
+		return &appError{err, err.Error(), http.StatusConflict}
+	} else if err != nil {
+		return &appError{err, "Datastore error: " + err.Error(), 500}
+	}
+
+	writeDomainResponse(w, name, &domain)
+	return nil
+}
+
+var errDomainTaken = errors.New("That domain is registered to someone else.")
+
+// Checks for the verification token of one of the API key owner's domains
+// and marks the domain verified if it's found.
+func handleVerifyDomain(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	name, err := normalizeDomainName(r.FormValue("domain"))
+	if err != nil {
+		return &appError{err, err.Error(), 400}
+	}
+
+	key := datastore.NewKey(c, "Domain", name, 0, nil)
+	var domain Domain
+	if err = datastore.Get(c, key, &domain); err == datastore.ErrNoSuchEntity {
+		return &appError{err, "That domain isn't registered.", 404}
+	} else if err != nil {
+		return &appError{err, "Datastore error: " + err.Error(), 500}
+	} else if domain.Owner != apiKey.OwnerEmail {
+		return &appError{nil, "That domain is registered to someone else.", 403}
+	}
+
+	if !domain.Verified {
+		if !checkDomainOwnership(c, name, domain.Token) {
+			return &appError{nil, "The verification token wasn't found. DNS changes can take a while to show up.", 400}
+		}
+
+		domain.Verified = true
+		domain.VerifiedAt = time.Now()
+		if _, err = datastore.Put(c, key, &domain); err != nil {
+			return &appError{err, "Datastore error: " + err.Error(), 500}
+		}
+		memcache.Delete(c, domainCacheKey(name))
+	}
+
+	writeDomainResponse(w, name, &domain)
+	return nil
+}
+
+// Returns whether token is published for name, in its TXT record or its
+// well-known file.
+func checkDomainOwnership(c context.Context, name string, token string) bool {
+	tc, cancel := context.WithTimeout(c, DOMAIN_CHECK_TIMEOUT)
+	defer cancel()
+	client := urlfetch.Client(tc)
+
+	// App Engine can't make DNS queries itself, so TXT records are looked
+	// up over HTTPS.
+	params := url.Values{"name": {DOMAIN_VERIFICATION_RECORD + "." + name}, "type": {"TXT"}}
+	body, err := fetchLimited(client, config.DNSResolverURL+"?"+params.Encode(), DOMAIN_CHECK_MAX_BYTES)
+	if err == nil {
+		found, err := txtRecordsContain(body, token)
+		if err != nil {
+			log.Warningf(c, "Bad DNS response for %v: %v", name, err)
+		} else if found {
+			return true
+		}
+	} else {
+		log.Infof(c, "TXT lookup for %v failed: %v", name, err)
+	}
+
+	for _, scheme := range []string{"https", "http"} {
+		resp, err := client.Get(scheme + "://" + name + DOMAIN_VERIFICATION_PATH)
+		if err != nil {
+			continue
+		}
+		file, err := ioutil.ReadAll(io.LimitReader(resp.Body, DOMAIN_CHECK_MAX_BYTES))
+		resp.Body.Close()
+		if err == nil && resp.StatusCode == http.StatusOK && strings.TrimSpace(string(file)) == token {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether a DNS-over-HTTPS JSON response (as served by Google and
+// Cloudflare) has a TXT record equal to token.
+func txtRecordsContain(body []byte, token string) (bool, error) {
+	var resp struct {
+		Answer []struct {
+			Type int    `json:"type"`
+			Data string `json:"data"`
+		}
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return false, err
+	}
+
+	const TXT = 16
+	for _, answer := range resp.Answer {
+		if answer.Type == TXT && strings.Trim(answer.Data, `"`) == token {
+			return true, nil
+		}
+	}
+	return false, nil
+}
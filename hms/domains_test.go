@@ -0,0 +1,90 @@
+package hms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeDomainName(t *testing.T) {
+	cases := map[string]string{
+		"Links.Example.com":  "links.example.com",
+		"links.example.com.": "links.example.com",
+		"bücher.example":     "xn--bcher-kva.example",
+	}
+	for name, expected := range cases {
+		if result, err := normalizeDomainName(name); err != nil || result != expected {
+			t.Errorf("For %q, expected %q but got %q, %v", name, expected, result, err)
+		}
+	}
+
+	for _, name := range []string{"", "localhost", "example.com:8080", "example.com/path", "user@example.com"} {
+		if result, err := normalizeDomainName(name); err == nil {
+			t.Errorf("Expected %q to be refused, got %q", name, result)
+		}
+	}
+}
+
+func TestTXTRecordsContain(t *testing.T) {
+	body := []byte(`{"Status": 0, "Answer": [
+		{"name": "_hms-verification.example.com.", "type": 5, "data": "token"},
+		{"name": "_hms-verification.example.com.", "type": 16, "data": "\"other\""},
+		{"name": "_hms-verification.example.com.", "type": 16, "data": "\"token\""}
+	]}`)
+
+	if found, err := txtRecordsContain(body, "token"); err != nil || !found {
+		t.Errorf("Expected the token to be found, got %v, %v", found, err)
+	}
+	if found, err := txtRecordsContain(body, "missing"); err != nil || found {
+		t.Errorf("Expected a missing token not to be found, got %v, %v", found, err)
+	}
+	if _, err := txtRecordsContain([]byte("not json"), "token"); err == nil {
+		t.Errorf("Expected an error for a bad response")
+	}
+}
+
+func TestAllowedLinkHost(t *testing.T) {
+	allowed := []string{"hms.space", "links.example.com"}
+	cases := []struct {
+		host      string
+		allowed   []string
+		canonical string
+		expected  string
+	}{
+		{"evil.example", nil, "", "evil.example"},
+		{"hms.space", allowed, "", "hms.space"},
+		{"Links.Example.com:8080", allowed, "", "Links.Example.com:8080"},
+		{"evil.example", allowed, "", "hms.space"},
+		{"evil.example", allowed, "go.hms.space", "go.hms.space"},
+	}
+	for _, tc := range cases {
+		if result := allowedLinkHost(tc.host, tc.allowed, tc.canonical); result != tc.expected {
+			t.Errorf("For %q allowing %v, expected %q but got %q", tc.host, tc.allowed, tc.expected, result)
+		}
+	}
+}
+
+func TestIsOwnDomain(t *testing.T) {
+	hosts := []string{"hms.appspot.com", "", "HMS.space:443", "go.example.com"}
+	for _, name := range []string{"hms.appspot.com", "hms.space", "go.example.com"} {
+		if !isOwnDomain(name, hosts) {
+			t.Errorf("Expected %q to be refused as one of the service's own", name)
+		}
+	}
+	if isOwnDomain("links.example.com", hosts) {
+		t.Errorf("Expected links.example.com to be registrable")
+	}
+}
+
+func TestDomainIsAbandonedAt(t *testing.T) {
+	now := time.Now()
+	stale := Domain{Created: now.Add(-DOMAIN_UNVERIFIED_TTL - time.Hour)}
+	if !stale.isAbandonedAt(now) {
+		t.Errorf("Expected an old unverified registration to be abandoned")
+	}
+	if fresh := (Domain{Created: now.Add(-time.Hour)}); fresh.isAbandonedAt(now) {
+		t.Errorf("Expected a new registration to be kept")
+	}
+	if stale.Verified = true; stale.isAbandonedAt(now) {
+		t.Errorf("Expected verified registrations to be kept")
+	}
+}
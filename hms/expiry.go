@@ -0,0 +1,150 @@
+package hms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Most paths POST /api/links/expiry takes at once.
+const MAX_EXPIRY_PATHS = 100
+
+// Parses a link's `expires` value: either an RFC 3339 time, or a duration
+// like "72h" counted from now. The result has to be in the future.
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		d, durErr := time.ParseDuration(value)
+		if durErr != nil {
+			return time.Time{}, fmt.Errorf("Invalid expires %q: use an RFC 3339 time or a duration like 72h", value)
+		}
+		expires = now.Add(d)
+	}
+
+	if !expires.After(now) {
+		return time.Time{}, fmt.Errorf("Invalid expires %q: it's already passed", value)
+	}
+	return expires, nil
+}
+
+// Returns whether the link has expired by t. Links without an ExpiresAt
+// never expire.
+func (l *Link) IsExpiredAt(t time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !t.Before(l.ExpiresAt)
+}
+
+type LinkExpiryResult struct {
+	Path      string
+	Success   bool
+	ExpiresAt *time.Time `json:",omitempty"`
+	Error     string     `json:",omitempty"`
+}
+
+type LinksExpiryResponse struct {
+	Success bool
+	Results []LinkExpiryResult
+}
+
+var errNotLinkOwner = errors.New("Only the link's creator or an admin can change it.")
+
+// Sets the expiry of the link at key, if the API key's owner may change it.
+func setLinkExpiry(c context.Context, key *datastore.Key, expiresAt time.Time, apiKey APIKey) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var link Link
+		if err := datastore.Get(tc, key, &link); err != nil {
+			return err
+		} else if !isLinkOwner(c, &link, apiKey) {
+			return errNotLinkOwner
+		}
+		link.ExpiresAt = expiresAt
+		link.Version++
+		_, err := datastore.Put(tc, key, &link)
+		return err
+	}, nil)
+}
+
+// Returns the distinct paths of a bulk expiry update, in the order given.
+func parseExpiryPaths(values []string) ([]string, error) {
+	seen := make(map[string]bool)
+	paths := make([]string, 0, len(values))
+	for _, path := range values {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("Missing path.")
+	} else if len(paths) > MAX_EXPIRY_PATHS {
+		return nil, fmt.Errorf("Too many paths; at most %d are allowed.", MAX_EXPIRY_PATHS)
+	}
+	return paths, nil
+}
+
+// Sets the expiry of every link in `path` (repeated, in `chatID` if given)
+// to `expires`, validated like a new link's. An alias's expiry is set on
+// its original, which its redirects use. Only links the API key's owner
+// created can be changed, unless they're an admin; the rest are reported as
+// failures alongside links that don't exist. Each link is updated in its own
+// transaction.
+func handleLinksExpiry(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+	r.ParseForm()
+	paths, err := parseExpiryPaths(r.Form["path"])
+	if err != nil {
+		return &appError{err, err.Error(), 400}
+	}
+	expiresAt, err := parseExpiry(r.FormValue("expires"), time.Now())
+	if err != nil {
+		return &appError{err, err.Error(), 400}
+	}
+	if _, err = parseChatID(r.FormValue("chatID")); err != nil {
+		return &appError{nil, "Bad chat ID", 400}
+	}
+
+	resp := LinksExpiryResponse{Success: true, Results: make([]LinkExpiryResult, len(paths))}
+	done := make(map[string]bool)
+	for i, path := range paths {
+		resp.Results[i].Path = path
+		key, link, appErr := findOwnedLink(c, r, apiKey, path)
+		if appErr != nil {
+			resp.Results[i].Error = appErr.Message
+			continue
+		}
+		updated := []*datastore.Key{key}
+		if link.AliasOf != nil {
+			// Redirects use the original's expiry.
+			key = link.AliasOf
+			updated = append(updated, key)
+		}
+
+		if !done[key.Encode()] {
+			if err = setLinkExpiry(c, key, expiresAt, apiKey); err == errNotLinkOwner {
+				resp.Results[i].Error = err.Error()
+				continue
+			} else if err == datastore.ErrNoSuchEntity {
+				resp.Results[i].Error = "No matching link"
+				continue
+			} else if err != nil {
+				return &appError{err, "Datastore error: " + err.Error(), 500}
+			}
+			done[key.Encode()] = true
+		}
+		uncacheLinks(c, updated...)
+		resp.Results[i].Success = true
+		resp.Results[i].ExpiresAt = &expiresAt
+	}
+
+	respJSON, _ := json.Marshal(&resp)
+	w.Write(respJSON)
+	return nil
+}
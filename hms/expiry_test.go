@@ -0,0 +1,60 @@
+package hms
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := map[string]time.Time{
+		"72h":                  now.Add(72 * time.Hour),
+		"90m":                  now.Add(90 * time.Minute),
+		"2016-03-05T00:00:00Z": time.Date(2016, 3, 5, 0, 0, 0, 0, time.UTC),
+	}
+	for value, expected := range cases {
+		if result, err := parseExpiry(value, now); err != nil || !result.Equal(expected) {
+			t.Errorf("For %q, expected %v but got %v, %v", value, expected, result, err)
+		}
+	}
+
+	for _, value := range []string{"", "soon", "-1h", "0s", "2016-02-01T00:00:00Z"} {
+		if result, err := parseExpiry(value, now); err == nil {
+			t.Errorf("Expected %q to be refused, got %v", value, result)
+		}
+	}
+}
+
+func TestIsExpiredAt(t *testing.T) {
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if (&Link{}).IsExpiredAt(now) {
+		t.Errorf("Expected a link without ExpiresAt never to expire")
+	}
+	if (&Link{ExpiresAt: now.Add(time.Second)}).IsExpiredAt(now) {
+		t.Errorf("Expected a link not to have expired before ExpiresAt")
+	}
+	if !(&Link{ExpiresAt: now}).IsExpiredAt(now) {
+		t.Errorf("Expected a link to have expired at ExpiresAt")
+	}
+}
+
+func TestParseExpiryPaths(t *testing.T) {
+	paths, err := parseExpiryPaths([]string{"a", "", "b", "a"})
+	if err != nil || len(paths) != 2 || paths[0] != "a" || paths[1] != "b" {
+		t.Errorf("Expected [a b] but got %v, %v", paths, err)
+	}
+
+	if _, err = parseExpiryPaths([]string{""}); err == nil {
+		t.Errorf("Expected no paths to be refused")
+	}
+	tooMany := make([]string, MAX_EXPIRY_PATHS+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("p%d", i)
+	}
+	if _, err = parseExpiryPaths(tooMany); err == nil {
+		t.Errorf("Expected more than %d paths to be refused", MAX_EXPIRY_PATHS)
+	}
+}
@@ -0,0 +1,116 @@
+package hms
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	FEED_PAGE_SIZE = 25
+	FEED_CACHE_TTL = 30 * time.Second
+)
+
+// A link as shown in the public feed, without anything identifying its
+// creator.
+type FeedLink struct {
+	Path      string
+	TargetURL string
+	Created   time.Time
+}
+
+type FeedResponse struct {
+	Success bool
+	Links   []FeedLink
+	// Pass back as `cursor` for the next page. Empty on the last page.
+	Cursor string
+}
+
+// Lists recently created public links, newest first, a page at a time. Only
+// links that resolve without a chat and aren't marked Private are public, and
+// only those redirecting now are listed.
+// Needs no API key, so it's rate limited per client and off unless
+// config.PublicFeed is set.
+func FeedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if !config.PublicFeed {
+		return &appError{nil, "Not found.", 404}
+	}
+	if r.Method != "GET" {
+		return &appError{nil, "Invalid request method: " + r.Method, 405}
+	}
+
+	c := appengine.NewContext(r)
+	if !allowRequest(c, "feed:"+r.RemoteAddr, config.FeedRateLimit) {
+		return &appError{nil, "Too many requests. Slow down.", http.StatusTooManyRequests}
+	}
+
+	cursor := r.FormValue("cursor")
+	cacheKey := "feed:" + cursor
+	w.Header().Set("Content-Type", "application/json")
+	if item, err := memcache.Get(c, cacheKey); err == nil {
+		var cached FeedResponse
+		json.Unmarshal(item.Value, &cached)
+		setPaginationLinks(w, r, cached.Cursor)
+		w.Write(item.Value)
+		return nil
+	}
+
+	q := datastore.NewQuery("Link").Filter("ChatKeys =", nil).Order("-Created")
+	if cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return &appError{err, "Bad cursor.", 400}
+		}
+		q = q.Start(decoded)
+	}
+
+	now := time.Now()
+	resp := FeedResponse{Success: true, Links: make([]FeedLink, 0, FEED_PAGE_SIZE)}
+	it := q.Limit(FEED_PAGE_SIZE).Run(c)
+	scanned := 0
+	for {
+		var link Link
+		_, err := it.Next(&link)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return &appError{err, err.Error(), 500}
+		}
+		scanned++
+
+		// Filtered here rather than in the query, since links from before
+		// Private existed don't have the property at all.
+		if !link.inFeedAt(now) {
+			continue
+		}
+		resp.Links = append(resp.Links, FeedLink{link.Path, link.TargetURL, link.Created})
+	}
+
+	if scanned == FEED_PAGE_SIZE {
+		next, err := it.Cursor()
+		if err != nil {
+			return &appError{err, err.Error(), 500}
+		}
+		resp.Cursor = next.String()
+	}
+
+	respJSON, _ := json.Marshal(&resp)
+	memcache.Set(c, &memcache.Item{
+		Key:        cacheKey,
+		Value:      respJSON,
+		Expiration: FEED_CACHE_TTL,
+	})
+	setPaginationLinks(w, r, resp.Cursor)
+	w.Write(respJSON)
+	return nil
+}
+
+// Returns whether the public feed lists the link at t: it has to be public,
+// unexpired and within its schedule.
+func (l *Link) inFeedAt(t time.Time) bool {
+	return !l.Private && !l.IsExpiredAt(t) && l.IsActiveAt(t)
+}
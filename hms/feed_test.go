@@ -0,0 +1,28 @@
+package hms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInFeedAt(t *testing.T) {
+	now := time.Date(2015, 11, 4, 12, 0, 0, 0, time.UTC) // Wednesday
+	weekdays := `{"timezone": "UTC", "windows": [{"days": ["wed"], "start": "09:00", "end": "17:00"}]}`
+	weekends := `{"timezone": "UTC", "windows": [{"days": ["sat", "sun"], "start": "09:00", "end": "17:00"}]}`
+	cases := []struct {
+		link     Link
+		expected bool
+	}{
+		{Link{}, true},
+		{Link{Private: true}, false},
+		{Link{ExpiresAt: now.Add(time.Hour)}, true},
+		{Link{ExpiresAt: now}, false},
+		{Link{Schedule: weekdays}, true},
+		{Link{Schedule: weekends}, false},
+	}
+	for _, tc := range cases {
+		if inFeed := tc.link.inFeedAt(now); inFeed != tc.expected {
+			t.Errorf("For %+v, expected inFeedAt=%v", tc.link, tc.expected)
+		}
+	}
+}
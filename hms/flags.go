@@ -0,0 +1,133 @@
+package hms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// A feature that can be switched on or off at runtime, without redeploying.
+// Stored with the flag's name as the key name.
+type FeatureFlag struct {
+	Enabled bool
+	Updated time.Time
+}
+
+const (
+	FLAG_MUSIC_INFO = "music_info"
+
+	FLAG_CACHE_TTL = time.Minute
+)
+
+// Used for flags that have never been set, so that behavior is unchanged
+// until an admin toggles something.
+var flagDefaults = map[string]bool{
+	FLAG_MUSIC_INFO:  true,
+	FLAG_OEMBED:      true,
+	FLAG_MUSIC_CACHE: true,
+}
+
+func flagCacheKey(name string) string {
+	return "flag:" + name
+}
+
+// Returns whether the named feature is enabled. Flags are cached in memcache
+// for FLAG_CACHE_TTL, so changes can take that long to take effect.
+func isFeatureEnabled(c context.Context, name string) bool {
+	if item, err := memcache.Get(c, flagCacheKey(name)); err == nil {
+		return string(item.Value) == "1"
+	}
+
+	enabled := flagDefaults[name]
+	var flag FeatureFlag
+	err := datastore.Get(c, datastore.NewKey(c, "FeatureFlag", name, 0, nil), &flag)
+	if err == nil {
+		enabled = flag.Enabled
+	} else if err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "Failed to read feature flag %v: %v", name, err)
+		return enabled
+	}
+
+	value := "0"
+	if enabled {
+		value = "1"
+	}
+	memcache.Set(c, &memcache.Item{
+		Key:        flagCacheKey(name),
+		Value:      []byte(value),
+		Expiration: FLAG_CACHE_TTL,
+	})
+	return enabled
+}
+
+func FeatureFlagHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	name := r.FormValue("name")
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+
+	if name == "" || err != nil {
+		w.Write([]byte("You forgot a parameter."))
+		return
+	}
+
+	flag := FeatureFlag{
+		Enabled: enabled,
+		Updated: time.Now(),
+	}
+	_, err = datastore.Put(c, datastore.NewKey(c, "FeatureFlag", name, 0, nil), &flag)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+	memcache.Delete(c, flagCacheKey(name))
+	w.Write([]byte("Success!"))
+}
+
+type AdminConfigResponse struct {
+	Config Config
+	// Current state of every flag that has a default or has been set.
+	Flags map[string]bool
+}
+
+// Shows the effective configuration, minus secrets, and the current feature
+// flags, for debugging deployments.
+func AdminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	flags := make(map[string]bool)
+	for name, enabled := range flagDefaults {
+		flags[name] = enabled
+	}
+
+	// Read the datastore directly, since the memcached values can be stale.
+	var stored []FeatureFlag
+	keys, err := datastore.NewQuery("FeatureFlag").GetAll(c, &stored)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+	for i, key := range keys {
+		flags[key.StringID()] = stored[i].Enabled
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	respJSON, _ := json.Marshal(&AdminConfigResponse{config.redacted(), flags})
+	w.Write(respJSON)
+}
@@ -0,0 +1,30 @@
+package hms
+
+import "net/http"
+
+// Values for Link.FrameOptions: whether pages the service serves for a link
+// may be framed by other sites.
+const (
+	FRAME_DENY        = "deny"
+	FRAME_SAME_ORIGIN = "sameorigin"
+	FRAME_ALLOW       = "allow"
+)
+
+func isValidFrameOption(option string) bool {
+	return option == FRAME_DENY || option == FRAME_SAME_ORIGIN || option == FRAME_ALLOW
+}
+
+// Sets the headers that control framing of a page served for the link. Links
+// without a setting can't be framed at all.
+func (l *Link) setFrameHeaders(w http.ResponseWriter) {
+	switch l.FrameOptions {
+	case FRAME_ALLOW:
+		return
+	case FRAME_SAME_ORIGIN:
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Set("Content-Security-Policy", "frame-ancestors 'self'")
+	default:
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	}
+}
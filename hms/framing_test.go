@@ -0,0 +1,27 @@
+package hms
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetFrameHeaders(t *testing.T) {
+	cases := map[string]string{
+		"":                "DENY",
+		FRAME_DENY:        "DENY",
+		FRAME_SAME_ORIGIN: "SAMEORIGIN",
+		FRAME_ALLOW:       "",
+	}
+
+	for option, expected := range cases {
+		w := httptest.NewRecorder()
+		link := Link{FrameOptions: option}
+		link.setFrameHeaders(w)
+		if got := w.Header().Get("X-Frame-Options"); got != expected {
+			t.Errorf("For %q, expected X-Frame-Options %q but got %q", option, expected, got)
+		}
+		if hasCSP := w.Header().Get("Content-Security-Policy") != ""; hasCSP != (expected != "") {
+			t.Errorf("For %q, Content-Security-Policy was %q", option, w.Header().Get("Content-Security-Policy"))
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package hms
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	HEALTH_CHECK_BATCH_SIZE  = 50
+	HEALTH_CHECK_CONCURRENCY = 5
+	HEALTH_CHECK_TIMEOUT     = 10 * time.Second
+
+	// Stored as LastHealthStatus when the target couldn't be reached at all.
+	HEALTH_STATUS_UNREACHABLE = -1
+)
+
+// Checks one batch of links and, if there are more, queues a task to check
+// the next batch. Each batch is small enough to finish well within a request
+// deadline, and the cursor makes the whole run resumable.
+func CheckLinkHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if !isInternalRequest(r) && !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	w.Header().Set("Content-Type", "text/plain")
+
+	q := datastore.NewQuery("Link").KeysOnly()
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Bad cursor."))
+			return
+		}
+		q = q.Start(decoded)
+	}
+
+	keys := make([]*datastore.Key, 0, HEALTH_CHECK_BATCH_SIZE)
+	it := q.Limit(HEALTH_CHECK_BATCH_SIZE).Run(c)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	checkLinksHealth(c, keys)
+
+	if len(keys) == HEALTH_CHECK_BATCH_SIZE {
+		next, err := it.Cursor()
+		if err == nil {
+			t := taskqueue.NewPOSTTask(r.URL.Path, url.Values{"cursor": {next.String()}})
+			_, err = taskqueue.Add(c, t, "")
+		}
+		if err != nil {
+			log.Errorf(c, "Failed to queue next health check batch: %v", err)
+		}
+	}
+
+	w.Write([]byte(fmt.Sprintf("Checked %d links.", len(keys))))
+}
+
+// Lists links whose last health check didn't return a 2xx status.
+func UnhealthyLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	w.Header().Set("Content-Type", "text/plain")
+	links, err := getUnhealthyLinks(c)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+
+	DELIM := "|||"
+	for _, link := range links {
+		s := link.Path + DELIM + link.TargetURL + DELIM
+		s += strconv.Itoa(link.LastHealthStatus) + DELIM
+		s += strconv.FormatInt(link.LastCheckedAt.Unix(), 10)
+		w.Write([]byte(s + "\n"))
+	}
+}
+
+func getUnhealthyLinks(c context.Context) ([]Link, error) {
+	links := make([]Link, 0)
+	_, err := datastore.NewQuery("Link").Filter("LastHealthStatus >=", 300).GetAll(c, &links)
+	if err != nil {
+		return nil, err
+	}
+	_, err = datastore.NewQuery("Link").
+		Filter("LastHealthStatus =", HEALTH_STATUS_UNREACHABLE).GetAll(c, &links)
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func checkLinksHealth(c context.Context, keys []*datastore.Key) {
+	sem := make(chan bool, HEALTH_CHECK_CONCURRENCY)
+	var wg sync.WaitGroup
+
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- true
+		go func(key *datastore.Key) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := checkLinkHealth(c, key); err != nil {
+				log.Errorf(c, "Health check for link %v failed: %v", key, err)
+			}
+		}(key)
+	}
+	wg.Wait()
+}
+
+func checkLinkHealth(c context.Context, key *datastore.Key) error {
+	var link Link
+	if err := datastore.Get(c, key, &link); err != nil {
+		return err
+	}
+
+	status := fetchHealthStatus(c, link.TargetURL)
+	fallbackStatuses := make([]int, len(link.FallbackTargets))
+	for i, target := range link.FallbackTargets {
+		fallbackStatuses[i] = fetchHealthStatus(c, target)
+	}
+	checkedAt := time.Now()
+
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		var current Link
+		if err := datastore.Get(tc, key, &current); err != nil {
+			return err
+		}
+		current.LastHealthStatus = status
+		current.FallbackHealthStatuses = fallbackStatuses
+		current.LastCheckedAt = checkedAt
+		current.Version++
+		_, err := datastore.Put(tc, key, &current)
+		return err
+	}, nil)
+	if err == nil {
+		// Redirects pick a fallback based on the new statuses.
+		uncacheLinks(c, key)
+	}
+	return err
+}
+
+// Returns whether a stored health status counts as up. Targets that haven't
+// been checked yet are assumed to be.
+func isHealthyStatus(status int) bool {
+	return status == 0 || (status >= 200 && status < 300)
+}
+
+// Returns the first fallback target the last health check found up, and
+// false if there isn't one.
+func (l *Link) healthyFallback() (string, bool) {
+	for i, target := range l.FallbackTargets {
+		status := 0
+		if i < len(l.FallbackHealthStatuses) {
+			status = l.FallbackHealthStatuses[i]
+		}
+		if isHealthyStatus(status) {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// Issues a HEAD request to target and returns the resulting status code, or
+// HEALTH_STATUS_UNREACHABLE if the request itself failed.
+func fetchHealthStatus(c context.Context, target string) int {
+	tc, cancel := context.WithTimeout(c, HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	resp, err := urlfetch.Client(tc).Head(target)
+	if err != nil {
+		log.Infof(c, "HEAD %v failed: %v", target, err)
+		return HEALTH_STATUS_UNREACHABLE
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
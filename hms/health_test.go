@@ -0,0 +1,24 @@
+package hms
+
+import "testing"
+
+func TestHealthyFallback(t *testing.T) {
+	link := Link{
+		FallbackTargets:        []string{"http://a.example", "http://b.example", "http://c.example"},
+		FallbackHealthStatuses: []int{HEALTH_STATUS_UNREACHABLE, 503, 200},
+	}
+	if target, ok := link.healthyFallback(); !ok || target != "http://c.example" {
+		t.Errorf("Expected the third fallback, got %q, %v", target, ok)
+	}
+
+	// Fallbacks added since the last check haven't been found down yet.
+	link.FallbackHealthStatuses = []int{404}
+	if target, ok := link.healthyFallback(); !ok || target != "http://b.example" {
+		t.Errorf("Expected the unchecked second fallback, got %q, %v", target, ok)
+	}
+
+	link.FallbackHealthStatuses = []int{500, 500, 500}
+	if target, ok := link.healthyFallback(); ok {
+		t.Errorf("Expected no healthy fallback, got %q", target)
+	}
+}
@@ -11,12 +11,11 @@ import (
 	"strings"
 	"time"
 
-	//"golang.org/x/net/context"
+	"golang.org/x/net/context"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/user"
 )
 
 type appError struct {
@@ -33,9 +32,37 @@ func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
 
 	http.HandleFunc("/add_api_key", APIKeyAddHandler)
+	http.HandleFunc("/revoke_api_key", APIKeyRevokeHandler)
 	http.HandleFunc("/add_chat", ChatAddHandler)
-	http.HandleFunc("/backup", BackupLinksHandler)
-	http.Handle("/api/", appHandler(APIHandler))
+	http.HandleFunc("/remove_chat", ChatRemoveHandler)
+	http.HandleFunc("/migrate_links", MigrateLinksHandler)
+	http.HandleFunc("/import_links", ImportLinksHandler)
+	http.HandleFunc("/import_links/chunk", ImportChunkHandler)
+	http.Handle("/backup", gzipHandler(http.HandlerFunc(BackupLinksHandler)))
+	http.HandleFunc("/backup/url", BackupURLHandler)
+	http.HandleFunc("/restore", RestoreLinksHandler)
+	http.Handle("/backup/download", gzipHandler(http.HandlerFunc(BackupDownloadHandler)))
+	if config.BasePath != "" {
+		// Where BackupURLHandler's URLs point.
+		http.Handle(config.BasePath+"/backup/download", gzipHandler(http.HandlerFunc(BackupDownloadHandler)))
+	}
+	http.HandleFunc("/repair_auto_links", RepairAutoLinksHandler)
+	http.HandleFunc("/check_link_health", CheckLinkHealthHandler)
+	http.HandleFunc("/unhealthy_links", UnhealthyLinksHandler)
+	http.HandleFunc("/recheck_safe_browsing", RecheckSafeBrowsingHandler)
+	http.HandleFunc("/set_flag", FeatureFlagHandler)
+	http.HandleFunc("/publish_pending", PublishPendingLinksHandler)
+	http.HandleFunc("/fetch_oembed", FetchOEmbedHandler)
+	http.HandleFunc("/fetch_music_info", FetchMusicInfoHandler)
+	http.HandleFunc("/record_click", RecordClickHandler)
+	http.HandleFunc("/metrics", MetricsHandler)
+	http.Handle("/qr_zip", appHandler(QRZipHandler))
+	http.HandleFunc("/api/debug/error", DebugErrorHandler)
+	http.Handle("/api/music/stats", gzipHandler(http.HandlerFunc(MusicStatsHandler)))
+	http.HandleFunc("/api/admin/config", AdminConfigHandler)
+	http.HandleFunc("/api/capabilities", CapabilitiesHandler)
+	http.Handle("/api/feed", gzipHandler(appHandler(FeedHandler)))
+	http.Handle("/api/", gzipHandler(appHandler(APIHandler)))
 	http.Handle("/", appHandler(ShortenerHandler))
 	//http.HandleFunc("/add", QuickAddHandler)
 	//http.HandleFunc("/", ShortenerHandler)
@@ -52,129 +79,375 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				asJson, _ := json.Marshal(e)
 				http.Error(w, string(asJson), e.Code)
 			} else {
-				w.WriteHeader(e.Code)
-				errTmpl, err := getErrorTemplate(e)
-				if err != nil {
-					defaultErrTmpl.Execute(w, e)
-				} else {
-					errTmpl.Execute(w, e)
-				}
+				renderErrorPage(w, e)
 			}
 		}
 	}
 }
 
-func BackupLinksHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	u := user.Current(c)
-	if u == nil {
-		loginUrl, _ := user.LoginURL(c, r.URL.RequestURI())
-		http.Redirect(w, r, loginUrl, http.StatusFound)
+// Renders the HTML page for a non-API error, using the template for its code
+// if there is one.
+func renderErrorPage(w http.ResponseWriter, e *appError) {
+	w.WriteHeader(e.Code)
+	errTmpl, err := getErrorTemplate(e)
+	if err != nil {
+		defaultErrTmpl.Execute(w, e)
+	} else {
+		errTmpl.Execute(w, e)
+	}
+}
+
+// Renders the error page for ?code=...&message=... exactly as ServeHTTP
+// would, so the error templates can be checked without causing real errors.
+// Only available on the dev server or to admins.
+func DebugErrorHandler(w http.ResponseWriter, r *http.Request) {
+	if !appengine.IsDevAppServer() && !handleAdminAuth(w, r) {
 		return
+	}
+
+	code, err := strconv.Atoi(r.FormValue("code"))
+	if err != nil || code < 400 || code > 599 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("code must be an HTTP error status."))
+		return
+	}
+
+	e := &appError{nil, r.FormValue("message"), code}
+	if e.Code == 500 {
+		http.Error(w, e.Message, e.Code)
 	} else {
-		if !u.Admin {
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("You're not an admin. Go away."))
+		renderErrorPage(w, e)
+	}
+}
+
+// Writes every link, one per line:
+//
+//	path|||target|||creator|||created|||fbChatID|||chatName|||id|||code|||originalTarget
+//
+// Links in several chats get a line per chat, and the chat fields are empty
+// for links that can be resolved without a chat. id is the link's
+// datastore ID and code is its auto-encoded path, which resolves to the
+// link even when it has a custom path. originalTarget is the target as it
+// was submitted, if it was stored. With ?privateNotes=true, each line also
+// ends with the link's private notes. With ?include=analytics, it then ends
+// with
+//
+//	privateNotes|||clicks|||lastClicked|||uniqueEstimate
+//
+// where privateNotes is "" unless asked for and lastClicked is a Unix time,
+// empty if the link was never clicked. See serveBackup for the JSON formats,
+// which don't depend on a delimiter.
+func BackupLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+	serveBackup(appengine.NewContext(r), w, r, r.FormValue("privateNotes") == "true")
+}
+
+// Writes the backup served by BackupLinksHandler, with each link's
+// PrivateNotes (quoted) if includeNotes is set, and its analytics after them
+// if includeAnalytics is.
+func writeBackup(c context.Context, w http.ResponseWriter, includeNotes bool, includeAnalytics bool) {
+	w.Header().Set("Content-Type", "text/plain")
+	results := datastore.NewQuery("Link").Order("-Created").Run(c)
+	DELIM := "|||"
+	for {
+		var link Link
+		key, err := results.Next(&link)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			w.Write([]byte(err.Error()))
 		} else {
-			w.Header().Set("Content-Type", "text/plain")
-			results := datastore.NewQuery("Link").Order("-Created").Run(c)
-			DELIM := "|||"
-			var link Link
-			for {
-				_, err := results.Next(&link)
-				if err == datastore.Done {
-					break
-				} else if err != nil {
-					w.Write([]byte(err.Error()))
-				} else {
-					var chat Chat
-					s := link.Path + DELIM + link.TargetURL + DELIM + link.Creator + DELIM
-					s += strconv.FormatInt(link.Created.Unix(), 10) + DELIM
-					if link.ChatKey != nil {
-						err = datastore.Get(c, link.ChatKey, &chat)
-						if err != nil {
-							continue
-						}
-						s += strconv.FormatInt(chat.FacebookChatID, 10) + DELIM + chat.ChatName
+			// Unmigrated links' chats are still in ChatKey. The line format
+			// can't say a link is in no chats, so those get a line without
+			// a chat rather than none at all.
+			migrateLink(&link)
+			chatKeys := link.ChatKeys
+			if len(chatKeys) == 0 {
+				chatKeys = []*datastore.Key{nil}
+			}
+			for _, chatKey := range chatKeys {
+				var chat Chat
+				s := link.Path + DELIM + link.TargetURL + DELIM + link.Creator + DELIM
+				s += strconv.FormatInt(link.Created.Unix(), 10) + DELIM
+				if chatKey != nil {
+					err = datastore.Get(c, chatKey, &chat)
+					if err != nil {
+						continue
 					}
-					w.Write([]byte(s + "\n"))
+					s += strconv.FormatInt(chat.FacebookChatID, 10) + DELIM + chat.ChatName
+				} else {
+					s += DELIM
+				}
+				s += DELIM + strconv.FormatInt(key.IntID(), 10) + DELIM + autoLinkPath(key.IntID())
+				s += DELIM + link.OriginalTarget
+				if includeNotes {
+					s += DELIM + strconv.Quote(link.PrivateNotes)
+				} else if includeAnalytics {
+					// So the analytics fields are always in the same place.
+					s += DELIM + strconv.Quote("")
 				}
+				if includeAnalytics {
+					s += DELIM + backupAnalyticsFields(&link, DELIM)
+				}
+				w.Write([]byte(s + "\n"))
 			}
 		}
 	}
 }
-func ChatAddHandler(w http.ResponseWriter, r *http.Request) {
+
+// Returns the analytics fields of link's text backup line.
+func backupAnalyticsFields(link *Link, delim string) string {
+	lastClicked := ""
+	if !link.LastClickedAt.IsZero() {
+		lastClicked = strconv.FormatInt(link.LastClickedAt.Unix(), 10)
+	}
+	return strconv.FormatInt(link.ClickCount, 10) + delim + lastClicked + delim + strconv.FormatInt(link.UniqueVisitors(), 10)
+}
+
+// Finds auto-encoded links whose path was never filled in (i.e. the second
+// write in createShortenedURL's transaction is missing) and fills it in.
+// Safe to run repeatedly.
+func RepairAutoLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+
 	c := appengine.NewContext(r)
-	u := user.Current(c)
-	if u == nil {
-		loginUrl, _ := user.LoginURL(c, r.URL.RequestURI())
-		http.Redirect(w, r, loginUrl, http.StatusFound)
+	w.Header().Set("Content-Type", "text/plain")
+	keys, err := datastore.NewQuery("Link").Filter("Path =", "").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+
+	repaired := 0
+	for _, key := range keys {
+		fixed, err := repairAutoLink(c, key)
+		if err != nil {
+			log.Errorf(c, "Failed to repair link %d: %v", key.IntID(), err)
+		} else if fixed {
+			repaired++
+		}
+	}
+	w.Write([]byte(fmt.Sprintf("Repaired %d of %d links.", repaired, len(keys))))
+}
+
+func repairAutoLink(c context.Context, key *datastore.Key) (bool, error) {
+	fixed := false
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		fixed = false
+		var link Link
+		if err := datastore.Get(tc, key, &link); err != nil {
+			return err
+		}
+
+		expected := autoLinkPath(key.IntID())
+		if link.Path == expected {
+			return nil
+		}
+
+		link.setPath(expected)
+		link.Version++
+		if _, err := datastore.Put(tc, key, &link); err != nil {
+			return err
+		}
+		fixed = true
+		return nil
+	}, nil)
+	return fixed, err
+}
+
+func ChatAddHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
 		return
+	}
+
+	c := appengine.NewContext(r)
+	name := r.FormValue("name")
+	strChatID := r.FormValue("fbID")
+
+	if name == "" || strChatID == "" {
+		w.Write([]byte("You forgot a parameter."))
+	}
+
+	fbChatID, err := strconv.ParseInt(strChatID, 10, 64)
+	if err != nil {
+		w.Write([]byte("Chat ID has to be a number."))
 	} else {
-		if !u.Admin {
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("You're not an admin. Go away."))
+		chat := Chat{
+			ChatName:       name,
+			FacebookChatID: fbChatID,
+		}
+		dkey := datastore.NewIncompleteKey(c, "Chat", nil)
+		_, err := datastore.Put(c, dkey, &chat)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
 		} else {
-			name := r.FormValue("name")
-			strChatID := r.FormValue("fbID")
+			w.Write([]byte("Success!"))
 
-			if name == "" || strChatID == "" {
-				w.Write([]byte("You forgot a parameter."))
-			}
+		}
+	}
+}
 
-			fbChatID, err := strconv.ParseInt(strChatID, 10, 64)
-			if err != nil {
-				w.Write([]byte("Chat ID has to be a number."))
-			} else {
-				chat := Chat{
-					ChatName:       name,
-					FacebookChatID: fbChatID,
-				}
-				dkey := datastore.NewIncompleteKey(c, "Chat", nil)
-				_, err := datastore.Put(c, dkey, &chat)
-				if err != nil {
-					w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
-				} else {
-					w.Write([]byte("Success!"))
+// Deletes a chat. Links in the chat stay around, minus their association
+// with it.
+func ChatRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
 
-				}
+	c := appengine.NewContext(r)
+	fbChatID, err := strconv.ParseInt(r.FormValue("fbID"), 10, 64)
+	if err != nil {
+		w.Write([]byte("Chat ID has to be a number."))
+		return
+	}
+
+	chatKeys, err := datastore.NewQuery("Chat").Filter("FacebookChatID =", fbChatID).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	} else if len(chatKeys) == 0 {
+		w.Write([]byte("No such chat."))
+		return
+	}
+
+	for _, chatKey := range chatKeys {
+		linkKeys, err := datastore.NewQuery("Link").Filter("ChatKeys =", chatKey).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+			return
+		}
+
+		for _, linkKey := range linkKeys {
+			if err = removeChatFromLink(c, linkKey, chatKey); err != nil {
+				w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+				return
 			}
 		}
+
+		if err = datastore.Delete(c, chatKey); err != nil {
+			w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+			return
+		}
 	}
+	w.Write([]byte("Success!"))
+}
+
+func removeChatFromLink(c context.Context, linkKey *datastore.Key, chatKey *datastore.Key) error {
+	defer uncacheLinks(c, linkKey)
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var link Link
+		if err := datastore.Get(tc, linkKey, &link); err != nil {
+			return err
+		}
+		// An unmigrated link's chat is still in ChatKey. Migrating it
+		// first also records that an empty ChatKeys means no chats.
+		migrateLink(&link)
+
+		remaining := make([]*datastore.Key, 0, len(link.ChatKeys))
+		for _, key := range link.ChatKeys {
+			if !key.Equal(chatKey) {
+				remaining = append(remaining, key)
+			}
+		}
+		link.ChatKeys = remaining
+		link.Version++
+		_, err := datastore.Put(tc, linkKey, &link)
+		return err
+	}, nil)
 }
+
 func APIKeyAddHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+
 	c := appengine.NewContext(r)
-	u := user.Current(c)
-	if u == nil {
-		loginUrl, _ := user.LoginURL(c, r.URL.RequestURI())
-		http.Redirect(w, r, loginUrl, http.StatusFound)
+	key := randomString(26)
+	owner := r.FormValue("owner")
+	rateLimit, err := strconv.Atoi(r.FormValue("rateLimit"))
+	if err != nil {
+		rateLimit = 0
+	}
+	scopes, err := parseScopes(r.FormValue("scopes"))
+	if err != nil {
+		w.Write([]byte(err.Error()))
 		return
+	}
+
+	if owner == "" {
+		w.Write([]byte("You forgot a parameter."))
 	} else {
-		if !u.Admin {
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("You're not an admin. Go away."))
+		apiKey := APIKey{
+			APIKey:     key,
+			OwnerEmail: owner,
+			RateLimit:  rateLimit,
+			Scopes:     scopes,
+		}
+		dkey := datastore.NewIncompleteKey(c, "APIKey", nil)
+		_, err := datastore.Put(c, dkey, &apiKey)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
 		} else {
-			key := randomString(26)
-			owner := r.FormValue("owner")
+			w.Write([]byte(key))
 
-			if owner == "" {
-				w.Write([]byte("You forgot a parameter."))
-			} else {
-				apiKey := APIKey{
-					APIKey:     key,
-					OwnerEmail: owner,
-				}
-				dkey := datastore.NewIncompleteKey(c, "APIKey", nil)
-				_, err := datastore.Put(c, dkey, &apiKey)
-				if err != nil {
-					w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
-				} else {
-					w.Write([]byte(key))
+		}
+	}
+}
 
-				}
+// Revokes the API key `key`, or every key owned by `owner`. The keys are kept
+// for auditing.
+func APIKeyRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	q := datastore.NewQuery("APIKey").KeysOnly()
+	if key := r.FormValue("key"); key != "" {
+		q = q.Filter("APIKey =", key)
+	} else if owner := r.FormValue("owner"); owner != "" {
+		q = q.Filter("OwnerEmail =", owner)
+	} else {
+		w.Write([]byte("You forgot a parameter."))
+		return
+	}
+
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+
+	revoked := 0
+	now := time.Now()
+	for _, key := range keys {
+		changed := false
+		err = datastore.RunInTransaction(c, func(tc context.Context) error {
+			changed = false
+			var apiKey APIKey
+			if err := datastore.Get(tc, key, &apiKey); err != nil {
+				return err
+			}
+			if apiKey.isRevoked() {
+				return nil
 			}
+			apiKey.RevokedAt = now
+			changed = true
+			_, err := datastore.Put(tc, key, &apiKey)
+			return err
+		}, nil)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+			return
+		} else if changed {
+			revoked++
 		}
 	}
+	w.Write([]byte(fmt.Sprintf("Revoked %d keys.", revoked)))
 }
 
 /*
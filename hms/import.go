@@ -0,0 +1,452 @@
+package hms
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/user"
+)
+
+const (
+	// Links stored per transaction. Each link is its own entity group, and
+	// cross-group transactions are limited to 25 groups.
+	IMPORT_BATCH_SIZE = 25
+	MAX_IMPORT_ROWS   = 5000
+	// Rows each ImportChunkHandler task imports, so that each stays well
+	// within a task's size limit and deadline.
+	IMPORT_CHUNK_ROWS = 100
+	// Most tasks taskqueue.AddMulti takes at once.
+	MAX_TASKS_PER_ADD = 100
+)
+
+// One row of an import CSV.
+type importRow struct {
+	// 1-based line in the CSV.
+	Line    int
+	Path    string
+	Target  string
+	Creator string
+	ChatID  string
+}
+
+type ImportRowResult struct {
+	Line     int
+	Path     string
+	ShortURL string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+type ImportResponse struct {
+	Success bool
+	// Pass as `id` to GET /import_links to see how the import is going.
+	ID      string `json:",omitempty"`
+	Created int
+	Failed  int
+	// Chunks of rows not imported yet. The results are final once it's 0.
+	Pending int
+	Rows    []ImportRowResult
+}
+
+// An import queued by ImportLinksHandler. ImportChunkHandler tasks import
+// its rows, each storing its results as a LinkImportChunk child with the
+// chunk's 1-based number as its ID.
+type LinkImport struct {
+	// The admin who started it, if they were logged in.
+	Admin   string
+	Host    string
+	Created time.Time
+	Chunks  int
+	// JSON []ImportRowResult of the rows refused before any were queued.
+	Refused string `datastore:",noindex"`
+}
+
+type LinkImportChunk struct {
+	// JSON []ImportRowResult.
+	Results string `datastore:",noindex"`
+}
+
+// Reads import rows of path,target,creator[,chatID]. A first row starting
+// with "path" is taken as a header and skipped.
+func parseImportRows(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	rows := make([]importRow, 0)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if line == 1 && len(record) > 0 && strings.EqualFold(record[0], "path") {
+			continue
+		}
+		if len(rows) == MAX_IMPORT_ROWS {
+			return nil, fmt.Errorf("Imports are limited to %d rows.", MAX_IMPORT_ROWS)
+		}
+
+		row := importRow{Line: line}
+		fields := []*string{&row.Path, &row.Target, &row.Creator, &row.ChatID}
+		for i := 0; i < len(record) && i < len(fields); i++ {
+			*fields[i] = strings.TrimSpace(record[i])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Queues the links in a CSV (the `csv` file of a multipart upload, or the
+// request body) with columns path, target, creator and optionally chatID to
+// be created, IMPORT_CHUNK_ROWS rows per task. Each row is validated like a
+// link created through the API, and ones that fail are reported and
+// skipped. An empty path gets an auto-encoded one, and an empty creator
+// means the admin running the import. Responds with an ImportResponse whose
+// ID can be passed back as `id` in a GET to follow the import's progress.
+func ImportLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+	c := appengine.NewContext(r)
+	if r.Method == "GET" {
+		writeImportStatus(c, w, r.FormValue("id"))
+		return
+	} else if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Imports have to be POSTed."))
+		return
+	}
+
+	var body io.Reader = r.Body
+	if file, _, err := r.FormFile("csv"); err == nil {
+		defer file.Close()
+		body = file
+	}
+	rows, err := parseImportRows(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad CSV: " + err.Error()))
+		return
+	}
+
+	rows, refused := splitDuplicateRows(rows)
+	refusedJSON, _ := json.Marshal(refused)
+	chunks := chunkImportRows(rows, IMPORT_CHUNK_ROWS)
+	imp := LinkImport{Host: linkHost(r), Created: time.Now(), Chunks: len(chunks), Refused: string(refusedJSON)}
+	if u := user.Current(c); u != nil {
+		imp.Admin = u.Email
+	}
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "LinkImport", nil), &imp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Datastore error: " + err.Error()))
+		return
+	}
+
+	tasks := make([]*taskqueue.Task, len(chunks))
+	for i, chunk := range chunks {
+		rowsJSON, _ := json.Marshal(chunk)
+		tasks[i] = taskqueue.NewPOSTTask("/import_links/chunk", url.Values{
+			"import": {key.Encode()},
+			"chunk":  {strconv.Itoa(i + 1)},
+			"rows":   {string(rowsJSON)},
+		})
+	}
+	if err = addTasks(c, tasks); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to queue the import: " + err.Error()))
+		return
+	}
+
+	writeImportStatus(c, w, key.Encode())
+}
+
+// Queues tasks, as few calls at a time as taskqueue allows.
+func addTasks(c context.Context, tasks []*taskqueue.Task) error {
+	for i := 0; i < len(tasks); i += MAX_TASKS_PER_ADD {
+		end := i + MAX_TASKS_PER_ADD
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		if _, err := taskqueue.AddMulti(c, tasks[i:end], ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the rows to import, leaving out (and reporting) ones whose path
+// an earlier row in the same chat already has, since newLink can't see
+// those until they're stored.
+func splitDuplicateRows(rows []importRow) ([]importRow, []ImportRowResult) {
+	taken := make(map[string]bool)
+	kept := make([]importRow, 0, len(rows))
+	refused := make([]ImportRowResult, 0)
+	for _, row := range rows {
+		if row.Path != "" {
+			name := row.ChatID + "/" + normalizePath(row.Path)
+			if taken[name] {
+				refused = append(refused, ImportRowResult{Line: row.Line, Path: row.Path, Error: "An earlier row has the same path."})
+				continue
+			}
+			taken[name] = true
+		}
+		kept = append(kept, row)
+	}
+	return kept, refused
+}
+
+func chunkImportRows(rows []importRow, size int) [][]importRow {
+	chunks := make([][]importRow, 0, (len(rows)+size-1)/size)
+	for i := 0; i < len(rows); i += size {
+		end := i + size
+		if end > len(rows) {
+			end = len(rows)
+		}
+		chunks = append(chunks, rows[i:end])
+	}
+	return chunks
+}
+
+// Imports one chunk of a LinkImport and stores its results. A chunk that
+// already has results is left alone, so retries don't import it twice.
+func ImportChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if !isInternalRequest(r) && !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	importKey, err := datastore.DecodeKey(r.FormValue("import"))
+	chunk, chunkErr := strconv.ParseInt(r.FormValue("chunk"), 10, 64)
+	var rows []importRow
+	if err == nil && chunkErr == nil {
+		err = json.Unmarshal([]byte(r.FormValue("rows")), &rows)
+	}
+	if err != nil || chunkErr != nil || chunk < 1 {
+		// Retrying won't help.
+		log.Errorf(c, "Bad import chunk %q of %q", r.FormValue("chunk"), r.FormValue("import"))
+		return
+	}
+
+	chunkKey := datastore.NewKey(c, "LinkImportChunk", "", chunk, importKey)
+	var imp LinkImport
+	if err = datastore.Get(c, chunkKey, &LinkImportChunk{}); err == nil {
+		return
+	} else if err != datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err = datastore.Get(c, importKey, &imp); err != nil {
+		log.Errorf(c, "Failed to load import %v: %v", importKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var admin *user.User
+	if imp.Admin != "" {
+		admin = &user.User{Email: imp.Admin}
+	}
+	resp := importLinks(c, rows, imp.Host, admin)
+	resultsJSON, _ := json.Marshal(resp.Rows)
+	if _, err = datastore.Put(c, chunkKey, &LinkImportChunk{string(resultsJSON)}); err != nil {
+		// The links are stored; a retry would only make them again.
+		log.Errorf(c, "Failed to store the results of import chunk %v: %v", chunkKey, err)
+	}
+}
+
+// Responds with how the import with the encoded key id is going.
+func writeImportStatus(c context.Context, w http.ResponseWriter, id string) {
+	key, err := datastore.DecodeKey(id)
+	var imp LinkImport
+	if err == nil {
+		err = datastore.Get(c, key, &imp)
+	}
+	if err == datastore.ErrNoSuchEntity || (err != nil && key == nil) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No such import."))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Datastore error: " + err.Error()))
+		return
+	}
+
+	resp := ImportResponse{Success: true, ID: id}
+	json.Unmarshal([]byte(imp.Refused), &resp.Rows)
+	chunkKeys := make([]*datastore.Key, imp.Chunks)
+	for i := range chunkKeys {
+		chunkKeys[i] = datastore.NewKey(c, "LinkImportChunk", "", int64(i+1), key)
+	}
+	chunks := make([]LinkImportChunk, imp.Chunks)
+	err = datastore.GetMulti(c, chunkKeys, chunks)
+	errs, _ := err.(appengine.MultiError)
+	if err != nil && errs == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Datastore error: " + err.Error()))
+		return
+	}
+	for i, chunk := range chunks {
+		if errs != nil && errs[i] != nil {
+			resp.Pending++
+			continue
+		}
+		var results []ImportRowResult
+		json.Unmarshal([]byte(chunk.Results), &results)
+		resp.Rows = append(resp.Rows, results...)
+	}
+	summarizeImport(&resp)
+
+	w.Header().Set("Content-Type", "application/json")
+	respJSON, _ := json.Marshal(&resp)
+	w.Write(respJSON)
+}
+
+// Sorts resp's rows by line and counts how many were created and failed.
+func summarizeImport(resp *ImportResponse) {
+	sort.Slice(resp.Rows, func(i, j int) bool { return resp.Rows[i].Line < resp.Rows[j].Line })
+	resp.Created, resp.Failed = 0, 0
+	for _, row := range resp.Rows {
+		if row.Error != "" {
+			resp.Failed++
+		} else {
+			resp.Created++
+		}
+	}
+}
+
+// Creates the links rows describe. Their targets are checked with Safe
+// Browsing in one lookup, and the follow-up work linkStored does per link is
+// batched: one CreatorStats update per creator and a few AddMulti calls.
+func importLinks(c context.Context, rows []importRow, host string, admin *user.User) ImportResponse {
+	resp := ImportResponse{Success: true, Rows: make([]ImportRowResult, len(rows))}
+	fail := func(i int, err error) {
+		resp.Rows[i].Error = err.Error()
+		resp.Failed++
+	}
+
+	links := make([]*Link, len(rows))
+	targets := make([]string, 0, len(rows))
+	for i, row := range rows {
+		resp.Rows[i] = ImportRowResult{Line: row.Line, Path: row.Path}
+		chatID, err := parseChatID(row.ChatID)
+		if err != nil {
+			fail(i, errors.New("Bad chat ID"))
+			continue
+		}
+
+		links[i], err = newLink(c, linkRequest{
+			Form:    url.Values{"path": {row.Path}, "target": {row.Target}},
+			Host:    host,
+			ChatID:  chatID,
+			User:    admin,
+			Creator: row.Creator,
+			Bulk:    true,
+		})
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		targets = append(targets, links[i].safeBrowsingTargets()...)
+	}
+
+	flagged, checked := lookupSafeBrowsing(c, targets)
+	batch := make([]int, 0, IMPORT_BATCH_SIZE)
+	createdBy := make(map[string]int64)
+	tasks := make([]*taskqueue.Task, 0)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		batchLinks := make([]*Link, len(batch))
+		for j, i := range batch {
+			batchLinks[j] = links[i]
+		}
+		keys, err := putImportBatch(c, batchLinks)
+		for j, i := range batch {
+			if err != nil {
+				fail(i, err)
+				continue
+			}
+			logCreation(c, keys[j], links[i])
+			createdBy[links[i].Creator]++
+			for _, t := range []*taskqueue.Task{newOEmbedFetchTask(c, keys[j]), newMusicInfoFetchTask(keys[j], links[i])} {
+				if t != nil {
+					tasks = append(tasks, t)
+				}
+			}
+			resp.Rows[i].Path = links[i].Path
+			resp.Rows[i].ShortURL = shortURL(host, links[i].Path)
+			resp.Created++
+		}
+		batch = batch[:0]
+	}
+
+links:
+	for i, link := range links {
+		if link == nil {
+			continue
+		}
+		for _, target := range link.safeBrowsingTargets() {
+			if threatType, ok := flagged[target]; ok {
+				fail(i, safeBrowsingError(target, threatType))
+				continue links
+			}
+		}
+		link.setSafeBrowsingStatus(safeBrowsingStatus(link.safeBrowsingTargets(), flagged, checked), link.Created)
+		batch = append(batch, i)
+		if len(batch) == IMPORT_BATCH_SIZE {
+			flush()
+		}
+	}
+	flush()
+
+	for creator, n := range createdBy {
+		adjustCreatorLinkCount(c, creator, n)
+	}
+	if err := addTasks(c, tasks); err != nil {
+		log.Errorf(c, "Failed to queue follow-up tasks for imported links: %v", err)
+	}
+	return resp
+}
+
+// Stores links in one transaction, giving the ones without a path an
+// auto-encoded one.
+func putImportBatch(c context.Context, links []*Link) ([]*datastore.Key, error) {
+	low, _, err := datastore.AllocateIDs(c, "Link", nil, len(links))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*datastore.Key, len(links))
+	for i, link := range links {
+		keys[i] = datastore.NewKey(c, "Link", "", low+int64(i), nil)
+		if link.Path == "" {
+			link.setPath(autoLinkPath(keys[i].IntID()))
+		}
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		_, err := datastore.PutMulti(tc, keys, links)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		log.Errorf(c, "Failed to store an import batch: %v", err)
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,82 @@
+package hms
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseImportRows(t *testing.T) {
+	csv := "path,target,creator,chatID\n" +
+		"docs,https://example.com/docs,a@example.com\n" +
+		`, "https://example.com/?a=1,2", b@example.com, 42` + "\n"
+	rows, err := parseImportRows(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []importRow{
+		{2, "docs", "https://example.com/docs", "a@example.com", ""},
+		{3, "", "https://example.com/?a=1,2", "b@example.com", "42"},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, rows)
+	}
+
+	if _, err = parseImportRows(strings.NewReader("docs,\"unterminated\n")); err == nil {
+		t.Errorf("Expected a malformed CSV to be refused")
+	}
+}
+
+func TestSplitDuplicateRows(t *testing.T) {
+	rows := []importRow{
+		{2, "docs", "https://example.com/1", "", ""},
+		{3, "Docs", "https://example.com/2", "", ""},
+		{4, "docs", "https://example.com/3", "", "42"},
+		{5, "", "https://example.com/4", "", ""},
+		{6, "", "https://example.com/5", "", ""},
+	}
+	kept, refused := splitDuplicateRows(rows)
+
+	expected := []importRow{rows[0], rows[2], rows[3], rows[4]}
+	if !reflect.DeepEqual(kept, expected) {
+		t.Errorf("Expected %+v to be kept but got %+v", expected, kept)
+	}
+	if len(refused) != 1 || refused[0].Line != 3 || refused[0].Error == "" {
+		t.Errorf("Expected line 3 to be refused but got %+v", refused)
+	}
+}
+
+func TestChunkImportRows(t *testing.T) {
+	rows := make([]importRow, 5)
+	for i := range rows {
+		rows[i].Line = i + 2
+	}
+
+	chunks := chunkImportRows(rows, 2)
+	if len(chunks) != 3 || len(chunks[0]) != 2 || len(chunks[2]) != 1 || chunks[2][0].Line != 6 {
+		t.Errorf("Expected chunks of 2, 2 and 1 rows but got %+v", chunks)
+	}
+	if chunks = chunkImportRows(nil, 2); len(chunks) != 0 {
+		t.Errorf("Expected no chunks for no rows but got %+v", chunks)
+	}
+}
+
+func TestSummarizeImport(t *testing.T) {
+	resp := ImportResponse{Rows: []ImportRowResult{
+		{Line: 4, Error: "Bad chat ID"},
+		{Line: 2},
+		{Line: 3},
+	}}
+	summarizeImport(&resp)
+
+	if resp.Created != 2 || resp.Failed != 1 {
+		t.Errorf("Expected 2 created and 1 failed but got %d and %d", resp.Created, resp.Failed)
+	}
+	for i, row := range resp.Rows {
+		if row.Line != i+2 {
+			t.Errorf("Expected the rows sorted by line but got %+v", resp.Rows)
+			break
+		}
+	}
+}
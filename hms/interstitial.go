@@ -0,0 +1,68 @@
+package hms
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// How long the interstitial waits before continuing on its own.
+const INTERSTITIAL_DELAY_SECONDS = 5
+
+var interstitialTmpl = template.Must(getTemplate("interstitial.html"))
+
+type InterstitialTemplateParams struct {
+	Target string
+	// Target's host, which is what's shown.
+	Host string
+	// Seconds until the page continues to Target, or 0 to wait for a click.
+	Delay int
+	Badge TrustBadge
+	// Checked HTML embedded in the page; see parseSnippet.
+	Snippet template.HTML
+}
+
+// What the interstitial and listing say about whether a link's target looks
+// safe.
+type TrustBadge struct {
+	// "passed", "flagged" or "unknown" (when Safe Browsing is off, or
+	// hasn't checked the link).
+	SafeBrowsing string
+	HTTPS        bool
+}
+
+func (l *Link) TrustBadge() TrustBadge {
+	badge := TrustBadge{SafeBrowsing: l.SafeBrowsingStatus, HTTPS: strings.HasPrefix(strings.ToLower(l.TargetURL), "https://")}
+	if badge.SafeBrowsing == SAFE_BROWSING_UNKNOWN {
+		badge.SafeBrowsing = "unknown"
+	}
+	return badge
+}
+
+func newInterstitialParams(target string, autoContinue bool, badge TrustBadge, snippet template.HTML) (InterstitialTemplateParams, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return InterstitialTemplateParams{}, err
+	}
+	params := InterstitialTemplateParams{Target: target, Host: parsed.Hostname(), Badge: badge, Snippet: snippet}
+	if autoContinue {
+		params.Delay = INTERSTITIAL_DELAY_SECONDS
+	}
+	return params, nil
+}
+
+// Serves a page saying where the link goes, with a button to continue to
+// target, in place of the redirect. With autoContinue, it also continues by
+// itself after INTERSTITIAL_DELAY_SECONDS. badge is shown alongside, and
+// snippet is embedded.
+func renderInterstitial(w http.ResponseWriter, target string, autoContinue bool, badge TrustBadge, snippet template.HTML) *appError {
+	params, err := newInterstitialParams(target, autoContinue, badge, snippet)
+	if err != nil {
+		return &appError{err, err.Error(), 500}
+	}
+	// Browsers would otherwise skip the page once they'd seen it.
+	w.Header().Set("Cache-Control", "no-store")
+	interstitialTmpl.Execute(w, params)
+	return nil
+}
@@ -0,0 +1,26 @@
+package hms
+
+import "testing"
+
+func TestNewInterstitialParams(t *testing.T) {
+	params, err := newInterstitialParams("https://user:pw@Example.com:8443/a?b=c", true, TrustBadge{}, "")
+	if err != nil || params.Host != "Example.com" || params.Delay != INTERSTITIAL_DELAY_SECONDS {
+		t.Errorf("Unexpected params %+v, %v", params, err)
+	}
+
+	if params, err = newInterstitialParams("https://example.com/", false, TrustBadge{}, ""); err != nil || params.Delay != 0 {
+		t.Errorf("Expected previews to wait for a click but got %+v, %v", params, err)
+	}
+}
+
+func TestTrustBadge(t *testing.T) {
+	link := Link{TargetURL: "HTTPS://example.com/", SafeBrowsingStatus: SAFE_BROWSING_PASSED}
+	if badge := link.TrustBadge(); badge != (TrustBadge{"passed", true}) {
+		t.Errorf("Unexpected badge %+v", badge)
+	}
+
+	link = Link{TargetURL: "http://example.com/"}
+	if badge := link.TrustBadge(); badge != (TrustBadge{"unknown", false}) {
+		t.Errorf("Expected an unchecked link's badge to be unknown but got %+v", badge)
+	}
+}
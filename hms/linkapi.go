@@ -0,0 +1,418 @@
+package hms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// Handles /api/link/{path}, for working with a single link by its path (in
+// `chatID`, if given).
+func handleLink(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	path := strings.TrimPrefix(r.URL.Path, "/api/link/")
+	if path == "" {
+		return &appError{nil, "Missing path.", 401}
+	}
+
+	switch r.Method {
+	case "GET":
+		return handleLinkInfo(c, w, r, path)
+	case "PUT":
+		return handleUpdateLink(c, w, r, apiKey, path)
+	case "DELETE":
+		return handleDeleteLink(c, w, r, apiKey, path)
+	default:
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+}
+
+// Response to GET /api/link/{path}.
+type LinkInfoResponse struct {
+	TargetURL  string
+	Creator    string
+	Created    time.Time
+	ClickCount int64
+	MusicInfo  MusicInfo
+	// Only set for links that expire.
+	ExpiresAt *time.Time `json:",omitempty"`
+	// Pass as `version` to PUT /api/link/{path}.
+	Version int64
+}
+
+func newLinkInfo(link *Link) LinkInfoResponse {
+	info := LinkInfoResponse{link.TargetURL, link.Creator, link.Created, link.ClickCount, link.MusicInfo, nil, link.Version}
+	if !link.ExpiresAt.IsZero() {
+		expiresAt := link.ExpiresAt
+		info.ExpiresAt = &expiresAt
+	}
+	return info
+}
+
+// Describes the link at path without redirecting to it, so clients can show
+// where it goes before following it.
+func handleLinkInfo(c context.Context, w http.ResponseWriter, r *http.Request, path string) *appError {
+	link, err := getLinkInfoByPath(c, r.FormValue("chatID"), path, config.AmbiguousPaths)
+	if _, ok := err.(*strconv.NumError); ok {
+		return &appError{err, "Bad chat ID", 400}
+	} else if err != nil {
+		return &appError{err, "No matching link", 404}
+	}
+
+	respJSON, _ := json.Marshal(newLinkInfo(link))
+	w.Write(respJSON)
+	return nil
+}
+
+// Looks up path both as a code and as a manual path in the chat, in the
+// order the redirect tries them (see shortenerRoutes), so an ambiguous path
+// is described as the link it goes to.
+func getLinkInfoByPath(c context.Context, strChatID string, path string, preference string) (*Link, error) {
+	if preference != AMBIGUOUS_PREFER_MANUAL {
+		if _, link := getAutoLinkByPath(c, path); link != nil {
+			return link, nil
+		}
+	}
+	link, err := getMatchingLinkChatString(c, strChatID, path)
+	if _, ok := err.(*strconv.NumError); ok || err == nil || preference != AMBIGUOUS_PREFER_MANUAL {
+		return link, err
+	}
+	if _, link := getAutoLinkByPath(c, path); link != nil {
+		return link, nil
+	}
+	return nil, err
+}
+
+// Body of POST /api/link.
+type CreateLinkRequest struct {
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	// Omitted for links that resolve without a chat.
+	ChatID    *int64 `json:"chatID"`
+	Permanent bool   `json:"permanent"`
+	// Return an existing link to the (canonicalized) target instead of
+	// making another; see createLink.
+	Reuse bool `json:"reuse"`
+}
+
+type CreateLinkResponse struct {
+	ShortURL string         `json:"shortUrl"`
+	Path     string         `json:"path"`
+	Warnings []string       `json:"warnings,omitempty"`
+	Audit    *CreationAudit `json:"audit,omitempty"`
+}
+
+// Handles POST /api/link, which creates a link like /api/add but takes a
+// JSON body, for clients that don't speak forms.
+func handleCreateLink(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "POST" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	var body CreateLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return &appError{err, "Invalid JSON body: " + err.Error(), 400}
+	}
+
+	chatID := NoChat
+	if body.ChatID != nil {
+		chatID = SomeChat(*body.ChatID)
+	}
+
+	result, err := createLink(c, linkRequest{
+		Form: url.Values{
+			"path":      {body.Path},
+			"target":    {body.Target},
+			"permanent": {strconv.FormatBool(body.Permanent)},
+			"reuse":     {strconv.FormatBool(body.Reuse)},
+		},
+		Host:       linkHost(r),
+		ChatID:     chatID,
+		APIKey:     &apiKey,
+		User:       user.Current(c),
+		RemoteAddr: r.RemoteAddr,
+	})
+	if taken, ok := err.(*pathTakenError); ok {
+		writeConflict(w, taken)
+		return nil
+	} else if err == errNoCreator {
+		return &appError{err, err.Error(), 401}
+	} else if err != nil {
+		return &appError{err, err.Error(), 400}
+	}
+
+	resp := CreateLinkResponse{result.ShortURL, result.Path, result.Warnings, result.Audit}
+	if chatID.Valid {
+		resp.ShortURL += "?chatID=" + chatID.String()
+	}
+	respJSON, _ := json.Marshal(&resp)
+	w.Write(respJSON)
+	return nil
+}
+
+// Finds the link at path and checks that the API key's owner may change it:
+// they have to have created it, or be a logged-in admin.
+func findOwnedLink(c context.Context, r *http.Request, apiKey APIKey, path string) (*datastore.Key, *Link, *appError) {
+	key, link, err := getMatchingLinkKeyChatString(c, r.FormValue("chatID"), path)
+	if _, ok := err.(*strconv.NumError); ok {
+		return nil, nil, &appError{err, "Bad chat ID", 400}
+	} else if err != nil {
+		// Auto-encoded links whose path never got written (see
+		// RepairAutoLinksHandler) can only be found by their ID.
+		if key, link = getAutoLinkByPath(c, path); link == nil {
+			return nil, nil, &appError{err, "No matching link", 404}
+		}
+	}
+
+	if !isLinkOwner(c, link, apiKey) {
+		return nil, nil, &appError{errNotLinkOwner, errNotLinkOwner.Error(), 403}
+	}
+	return key, link, nil
+}
+
+// Returns whether the API key's owner created the link or is a logged-in
+// admin, the people who may change it and see its PrivateNotes.
+func isLinkOwner(c context.Context, link *Link, apiKey APIKey) bool {
+	return link.Creator == apiKey.OwnerEmail || user.IsAdmin(c)
+}
+
+// Returns the auto-encoded link path decodes to, or nil if there isn't one.
+func getAutoLinkByPath(c context.Context, path string) (*datastore.Key, *Link) {
+	if config.CaseInsensitiveCodes {
+		path = normalizeAutoCode(path)
+	}
+	if !autoCodeRegex.MatchString("/" + path) {
+		return nil, nil
+	}
+	id := ShortURLDecode(path)
+	if id <= 0 {
+		return nil, nil
+	}
+
+	key := datastore.NewKey(c, "Link", "", id, nil)
+	var link Link
+	if err := datastore.Get(c, key, &link); err != nil {
+		return nil, nil
+	}
+	return key, &link
+}
+
+// Deletes the link, keeping a copy as a DeletedLink like /api/remove does.
+func handleDeleteLink(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey, path string) *appError {
+	key, link, appErr := findOwnedLink(c, r, apiKey, path)
+	if appErr != nil {
+		return appErr
+	}
+
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := datastore.Put(tc, datastore.NewIncompleteKey(tc, "DeletedLink", nil), link); err != nil {
+			return err
+		}
+		return datastore.Delete(tc, key)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return &appError{err, "Datastore error: " + err.Error(), 500}
+	}
+	uncacheLinks(c, key)
+	adjustCreatorLinkCount(c, link.Creator, -1)
+
+	respJSON, _ := json.Marshal(RemoveResponse{true, 1, ""})
+	w.Write(respJSON)
+	return nil
+}
+
+var errVersionConflict = errors.New("The link has changed since that version; load it again and retry.")
+
+// Returns errVersionConflict unless the link is at the expected Version.
+func checkLinkVersion(link *Link, expected int64) error {
+	if link.Version != expected {
+		return errVersionConflict
+	}
+	return nil
+}
+
+// Points the link at target, validating it the same way createShortenedURL
+// does. Everything else about the link, including its creator, creation time
+// and click count, stays the same. Fails with errVersionConflict if the link
+// isn't at version. Returns the updated link.
+func UpdateLinkTarget(c context.Context, key *datastore.Key, link *Link, target string, host string, version int64) (*Link, error) {
+	if link.AliasOf != nil {
+		return nil, errors.New("Aliases always use their original link's target.")
+	}
+
+	updated := *link
+	updated.OriginalTarget = ""
+	parsedUrl, err := updated.setTarget(target, host)
+	if err != nil {
+		return nil, err
+	}
+	if updated.Templated {
+		if err = validateTargetTemplate(parsedUrl); err != nil {
+			return nil, err
+		}
+	}
+	status, err := checkSafeBrowsing(c, updated.safeBrowsingTargets())
+	if err != nil {
+		return nil, err
+	}
+	updated.setSafeBrowsingStatus(status, time.Now())
+
+	clearCredentials := false
+	if previous, err := link.parseTarget(); err != nil || previous.Host != parsedUrl.Host {
+		// Don't hand the old target's credentials to a different host.
+		clearCredentials = len(link.AuthCredentials) > 0
+	}
+
+	if clearCredentials {
+		updated.warnings = append(updated.warnings, "The link's credentials were removed because the target is on a different host.")
+	}
+
+	updated.MusicInfo, updated.HasMusic = MusicInfo{}, false
+	fillMusicInfo(c, &updated)
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		var current Link
+		if err := datastore.Get(tc, key, &current); err != nil {
+			return err
+		} else if err = checkLinkVersion(&current, version); err != nil {
+			return err
+		}
+		current.Version++
+		current.TargetURL = updated.TargetURL
+		current.OriginalTarget = updated.OriginalTarget
+		current.SafeBrowsingStatus = updated.SafeBrowsingStatus
+		current.SafeBrowsingCheckedAt = updated.SafeBrowsingCheckedAt
+		current.MusicInfo = updated.MusicInfo
+		current.HasMusic = updated.HasMusic
+		current.OEmbedInfo = OEmbedInfo{}
+		// The health check results were for the old target.
+		current.LastHealthStatus = 0
+		current.LastCheckedAt = time.Time{}
+		if clearCredentials {
+			current.clearCredentials()
+		}
+		current.warnings = updated.warnings
+		current.musicInfoPending = updated.musicInfoPending
+		_, err := datastore.Put(tc, key, &current)
+		updated = current
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	uncacheLinks(c, key)
+
+	queueOEmbedFetch(c, key)
+	queueMusicInfoFetch(c, key, &updated)
+	return &updated, nil
+}
+
+// Replaces the link's PrivateNotes and Metadata (already validated) with
+// the given ones, leaving nil ones alone. Fails with errVersionConflict if
+// the link isn't at version. Returns the updated link.
+func updateLinkNotes(c context.Context, key *datastore.Key, notes *string, metadata *string, version int64) (*Link, error) {
+	if notes != nil {
+		if err := validatePrivateNotes(*notes); err != nil {
+			return nil, err
+		}
+	}
+
+	var link Link
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		if err := datastore.Get(tc, key, &link); err != nil {
+			return err
+		} else if err = checkLinkVersion(&link, version); err != nil {
+			return err
+		}
+		link.Version++
+		if notes != nil {
+			link.PrivateNotes = *notes
+		}
+		if metadata != nil {
+			link.Metadata = *metadata
+		}
+		_, err := datastore.Put(tc, key, &link)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	uncacheLinks(c, key)
+	return &link, nil
+}
+
+// Changes the link's target to the `target` form value, its private notes
+// to `privateNotes` and/or its metadata to `metadata` ("{}" clears it).
+// `version` has to be the Version the client last read; if the link has been
+// changed since, it responds with 409 instead.
+func handleUpdateLink(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey, path string) *appError {
+	target := r.FormValue("target")
+	if r.FormValue("version") == "" {
+		return &appError{nil, "Missing version: send the Version of the link you're editing.", http.StatusPreconditionRequired}
+	}
+	version, err := strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil {
+		return &appError{err, "Invalid version.", 400}
+	}
+	var notes, metadata *string
+	if values, ok := r.Form["privateNotes"]; ok {
+		notes = &values[0]
+		if err := validatePrivateNotes(*notes); err != nil {
+			return &appError{err, err.Error(), 400}
+		}
+	}
+	if values, ok := r.Form["metadata"]; ok {
+		serialized, err := parseMetadata(values[0])
+		if err != nil {
+			return &appError{err, err.Error(), 400}
+		}
+		metadata = &serialized
+	}
+	if target == "" && notes == nil && metadata == nil {
+		return &appError{nil, "Missing target, privateNotes or metadata.", 400}
+	}
+
+	key, link, appErr := findOwnedLink(c, r, apiKey, path)
+	if appErr != nil {
+		return appErr
+	}
+
+	if err = checkLinkVersion(link, version); err != nil {
+		return &appError{err, err.Error(), http.StatusConflict}
+	}
+
+	updated := link
+	if target != "" {
+		updated, err = UpdateLinkTarget(c, key, link, target, linkHost(r), version)
+		if err == errVersionConflict {
+			return &appError{err, err.Error(), http.StatusConflict}
+		} else if err != nil {
+			// TODO like handleAdd, tell bad targets apart from datastore errors
+			return &appError{err, err.Error(), 400}
+		}
+		// The notes are updated on top of this edit.
+		version = updated.Version
+	}
+	if notes != nil || metadata != nil {
+		warnings := updated.warnings
+		if updated, err = updateLinkNotes(c, key, notes, metadata, version); err == errVersionConflict {
+			return &appError{err, err.Error(), http.StatusConflict}
+		} else if err != nil {
+			return &appError{err, "Datastore error: " + err.Error(), 500}
+		}
+		updated.warnings = warnings
+	}
+
+	respJSON, _ := json.Marshal(AddSuccessResponse{true, shortURL(linkHost(r), updated.Path), updated.warnings, nil, updated.Version})
+	w.Write(respJSON)
+	return nil
+}
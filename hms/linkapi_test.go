@@ -0,0 +1,28 @@
+package hms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewLinkInfo(t *testing.T) {
+	link := Link{TargetURL: "https://example.com", Creator: "alice@example.com", ClickCount: 3, Version: 2}
+	if info := newLinkInfo(&link); info.ExpiresAt != nil || info.TargetURL != link.TargetURL || info.ClickCount != 3 || info.Version != 2 {
+		t.Errorf("Unexpected info for a link that doesn't expire: %+v", info)
+	}
+
+	link.ExpiresAt = time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	if info := newLinkInfo(&link); info.ExpiresAt == nil || !info.ExpiresAt.Equal(link.ExpiresAt) {
+		t.Errorf("Expected ExpiresAt %v but got %v", link.ExpiresAt, info.ExpiresAt)
+	}
+}
+
+func TestCheckLinkVersion(t *testing.T) {
+	link := Link{Version: 3}
+	if err := checkLinkVersion(&link, 3); err != nil {
+		t.Errorf("Expected the current version to match, got %v", err)
+	}
+	if err := checkLinkVersion(&link, 2); err != errVersionConflict {
+		t.Errorf("Expected a conflict for a stale version, got %v", err)
+	}
+}
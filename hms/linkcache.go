@@ -0,0 +1,109 @@
+package hms
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// How long a link looked up for a redirect stays in memcache. Writers that
+// change how a link redirects call uncacheLinks; anything they miss is stale
+// for at most this long.
+const LINK_CACHE_TTL = 5 * time.Minute
+
+func linkCacheKey(key *datastore.Key) string {
+	return "link:" + key.Encode()
+}
+
+func linkPathCacheKey(strChatID string, path string) string {
+	return "linkpath:" + strChatID + ":" + path
+}
+
+// Returns how long link may be cached from now: LINK_CACHE_TTL, or less if
+// it expires sooner. 0 means it shouldn't be cached at all.
+func linkCacheExpiration(link *Link, now time.Time) time.Duration {
+	ttl := LINK_CACHE_TTL
+	if !link.ExpiresAt.IsZero() && link.ExpiresAt.Sub(now) < ttl {
+		ttl = link.ExpiresAt.Sub(now)
+	}
+	if ttl < time.Second {
+		// memcache takes an expiration of 0 to mean never.
+		return 0
+	}
+	return ttl
+}
+
+func getCachedLink(c context.Context, key *datastore.Key) (*Link, bool) {
+	var link Link
+	if _, err := memcache.Gob.Get(c, linkCacheKey(key), &link); err != nil {
+		return nil, false
+	}
+	return &link, true
+}
+
+func cacheLink(c context.Context, key *datastore.Key, link *Link) {
+	ttl := linkCacheExpiration(link, time.Now())
+	if ttl == 0 {
+		return
+	}
+	memcache.Gob.Set(c, &memcache.Item{
+		Key:        linkCacheKey(key),
+		Object:     link,
+		Expiration: ttl,
+	})
+}
+
+// Drops the links from the cache, after they've been changed or deleted.
+func uncacheLinks(c context.Context, keys ...*datastore.Key) {
+	cacheKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != nil && !key.Incomplete() {
+			cacheKeys = append(cacheKeys, linkCacheKey(key))
+		}
+	}
+	if len(cacheKeys) > 0 {
+		memcache.DeleteMulti(c, cacheKeys)
+	}
+}
+
+// Gets the link at key for a redirect, from memcache if it's there.
+func getRedirectLink(c context.Context, key *datastore.Key) (*Link, error) {
+	if link, ok := getCachedLink(c, key); ok {
+		return link, nil
+	}
+	var link Link
+	if err := datastore.Get(c, key, &link); err != nil {
+		return nil, err
+	}
+	cacheLink(c, key, &link)
+	return &link, nil
+}
+
+// Like getMatchingLinkKeyChatString, but from memcache if it's there. The
+// path only remembers which link it matched; that's only trusted while the
+// link itself is still cached, so uncacheLinks drops both.
+func getRedirectLinkByPath(c context.Context, strChatID string, path string) (*datastore.Key, *Link, error) {
+	pathCacheKey := linkPathCacheKey(strChatID, path)
+	if item, err := memcache.Get(c, pathCacheKey); err == nil {
+		if key, err := datastore.DecodeKey(string(item.Value)); err == nil {
+			if link, ok := getCachedLink(c, key); ok {
+				return key, link, nil
+			}
+		}
+	}
+
+	key, link, err := getMatchingLinkKeyChatString(c, strChatID, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cacheLink(c, key, link)
+	memcache.Set(c, &memcache.Item{
+		Key:        pathCacheKey,
+		Value:      []byte(key.Encode()),
+		Expiration: LINK_CACHE_TTL,
+	})
+	return key, link, nil
+}
@@ -0,0 +1,26 @@
+package hms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkCacheExpiration(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		expiresAt time.Time
+		expected  time.Duration
+	}{
+		{time.Time{}, LINK_CACHE_TTL},
+		{now.Add(time.Hour), LINK_CACHE_TTL},
+		{now.Add(time.Minute), time.Minute},
+		{now.Add(time.Millisecond), 0},
+		{now.Add(-time.Minute), 0},
+	}
+	for _, tc := range cases {
+		link := Link{ExpiresAt: tc.expiresAt}
+		if actual := linkCacheExpiration(&link, now); actual != tc.expected {
+			t.Errorf("Expected %v for a link expiring at %v but got %v", tc.expected, tc.expiresAt, actual)
+		}
+	}
+}
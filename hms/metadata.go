@@ -0,0 +1,38 @@
+package hms
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Most bytes a link's serialized Metadata may take.
+const MAX_METADATA_SIZE = 4096
+
+// Parses a link's `metadata` value: a JSON object whose values are all
+// strings, like {"crmID": "1234"}. Returns it re-serialized, so what's stored
+// doesn't depend on the client's formatting.
+func parseMetadata(s string) (string, error) {
+	metadata := make(map[string]string)
+	if err := json.Unmarshal([]byte(s), &metadata); err != nil {
+		return "", fmt.Errorf("Invalid metadata: it has to be a JSON object of strings (%v)", err)
+	}
+	if len(metadata) == 0 {
+		return "", nil
+	}
+
+	serialized, _ := json.Marshal(metadata)
+	if len(serialized) > MAX_METADATA_SIZE {
+		return "", fmt.Errorf("Metadata is limited to %d bytes.", MAX_METADATA_SIZE)
+	}
+	return string(serialized), nil
+}
+
+// Returns the link's Metadata as a map, or nil if it has none.
+func (l *Link) metadata() map[string]string {
+	if l.Metadata == "" {
+		return nil
+	}
+	var metadata map[string]string
+	json.Unmarshal([]byte(l.Metadata), &metadata)
+	return metadata
+}
@@ -0,0 +1,33 @@
+package hms
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	serialized, err := parseMetadata(` { "source": "crm", "crmID": "1234" } `)
+	if err != nil || serialized != `{"crmID":"1234","source":"crm"}` {
+		t.Errorf("Unexpected result %q, %v", serialized, err)
+	}
+	if serialized, err = parseMetadata("{}"); err != nil || serialized != "" {
+		t.Errorf("Expected empty metadata to be cleared, got %q, %v", serialized, err)
+	}
+
+	tooBig := `{"notes": "` + strings.Repeat("x", MAX_METADATA_SIZE) + `"}`
+	for _, bad := range []string{`{"id": 1234}`, `{"nested": {"a": "b"}}`, `["a"]`, `"a"`, "", tooBig} {
+		if _, err = parseMetadata(bad); err == nil {
+			t.Errorf("Expected %.40q to be refused", bad)
+		}
+	}
+}
+
+func TestLinkMetadata(t *testing.T) {
+	link := Link{Metadata: `{"crmID":"1234"}`}
+	if metadata := link.metadata(); metadata["crmID"] != "1234" {
+		t.Errorf("Expected crmID 1234, got %v", metadata)
+	}
+	if (&Link{}).metadata() != nil {
+		t.Errorf("Expected no metadata for a link without any")
+	}
+}
@@ -0,0 +1,114 @@
+package hms
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Longest /metrics spends reading links before reporting what it has.
+const METRICS_BUDGET = 20 * time.Second
+
+// The per-link numbers /metrics exports.
+type linkMetric struct {
+	Path      string
+	Code      string
+	Clicks    int64
+	Unhealthy bool
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes metrics in the Prometheus text format. Each of the first top
+// links (which are sorted by clicks, most first) gets its own series,
+// labeled with its path and code (since paths are only unique per chat), and
+// the rest are added up under path="other".
+func writeLinkMetrics(w io.Writer, metrics []linkMetric, top int, complete bool) {
+	type series struct {
+		labels    string
+		clicks    int64
+		unhealthy int
+	}
+	all := make([]series, 0, top+1)
+	other := series{labels: `path="other",code=""`}
+	for i, m := range metrics {
+		unhealthy := 0
+		if m.Unhealthy {
+			unhealthy = 1
+		}
+		if i < top {
+			labels := fmt.Sprintf(`path="%s",code="%s"`, metricLabelEscaper.Replace(m.Path), m.Code)
+			all = append(all, series{labels, m.Clicks, unhealthy})
+		} else {
+			other.clicks += m.Clicks
+			other.unhealthy += unhealthy
+		}
+	}
+	if len(metrics) > top {
+		all = append(all, other)
+	}
+
+	fmt.Fprintln(w, "# HELP hms_link_clicks_total Redirects served, by link.")
+	fmt.Fprintln(w, "# TYPE hms_link_clicks_total counter")
+	for _, s := range all {
+		fmt.Fprintf(w, "hms_link_clicks_total{%s} %d\n", s.labels, s.clicks)
+	}
+	fmt.Fprintln(w, "# HELP hms_link_unhealthy Links whose target failed its last health check.")
+	fmt.Fprintln(w, "# TYPE hms_link_unhealthy gauge")
+	for _, s := range all {
+		fmt.Fprintf(w, "hms_link_unhealthy{%s} %d\n", s.labels, s.unhealthy)
+	}
+
+	completeValue := 0
+	if complete {
+		completeValue = 1
+	}
+	fmt.Fprintln(w, "# HELP hms_link_metrics_complete Whether every link was read in time.")
+	fmt.Fprintln(w, "# TYPE hms_link_metrics_complete gauge")
+	fmt.Fprintf(w, "hms_link_metrics_complete %d\n", completeValue)
+}
+
+// Exports per-link metrics for Prometheus, with a series for each of the
+// config.MetricsTopLinks most clicked links and one for the rest, which keeps
+// the number of series bounded.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isInternalRequest(r) && !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	metrics := make([]linkMetric, 0)
+	complete := true
+	deadline := time.Now().Add(METRICS_BUDGET)
+	it := datastore.NewQuery("Link").Order("-ClickCount").Run(c)
+	for {
+		var link Link
+		key, err := it.Next(&link)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			log.Errorf(c, "Failed to read links for metrics: %v", err)
+			complete = false
+			break
+		}
+		metrics = append(metrics, linkMetric{
+			Path:      link.Path,
+			Code:      autoLinkPath(key.IntID()),
+			Clicks:    link.ClickCount,
+			Unhealthy: !isHealthyStatus(link.LastHealthStatus),
+		})
+		if time.Now().After(deadline) {
+			complete = false
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeLinkMetrics(w, metrics, config.MetricsTopLinks, complete)
+}
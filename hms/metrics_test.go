@@ -0,0 +1,40 @@
+package hms
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteLinkMetrics(t *testing.T) {
+	metrics := []linkMetric{
+		{"docs", "yD", 50, false},
+		{`we"ird`, "yV", 20, true},
+		{"old", "yX", 5, true},
+		{"older", "yI", 1, false},
+	}
+	var out bytes.Buffer
+	writeLinkMetrics(&out, metrics, 2, true)
+	s := out.String()
+
+	for _, expected := range []string{
+		`hms_link_clicks_total{path="docs",code="yD"} 50`,
+		`hms_link_clicks_total{path="we\"ird",code="yV"} 20`,
+		`hms_link_clicks_total{path="other",code=""} 6`,
+		`hms_link_unhealthy{path="other",code=""} 1`,
+		`hms_link_metrics_complete 1`,
+	} {
+		if !strings.Contains(s, expected+"\n") {
+			t.Errorf("Expected %s in:\n%s", expected, s)
+		}
+	}
+	if strings.Contains(s, `path="old"`) {
+		t.Errorf("Expected links past the top 2 to only be in other:\n%s", s)
+	}
+
+	out.Reset()
+	writeLinkMetrics(&out, metrics[:1], 2, false)
+	if strings.Contains(out.String(), `path="other"`) {
+		t.Errorf("Expected no other series when every link has its own:\n%s", out.String())
+	}
+}
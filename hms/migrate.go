@@ -0,0 +1,142 @@
+package hms
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	MIGRATION_BATCH_SIZE = 100
+
+	// Link.SchemaVersion of links that are fully up to date. Versions:
+	//   1: ClickCount is stored, so queries on it see the link.
+	//   2: HasMusic is set for links with MusicInfo.
+	//   3: PathLower is set.
+	LINK_SCHEMA_VERSION = 3
+)
+
+// Brings a link stored by an older version up to date. Returns whether
+// anything changed. Must be idempotent, since migrations can be rerun.
+func migrateLink(link *Link) bool {
+	changed := false
+
+	// Only links from before SchemaVersion existed still have a ChatKey to
+	// move; for those a nil ChatKey means no chat. Links with a version
+	// and no ChatKeys were removed from all of their chats and stay that
+	// way.
+	if link.SchemaVersion < 1 && len(link.ChatKeys) == 0 {
+		link.ChatKeys = []*datastore.Key{link.ChatKey}
+		link.ChatKey = nil
+		changed = true
+	}
+
+	if link.SchemaVersion < 1 {
+		// Nothing to change: storing the link again writes its zero
+		// ClickCount.
+		link.SchemaVersion = 1
+		changed = true
+	}
+
+	if link.SchemaVersion < 2 {
+		link.HasMusic = !link.MusicInfo.IsEmpty()
+		link.SchemaVersion = 2
+		changed = true
+	}
+
+	if link.SchemaVersion < 3 {
+		link.setPath(link.Path)
+		link.SchemaVersion = 3
+		changed = true
+	}
+
+	return changed
+}
+
+// Runs migrateLink over a batch of links and queues a task for the next
+// batch, so the whole dataset gets migrated without hitting request
+// deadlines.
+func MigrateLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !isInternalRequest(r) && !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	w.Header().Set("Content-Type", "text/plain")
+
+	q := datastore.NewQuery("Link").KeysOnly()
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Bad cursor."))
+			return
+		}
+		q = q.Start(decoded)
+	}
+
+	keys := make([]*datastore.Key, 0, MIGRATION_BATCH_SIZE)
+	it := q.Limit(MIGRATION_BATCH_SIZE).Run(c)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	migrated := 0
+	for _, key := range keys {
+		changed, err := migrateLinkKey(c, key)
+		if err != nil {
+			log.Errorf(c, "Failed to migrate link %v: %v", key, err)
+		} else if changed {
+			migrated++
+		}
+	}
+
+	if len(keys) == MIGRATION_BATCH_SIZE {
+		next, err := it.Cursor()
+		if err == nil {
+			t := taskqueue.NewPOSTTask(r.URL.Path, url.Values{"cursor": {next.String()}})
+			_, err = taskqueue.Add(c, t, "")
+		}
+		if err != nil {
+			log.Errorf(c, "Failed to queue next migration batch: %v", err)
+		}
+	}
+
+	w.Write([]byte(fmt.Sprintf("Migrated %d of %d links.", migrated, len(keys))))
+}
+
+func migrateLinkKey(c context.Context, key *datastore.Key) (bool, error) {
+	changed := false
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		var link Link
+		if err := datastore.Get(tc, key, &link); err != nil {
+			return err
+		}
+
+		changed = migrateLink(&link)
+		if !changed {
+			return nil
+		}
+		_, err := datastore.Put(tc, key, &link)
+		return err
+	}, nil)
+	if changed && err == nil {
+		uncacheLinks(c, key)
+	}
+	return changed, err
+}
@@ -0,0 +1,86 @@
+package hms
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestMigrateLinkMovesChatKey(t *testing.T) {
+	link := Link{Path: "legacy"}
+	if !migrateLink(&link) {
+		t.Fatalf("Expected a legacy link to be migrated")
+	}
+	if len(link.ChatKeys) != 1 || link.ChatKeys[0] != nil {
+		t.Errorf("Expected a chatless link to get a single nil chat key, got %v", link.ChatKeys)
+	}
+	if !link.InChat(nil) {
+		t.Errorf("Expected a migrated chatless link to still resolve without a chat")
+	}
+
+	if migrateLink(&link) {
+		t.Errorf("Expected migrating twice to be a no-op")
+	}
+}
+
+func TestMigrateLinkKeepsLinksWithoutChats(t *testing.T) {
+	link := Link{Path: "detached", SchemaVersion: LINK_SCHEMA_VERSION}
+	if migrateLink(&link) {
+		t.Errorf("Expected a link removed from all of its chats to be left alone")
+	}
+	if len(link.ChatKeys) != 0 || link.InChat(nil) {
+		t.Errorf("Expected the link to stay out of every chat, got %v", link.ChatKeys)
+	}
+}
+
+func TestMigrateLinkLeavesCurrentLinks(t *testing.T) {
+	link := Link{Path: "current", ChatKeys: []*datastore.Key{nil}, SchemaVersion: LINK_SCHEMA_VERSION}
+	if migrateLink(&link) {
+		t.Errorf("Expected an up to date link to be left alone")
+	}
+}
+
+func TestMigrateLinkBackfillsHasMusic(t *testing.T) {
+	music := Link{Path: "song", ChatKeys: []*datastore.Key{nil}, SchemaVersion: 1,
+		MusicInfo: MusicInfo{Title: "Song", SourceType: SOURCE_SPOTIFY}}
+	other := Link{Path: "docs", ChatKeys: []*datastore.Key{nil}, SchemaVersion: 1}
+	if !migrateLink(&music) || !migrateLink(&other) {
+		t.Fatalf("Expected version 1 links to be migrated")
+	}
+	if !music.HasMusic || other.HasMusic {
+		t.Errorf("Expected HasMusic only on the link with music info, got %v and %v", music.HasMusic, other.HasMusic)
+	}
+}
+
+func TestMigrateLinkBackfillsPathLower(t *testing.T) {
+	link := Link{Path: "MyLink", ChatKeys: []*datastore.Key{nil}, SchemaVersion: 2}
+	if !migrateLink(&link) {
+		t.Fatalf("Expected a version 2 link to be migrated")
+	}
+	if link.Path != "MyLink" || link.PathLower != "mylink" {
+		t.Errorf("Expected MyLink to be looked up as mylink, got %q as %q", link.Path, link.PathLower)
+	}
+}
+
+func TestMigrateLinkBackfillsClickCount(t *testing.T) {
+	link := Link{Path: "uncounted", ChatKeys: []*datastore.Key{nil}}
+	if !migrateLink(&link) {
+		t.Fatalf("Expected a link without a schema version to be migrated")
+	}
+	if link.SchemaVersion != LINK_SCHEMA_VERSION || link.ClickCount != 0 {
+		t.Errorf("Expected version %d with no clicks, got version %d with %d clicks",
+			LINK_SCHEMA_VERSION, link.SchemaVersion, link.ClickCount)
+	}
+}
+
+func TestIsUnmigratedIn(t *testing.T) {
+	if !isUnmigratedIn(&Link{Path: "legacy"}, nil) {
+		t.Errorf("Expected a chatless legacy link to be found without a chat")
+	}
+	if isUnmigratedIn(&Link{Path: "detached", SchemaVersion: LINK_SCHEMA_VERSION}, nil) {
+		t.Errorf("Expected a migrated link with no chats not to be found")
+	}
+	if isUnmigratedIn(&Link{Path: "current", ChatKeys: []*datastore.Key{nil}}, nil) {
+		t.Errorf("Expected links with ChatKeys to be left to the usual lookup")
+	}
+}
@@ -2,12 +2,16 @@ package hms
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/net/context"
+	"golang.org/x/net/idna"
 
 	"google.golang.org/appengine/datastore"
 )
@@ -18,6 +22,40 @@ type Chat struct {
 	FacebookChatID int64
 }
 
+// The Facebook chat a link is looked up or created in, if any. The zero value
+// is NoChat, for links that resolve without a chat; any ID, including 0, is a
+// real chat.
+type ChatID struct {
+	ID    int64
+	Valid bool
+}
+
+var NoChat = ChatID{}
+
+func SomeChat(fbChatID int64) ChatID {
+	return ChatID{fbChatID, true}
+}
+
+// Parses a `chatID` parameter. Empty means NoChat.
+func parseChatID(s string) (ChatID, error) {
+	if s == "" {
+		return NoChat, nil
+	}
+	fbChatID, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return NoChat, err
+	}
+	return SomeChat(fbChatID), nil
+}
+
+// Returns the chat's `chatID` parameter, or "" for NoChat.
+func (id ChatID) String() string {
+	if !id.Valid {
+		return ""
+	}
+	return strconv.FormatInt(id.ID, 10)
+}
+
 func getOrCreateChat(c context.Context, fbChatID int64, keyBuf **datastore.Key) (*Chat, error) {
 	results := make([]Chat, 0, 1)
 	keys, err := datastore.NewQuery("Chat").
@@ -53,12 +91,138 @@ func getOrCreateChat(c context.Context, fbChatID int64, keyBuf **datastore.Key)
 
 // Represents a single shared link
 type Link struct {
-	Path      string
+	// The path as it was created, for display.
+	Path string
+	// normalizePath(Path), which lookups match on so paths are
+	// case-insensitive. Set with setPath.
+	PathLower string `json:"-"`
 	TargetURL string
-	Creator   string
-	Created   time.Time
+	// The target exactly as it was submitted, before normalization. Only
+	// stored when config.StoreOriginalTarget is on.
+	OriginalTarget string `datastore:",noindex"`
+	Creator        string
+	// The API key the link was created through, if it was.
+	APIKeyID *datastore.Key `json:"-"`
+	Created  time.Time
+	// Every chat the link can be resolved from. A nil entry means it can
+	// also be resolved without a chat.
+	ChatKeys []*datastore.Key `json:"-"`
+	// Deprecated: the single chat of links created before ChatKeys existed.
+	// The link migration moves it into ChatKeys.
 	ChatKey   *datastore.Key `json:"-"`
 	MusicInfo MusicInfo
+	// Whether MusicInfo was filled in, so music links can be queried for.
+	HasMusic bool
+	// Filled in after creation for targets that support oEmbed.
+	OEmbedInfo OEmbedInfo
+	// When the link stops redirecting. Zero means never.
+	ExpiresAt time.Time
+	// Serialized Schedule; empty means the link is always active.
+	Schedule string `datastore:",noindex"`
+	// Serialized map of query params merged into the target on redirect.
+	QueryParams string `datastore:",noindex"`
+	// Whether QueryParams replace params the target already has.
+	OverrideParams bool
+	// Longest the redirect's lookups may take before extra processing
+	// (like param injection) is skipped and it goes to TargetURL as-is.
+	// 0 uses config.RedirectBudget.
+	RedirectBudgetMs int `datastore:",noindex"`
+	// Whether clients should repeat the original method and body when
+	// following the redirect (307 instead of 302), for links used as API
+	// endpoints.
+	PreserveMethod bool
+	// Whether the redirect is permanent (301, or 308 with PreserveMethod),
+	// so browsers and crawlers cache it. For links whose target won't
+	// change.
+	Permanent bool
+	// Whether TargetURL has placeholders filled in from each request; see
+	// expandTargetTemplate.
+	Templated bool
+	// Keeps the link out of the public feed.
+	Private bool
+	// Annotations only the creator and admins see. Left out of every other
+	// response, the feed and (unless an admin asks) backups.
+	PrivateNotes string `datastore:",noindex" json:"-"`
+	// Serialized JSON object of strings integrations can keep on the link;
+	// see parseMetadata. Seen by the same people as PrivateNotes.
+	Metadata string `datastore:",noindex" json:"-"`
+	// Lets anyone follow the link without logging in, when
+	// config.AnonymousRedirects is on; see requiresAuth.
+	AllowAnonymous bool
+	// Shows a page naming the target's host before continuing to it,
+	// instead of redirecting straight away; see renderInterstitial. Links
+	// whose credentials are proxied are served without it.
+	Interstitial bool
+	// HTML the interstitial embeds, like an analytics pixel, instead of
+	// config.InterstitialSnippet; see parseSnippet.
+	InterstitialSnippet string `datastore:",noindex" json:"-"`
+	// Who may frame pages served for the link, one of the FRAME_*
+	// constants. Empty means FRAME_DENY.
+	FrameOptions string `datastore:",noindex"`
+
+	// Targets to redirect to instead, in order, when the health check finds
+	// TargetURL down.
+	FallbackTargets []string `datastore:",noindex"`
+
+	// What Google Safe Browsing last said about the targets, one of the
+	// SAFE_BROWSING_* constants, and when. Checked at creation and
+	// rechecked by RecheckSafeBrowsingHandler; shown by TrustBadge.
+	SafeBrowsingStatus    string    `datastore:",noindex"`
+	SafeBrowsingCheckedAt time.Time `datastore:",noindex"`
+
+	// Number of redirects served for the link, counted by RecordClickHandler
+	// shortly after each one. With sampling it's an estimate: see
+	// ClickSampleEvery.
+	ClickCount int64
+	// Only one in this many redirects is recorded, adding this many to
+	// ClickCount, for links too busy to record every one. 0 uses
+	// config.ClickSampleEvery.
+	ClickSampleEvery int `datastore:",noindex"`
+	// When RecordClickHandler last recorded a click, and a sketch of the
+	// visitors it recorded; see UniqueVisitors. Only backed up with
+	// ?include=analytics.
+	LastClickedAt time.Time `json:"-"`
+	ClickVisitors []byte    `datastore:",noindex" json:"-"`
+	// Whether to record nothing about the link's clicks beyond (if
+	// config.CountOptedOutClicks) ClickCount. Defaults to
+	// config.NoAnalytics when the link is made.
+	NoAnalytics bool `datastore:",noindex"`
+
+	// Which migrations the stored entity has had; see migrateLink.
+	SchemaVersion int
+	// Starts at 1 and is bumped by every change to the link, except for
+	// bookkeeping edits never conflict with (click counts, fetched oEmbed
+	// and music info, migrations). PUT /api/link/{path} takes the version
+	// the client last read; see checkLinkVersion.
+	Version int64 `datastore:",noindex"`
+
+	// Filled in by the link health check task. FallbackHealthStatuses has
+	// an entry per FallbackTargets entry.
+	LastHealthStatus       int
+	FallbackHealthStatuses []int `datastore:",noindex"`
+	LastCheckedAt          time.Time
+
+	// Encrypted Basic Auth credentials for the target, and how they're
+	// used: AUTH_MODE_PROXY or AUTH_MODE_URL. See credentials.go. Never
+	// exported.
+	AuthCredentials []byte `datastore:",noindex" json:"-"`
+	AuthMode        string `datastore:",noindex" json:"-"`
+
+	// Set on links that are just another path for an existing link; the
+	// original's target and settings are used when redirecting.
+	AliasOf *datastore.Key `json:"-"`
+
+	// Where Creator came from and the client address the link was created
+	// from. Only logged, never stored.
+	creatorSource string
+	createdFrom   string
+	// Non-fatal problems found while creating the link. Never stored.
+	warnings []string
+	// Whether fetching MusicInfo failed and should be retried.
+	musicInfoPending bool
+	// Whether parseTarget canonicalizes the target. Only set while a link
+	// is created with `reuse`.
+	canonicalTarget bool
 }
 
 type MusicInfo struct {
@@ -69,24 +233,207 @@ type MusicInfo struct {
 	Title      string      `json:"title"`
 }
 
+// Returns whether no music info was found.
+func (m MusicInfo) IsEmpty() bool {
+	return m.Title == "" && m.SourceType == SOURCE_UNKNOWN && len(m.Artists) == 0 &&
+		len(m.Genres) == 0 && len(m.SubGenres) == 0
+}
+
+// Returns the first chat the link belongs to, or nil if it doesn't belong to
+// any.
+func (l *Link) PrimaryChatKey() *datastore.Key {
+	for _, key := range l.ChatKeys {
+		if key != nil {
+			return key
+		}
+	}
+	return nil
+}
+
+// Returns whether the link can be resolved from the given chat (or, for a nil
+// chatKey, without a chat).
+func (l *Link) InChat(chatKey *datastore.Key) bool {
+	for _, key := range l.ChatKeys {
+		if key.Equal(chatKey) {
+			return true
+		}
+	}
+	return false
+}
+
+const MAX_PRIVATE_NOTES_LENGTH = 2000
+
+func validatePrivateNotes(notes string) error {
+	if utf8.RuneCountInString(notes) > MAX_PRIVATE_NOTES_LENGTH {
+		return fmt.Errorf("Private notes are limited to %d characters.", MAX_PRIVATE_NOTES_LENGTH)
+	}
+	return nil
+}
+
+// Returns whether following the link needs an authorized user.
+func (l *Link) requiresAuth() bool {
+	return !config.AnonymousRedirects || !l.AllowAnonymous
+}
+
 // Used by templates to format the Link struct's created field.
 func (l *Link) FormatCreated() string {
 	return l.Created.Add(time.Hour * -8).Format("3:04pm, Monday, January 2")
 }
 
+// Returns whether the link should redirect at time t according to its
+// schedule.
+func (l *Link) IsActiveAt(t time.Time) bool {
+	if l.Schedule == "" {
+		return true
+	}
+	sched, err := parseSchedule(l.Schedule)
+	if err != nil {
+		// Schedules are validated on creation, so don't lock people out
+		// of a link because of a schedule we can no longer read.
+		return true
+	}
+	return sched.IsActive(t)
+}
+
+// Returns the URL the link should actually redirect to.
+func (l *Link) RedirectURL() string {
+	if l.QueryParams == "" {
+		return l.TargetURL
+	}
+
+	params, err := parseQueryParams(l.QueryParams)
+	if err != nil {
+		return l.TargetURL
+	}
+	target, err := injectQueryParams(l.TargetURL, params, l.OverrideParams)
+	if err != nil {
+		return l.TargetURL
+	}
+	return target
+}
+
+// How long clients may cache a permanent redirect.
+const PERMANENT_REDIRECT_MAX_AGE = 30 * 24 * time.Hour
+
+// Returns the status code the link should redirect with: 302, or 307 when the
+// method should be preserved, or their permanent versions (301 and 308) for
+// permanent links.
+func (l *Link) RedirectStatus() int {
+	switch {
+	case l.Permanent && l.PreserveMethod:
+		return http.StatusPermanentRedirect
+	case l.Permanent:
+		return http.StatusMovedPermanently
+	case l.PreserveMethod:
+		return http.StatusTemporaryRedirect
+	}
+	return http.StatusFound
+}
+
+// Returns the Cache-Control header for the link's redirects. Temporary
+// redirects aren't cached, so every click reaches us (and is counted).
+// Permanent ones can be, but only by the user's own browser if following the
+// link needs a login, and never past the link's expiry.
+func (l *Link) RedirectCacheControl(now time.Time) string {
+	if !l.Permanent {
+		return "no-cache, no-store"
+	}
+
+	maxAge := PERMANENT_REDIRECT_MAX_AGE
+	if !l.ExpiresAt.IsZero() && l.ExpiresAt.Sub(now) < maxAge {
+		maxAge = l.ExpiresAt.Sub(now)
+	}
+	visibility := "public"
+	if l.requiresAuth() {
+		visibility = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d", visibility, int64(maxAge/time.Second))
+}
+
+// Like RedirectURL, but goes to TargetURL as-is once the redirect has
+// already spent longer than the link's budget (on lookups like resolving an
+// alias), rather than adding more work to a slow response.
+func (l *Link) RedirectURLWithin(defaultBudget time.Duration, spent time.Duration) string {
+	budget := defaultBudget
+	if l.RedirectBudgetMs > 0 {
+		budget = time.Duration(l.RedirectBudgetMs) * time.Millisecond
+	}
+	if budget > 0 && spent > budget {
+		return l.TargetURL
+	}
+	return l.RedirectURL()
+}
+
 func (l *Link) parseTarget() (*url.URL, error) {
-	parsedUrl, err := url.Parse(l.TargetURL)
+	target := l.TargetURL
+	if strings.HasPrefix(target, "//") {
+		// Scheme-relative; without this it'd become a path on an empty
+		// host.
+		target = "http:" + target
+	}
+	parsedUrl, err := url.Parse(target)
 	if err != nil {
 		return nil, err
 	} else if parsedUrl.Scheme == "" {
-		parsedUrl, err = url.Parse("http://" + l.TargetURL)
+		parsedUrl, err = url.Parse("http://" + target)
 		if err != nil {
 			return nil, err
 		}
 	}
+
+	if err = normalizeHost(parsedUrl); err != nil {
+		return nil, err
+	}
+	if l.canonicalTarget {
+		canonicalizeTarget(parsedUrl)
+	}
 	return parsedUrl, nil
 }
 
+// Converts an internationalized host to its Punycode form so that the same
+// domain is always stored the same way, regardless of how it was typed.
+func normalizeHost(u *url.URL) error {
+	hostname := u.Hostname()
+	if hostname == "" {
+		return nil
+	}
+
+	asciiHost, err := idna.Lookup.ToASCII(hostname)
+	if err != nil {
+		return fmt.Errorf("Invalid host %q: %v", hostname, err)
+	}
+
+	if port := u.Port(); port != "" {
+		u.Host = asciiHost + ":" + port
+	} else {
+		u.Host = asciiHost
+	}
+	return nil
+}
+
+// Rewrites u (from parseTarget) so that URLs which only differ in ways that
+// don't matter come out the same: a lowercase host without its scheme's
+// default port, sorted query params and no trailing slash. Used for
+// `reuse`, where matching earlier links matters more than keeping the
+// target exactly as submitted.
+func canonicalizeTarget(u *url.URL) {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	if u.RawQuery != "" {
+		u.RawQuery = u.Query().Encode()
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+}
+
 func (l Link) IsLikelyMusicLink() bool {
 	url, err := l.parseTarget()
 	if err != nil {
@@ -104,46 +451,136 @@ func (l Link) IsLikelyMusicLink() bool {
 	return false
 }
 
-func getMatchingLink(c context.Context, fbChatID int64, path string) (*Link, error) {
-	var chatKey *datastore.Key
-	chatKey = nil
+// Returns the form of path that lookups match on.
+func normalizePath(path string) string {
+	return strings.ToLower(path)
+}
 
-	if fbChatID >= 0 {
-		chatKeys, err := datastore.NewQuery("Chat").Filter("FacebookChatID =", fbChatID).KeysOnly().GetAll(c, nil)
-		if err != nil {
-			return nil, err
-		} else if len(chatKeys) == 0 {
-			return nil, errors.New("No matching chat key")
-		}
+// Sets the link's path, keeping PathLower in sync.
+func (l *Link) setPath(path string) {
+	l.Path = path
+	l.PathLower = normalizePath(path)
+}
+
+func getMatchingLink(c context.Context, chatID ChatID, path string) (*Link, error) {
+	_, link, err := getMatchingLinkKey(c, chatID, path)
+	return link, err
+}
 
-		chatKey = chatKeys[0]
+// Like getMatchingLink, but also returns the link's key.
+func getMatchingLinkKey(c context.Context, chatID ChatID, path string) (*datastore.Key, *Link, error) {
+	chatKey, err := getChatKey(c, chatID)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	match := make([]Link, 0, 1)
-	_, err := datastore.NewQuery("Link").Filter("Path =", path).Filter("ChatKey =", chatKey).Limit(1).GetAll(c, &match)
+	keys, err := datastore.NewQuery("Link").Filter("PathLower =", normalizePath(path)).Filter("ChatKeys =", chatKey).Limit(1).GetAll(c, &match)
+	if err == nil && len(match) == 0 {
+		// Links stored before schema version 3 have no PathLower until
+		// they're migrated, so they can still be found by their exact path.
+		keys, err = datastore.NewQuery("Link").Filter("Path =", path).Filter("ChatKeys =", chatKey).Limit(1).GetAll(c, &match)
+	}
+	if err == nil && len(match) == 0 {
+		return getUnmigratedLinkKey(c, chatKey, path)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	} else if len(match) == 0 {
-		return nil, errors.New("No matching link")
+		return nil, nil, errors.New("No matching link")
 	}
-	return &match[0], nil
+	return keys[0], &match[0], nil
 }
 
-func getMatchingLinkChatString(c context.Context, strFbChatID string, path string) (*Link, error) {
-	var fbChatID int64 = -1
-	var err error
-	if strFbChatID != "" {
-		fbChatID, err = strconv.ParseInt(strFbChatID, 10, 64)
-		if err != nil {
-			return nil, err
+// Returns the key of the chat, or nil for NoChat.
+func getChatKey(c context.Context, chatID ChatID) (*datastore.Key, error) {
+	if !chatID.Valid {
+		return nil, nil
+	}
+	chatKeys, err := datastore.NewQuery("Chat").Filter("FacebookChatID =", chatID.ID).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	} else if len(chatKeys) == 0 {
+		return nil, errors.New("No matching chat key")
+	}
+	return chatKeys[0], nil
+}
+
+// Finds the link at path in chatKey among links stored before ChatKeys
+// existed, which only have a ChatKey until /migrate_links gets to them.
+// Migrated links left with no chats also have a nil ChatKey, so only links
+// without a SchemaVersion count.
+func getUnmigratedLinkKey(c context.Context, chatKey *datastore.Key, path string) (*datastore.Key, *Link, error) {
+	var candidates []Link
+	keys, err := datastore.NewQuery("Link").Filter("Path =", path).Filter("ChatKey =", chatKey).GetAll(c, &candidates)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range candidates {
+		if isUnmigratedIn(&candidates[i], chatKey) {
+			return keys[i], &candidates[i], nil
 		}
 	}
-	return getMatchingLink(c, fbChatID, path)
+	return nil, nil, errors.New("No matching link")
+}
+
+// Returns whether link predates ChatKeys and is in chatKey (nil for no
+// chat).
+func isUnmigratedIn(link *Link, chatKey *datastore.Key) bool {
+	return link.SchemaVersion < 1 && len(link.ChatKeys) == 0 && link.ChatKey.Equal(chatKey)
+}
+
+// Returns the link an alias points to, or link itself if it isn't an alias.
+func resolveAlias(c context.Context, link *Link) (*Link, error) {
+	if link.AliasOf == nil {
+		return link, nil
+	}
+
+	var original Link
+	if err := datastore.Get(c, link.AliasOf, &original); err != nil {
+		return nil, err
+	}
+	return &original, nil
+}
+
+func getMatchingLinkChatString(c context.Context, strFbChatID string, path string) (*Link, error) {
+	_, link, err := getMatchingLinkKeyChatString(c, strFbChatID, path)
+	return link, err
+}
+
+// Like getMatchingLinkChatString, but also returns the link's key.
+func getMatchingLinkKeyChatString(c context.Context, strFbChatID string, path string) (*datastore.Key, *Link, error) {
+	chatID, err := parseChatID(strFbChatID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return getMatchingLinkKey(c, chatID, path)
 }
 
 type APIKey struct {
 	APIKey     string
 	OwnerEmail string
 	Created    time.Time
-	valid      bool
+	// Most links the key may create an hour. 0 uses API_KEY_RATE_LIMIT.
+	RateLimit int
+	// The SCOPE_* constants the key is allowed; none means all of them.
+	Scopes []string
+	// When the key was revoked. Revoked keys are kept for auditing, but
+	// can't be used; zero means the key is active.
+	RevokedAt time.Time
+	valid     bool
+	// Set by APIHandler to the key's datastore key.
+	key *datastore.Key
+}
+
+func (k *APIKey) isRevoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// Returns how many links the key may create an hour.
+func (k *APIKey) creationLimit() int {
+	if k.RateLimit > 0 {
+		return k.RateLimit
+	}
+	return API_KEY_RATE_LIMIT
 }
@@ -0,0 +1,188 @@
+package hms
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTargetNormalizesHost(t *testing.T) {
+	cases := map[string]string{
+		"http://münchen.de/path?q=1":       "http://xn--mnchen-3ya.de/path?q=1",
+		"MÜNCHEN.de":                       "http://xn--mnchen-3ya.de",
+		"https://Example.COM:8080/a":       "https://example.com:8080/a",
+		"http://例え.テスト/":                   "http://xn--r8jz45g.xn--zckzah/",
+		"https://bücher.example/x#frag":    "https://xn--bcher-kva.example/x#frag",
+		"http://already-ascii.org/a/b?c=d": "http://already-ascii.org/a/b?c=d",
+	}
+
+	for in, expected := range cases {
+		l := Link{TargetURL: in}
+		parsed, err := l.parseTarget()
+		if err != nil {
+			t.Errorf("For %s, got unexpected error: %v", in, err)
+			continue
+		}
+		if parsed.String() != expected {
+			t.Errorf("For %s, expected %s, got %s", in, expected, parsed.String())
+		}
+	}
+}
+
+func TestParseTargetRejectsInvalidHost(t *testing.T) {
+	l := Link{TargetURL: "http://xn--a.com/"}
+	if _, err := l.parseTarget(); err == nil {
+		t.Errorf("Expected an error for an invalid punycode host")
+	}
+}
+
+func TestParseTargetCanonicalizes(t *testing.T) {
+	cases := map[string]string{
+		"HTTPS://Example.COM:443/a/?b=2&a=1": "https://example.com/a?a=1&b=2",
+		"http://example.com:80/":             "http://example.com",
+		"http://example.com:8080/a//":        "http://example.com:8080/a",
+		"https://example.com:80/a#frag":      "https://example.com:80/a#frag",
+	}
+
+	for in, expected := range cases {
+		l := Link{TargetURL: in, canonicalTarget: true}
+		parsed, err := l.parseTarget()
+		if err != nil {
+			t.Errorf("For %s, got unexpected error: %v", in, err)
+		} else if parsed.String() != expected {
+			t.Errorf("For %s, expected %s, got %s", in, expected, parsed.String())
+		}
+	}
+}
+
+func TestParseChatID(t *testing.T) {
+	cases := map[string]ChatID{
+		"":      NoChat,
+		"0":     SomeChat(0),
+		"12345": SomeChat(12345),
+	}
+	for value, expected := range cases {
+		chatID, err := parseChatID(value)
+		if err != nil || chatID != expected {
+			t.Errorf("For %q, expected %+v but got %+v, %v", value, expected, chatID, err)
+		}
+		if chatID.String() != value {
+			t.Errorf("For %q, String gave %q", value, chatID.String())
+		}
+	}
+
+	if _, err := parseChatID("chat"); err == nil {
+		t.Errorf("Expected a non-numeric chat ID to be refused")
+	}
+}
+
+func TestChatIDZeroIsAChat(t *testing.T) {
+	if !SomeChat(0).Valid || SomeChat(0) == NoChat {
+		t.Errorf("Expected chat 0 to be a real chat")
+	}
+	var zero ChatID
+	if zero.Valid || zero != NoChat {
+		t.Errorf("Expected the zero ChatID to be NoChat")
+	}
+
+	for _, chatID := range []ChatID{NoChat, SomeChat(0), SomeChat(42)} {
+		p := PendingLink{ChatID: storedPendingChatID(chatID)}
+		if p.chatID() != chatID {
+			t.Errorf("Expected %+v to survive being stored on a PendingLink, got %+v", chatID, p.chatID())
+		}
+	}
+}
+
+func TestAPIKeyRevoked(t *testing.T) {
+	if (&APIKey{}).isRevoked() {
+		t.Errorf("Expected keys from before revocation existed to be active")
+	}
+	if !(&APIKey{RevokedAt: time.Now()}).isRevoked() {
+		t.Errorf("Expected a key with RevokedAt to be revoked")
+	}
+}
+
+func TestAPIKeyCreationLimit(t *testing.T) {
+	if limit := (&APIKey{}).creationLimit(); limit != API_KEY_RATE_LIMIT {
+		t.Errorf("Expected a key without a limit to get %d, got %d", API_KEY_RATE_LIMIT, limit)
+	}
+	if limit := (&APIKey{RateLimit: 5}).creationLimit(); limit != 5 {
+		t.Errorf("Expected the key's own limit of 5, got %d", limit)
+	}
+}
+
+func TestLinkRequiresAuth(t *testing.T) {
+	defer func(enabled bool) { config.AnonymousRedirects = enabled }(config.AnonymousRedirects)
+
+	config.AnonymousRedirects = false
+	if !(&Link{AllowAnonymous: true}).requiresAuth() {
+		t.Errorf("Expected every link to need auth while anonymous redirects are off")
+	}
+
+	config.AnonymousRedirects = true
+	if (&Link{AllowAnonymous: true}).requiresAuth() {
+		t.Errorf("Expected an anonymous link not to need auth")
+	}
+	if !(&Link{}).requiresAuth() {
+		t.Errorf("Expected links to need auth unless marked otherwise")
+	}
+}
+
+func TestRedirectStatus(t *testing.T) {
+	cases := []struct {
+		link     Link
+		expected int
+	}{
+		{Link{}, http.StatusFound},
+		{Link{PreserveMethod: true}, http.StatusTemporaryRedirect},
+		{Link{Permanent: true}, http.StatusMovedPermanently},
+		{Link{Permanent: true, PreserveMethod: true}, http.StatusPermanentRedirect},
+	}
+	for _, tc := range cases {
+		if status := tc.link.RedirectStatus(); status != tc.expected {
+			t.Errorf("For %+v, expected %d but got %d", tc.link, tc.expected, status)
+		}
+	}
+}
+
+func TestRedirectCacheControl(t *testing.T) {
+	defer func(enabled bool) { config.AnonymousRedirects = enabled }(config.AnonymousRedirects)
+	config.AnonymousRedirects = true
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		link     Link
+		expected string
+	}{
+		{Link{}, "no-cache, no-store"},
+		{Link{Permanent: true}, "private, max-age=2592000"},
+		{Link{Permanent: true, AllowAnonymous: true}, "public, max-age=2592000"},
+		{Link{Permanent: true, ExpiresAt: now.Add(time.Hour)}, "private, max-age=3600"},
+	}
+	for _, tc := range cases {
+		if header := tc.link.RedirectCacheControl(now); header != tc.expected {
+			t.Errorf("For %+v, expected %q but got %q", tc.link, tc.expected, header)
+		}
+	}
+}
+
+func TestLinkJSONLeavesOutOwnerOnlyFields(t *testing.T) {
+	link := Link{Path: "p", PrivateNotes: "only for me", Metadata: `{"crmID":"1234"}`, AuthCredentials: []byte("sealed")}
+	asJSON, _ := json.Marshal(&link)
+	for _, field := range []string{"PrivateNotes", "only for me", "AuthCredentials", "AuthMode", "crmID", "APIKeyID"} {
+		if strings.Contains(string(asJSON), field) {
+			t.Errorf("Link JSON contains %q: %s", field, asJSON)
+		}
+	}
+}
+
+func TestValidatePrivateNotes(t *testing.T) {
+	if err := validatePrivateNotes(strings.Repeat("é", MAX_PRIVATE_NOTES_LENGTH)); err != nil {
+		t.Errorf("Expected notes at the limit to be fine, got %v", err)
+	}
+	if err := validatePrivateNotes(strings.Repeat("a", MAX_PRIVATE_NOTES_LENGTH+1)); err == nil {
+		t.Errorf("Expected notes over the limit to be refused")
+	}
+}
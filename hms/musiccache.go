@@ -0,0 +1,63 @@
+package hms
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Bypasses MusicCache when turned off, so every music link asks the provider
+// again.
+const FLAG_MUSIC_CACHE = "music_cache"
+
+// The music provider's answer for a target, so repeat shortenings of the same
+// song don't ask it again. Keyed by musicCacheKeyName.
+type MusicCache struct {
+	TargetURL string `datastore:",noindex"`
+	MusicInfo MusicInfo
+	Cached    time.Time
+}
+
+// Targets can be longer than a key name may be, so they're hashed.
+func musicCacheKeyName(target string) string {
+	sum := sha1.Sum([]byte(target))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the cached music info for target, or nil if there's none younger
+// than config.MusicCacheTTL.
+func getCachedMusicInfo(c context.Context, target string) *MusicInfo {
+	if config.MusicCacheTTL <= 0 || !isFeatureEnabled(c, FLAG_MUSIC_CACHE) {
+		return nil
+	}
+
+	var cached MusicCache
+	err := datastore.Get(c, datastore.NewKey(c, "MusicCache", musicCacheKeyName(target), 0, nil), &cached)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			log.Errorf(c, "Failed to read music cache for %v: %v", target, err)
+		}
+		return nil
+	}
+	if cached.TargetURL != target || time.Since(cached.Cached) > config.MusicCacheTTL {
+		return nil
+	}
+	return &cached.MusicInfo
+}
+
+func cacheMusicInfo(c context.Context, target string, info *MusicInfo) {
+	if config.MusicCacheTTL <= 0 || !isFeatureEnabled(c, FLAG_MUSIC_CACHE) {
+		return
+	}
+
+	cached := MusicCache{TargetURL: target, MusicInfo: *info, Cached: time.Now()}
+	_, err := datastore.Put(c, datastore.NewKey(c, "MusicCache", musicCacheKeyName(target), 0, nil), &cached)
+	if err != nil {
+		log.Errorf(c, "Failed to cache music info for %v: %v", target, err)
+	}
+}
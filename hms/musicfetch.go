@@ -0,0 +1,142 @@
+package hms
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	MUSIC_INFO_URL = "http://music.hms.space/get_music_info"
+	// How many times the task queue retries a music info fetch that failed
+	// while the link was being created.
+	MUSIC_INFO_MAX_RETRIES = 5
+)
+
+// Asks the music provider about target.
+func fetchMusicInfo(c context.Context, target string) (*MusicInfo, error) {
+	params := url.Values{}
+	params.Set("link", target)
+	resp, err := urlfetch.Client(c).Get(MUSIC_INFO_URL + "?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("music provider returned %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var info MusicInfo
+	if err = json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("invalid music response %q: %v", body, err)
+	}
+	return &info, nil
+}
+
+// Queues a retry of the music info fetch for the link at key, if the fetch
+// failed when it was created. Failing to queue is just logged.
+func queueMusicInfoFetch(c context.Context, key *datastore.Key, u *Link) {
+	t := newMusicInfoFetchTask(key, u)
+	if t == nil {
+		return
+	}
+	if _, err := taskqueue.Add(c, t, ""); err != nil {
+		log.Errorf(c, "Failed to queue music info fetch for link %v: %v", key, err)
+	}
+}
+
+// Returns the task queueMusicInfoFetch queues, or nil if u doesn't need one.
+func newMusicInfoFetchTask(key *datastore.Key, u *Link) *taskqueue.Task {
+	if !u.musicInfoPending {
+		return nil
+	}
+	t := taskqueue.NewPOSTTask("/fetch_music_info", url.Values{
+		"id":     {strconv.FormatInt(key.IntID(), 10)},
+		"target": {u.TargetURL},
+	})
+	t.RetryOptions = &taskqueue.RetryOptions{RetryLimit: MUSIC_INFO_MAX_RETRIES}
+	return t
+}
+
+// Retries the music info fetch for one link. Does nothing if the link is gone,
+// already has music info, or no longer points at `target`, so repeats are
+// harmless. Fails (so the task queue retries) until the last attempt.
+func FetchMusicInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if !isInternalRequest(r) && !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid link ID."))
+		return
+	}
+	key := datastore.NewKey(c, "Link", "", id, nil)
+	target := r.FormValue("target")
+
+	var link Link
+	if err = datastore.Get(c, key, &link); err == datastore.ErrNoSuchEntity {
+		w.Write([]byte("No such link."))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+	if link.TargetURL != target || !link.MusicInfo.IsEmpty() {
+		w.Write([]byte("Nothing to do."))
+		return
+	}
+
+	info, err := fetchMusicInfo(c, target)
+	if err != nil {
+		retries, _ := strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
+		if retries >= MUSIC_INFO_MAX_RETRIES {
+			log.Errorf(c, "Giving up on music info for link %v (%v): %v", key, target, err)
+			w.Write([]byte("Gave up: " + err.Error()))
+			return
+		}
+		log.Warningf(c, "Music info for link %v (%v) failed again: %v", key, target, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+	cacheMusicInfo(c, target, info)
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		var current Link
+		if err := datastore.Get(tc, key, &current); err != nil {
+			return err
+		}
+		if current.TargetURL != target {
+			return nil
+		}
+		current.MusicInfo = *info
+		current.HasMusic = !info.IsEmpty()
+		_, err := datastore.Put(tc, key, &current)
+		return err
+	}, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+	w.Write([]byte("Success!"))
+}
@@ -0,0 +1,155 @@
+package hms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	MUSIC_STATS_BATCH_SIZE = 200
+
+	// How long one stats request may spend scanning before it stops and
+	// hands back a cursor, well inside the request deadline.
+	MUSIC_STATS_BUDGET = 30 * time.Second
+
+	MUSIC_STATS_DEFAULT_TOP = 10
+)
+
+type MusicStatCount struct {
+	Name  string
+	Count int
+}
+
+type MusicStatsResponse struct {
+	Success bool
+	// Number of music links counted.
+	Links      int
+	TopArtists []MusicStatCount
+	TopGenres  []MusicStatCount
+	// Link counts keyed by MusicSource name.
+	Sources map[string]int
+	// False if the scan ran out of time. The counts then only cover the
+	// links scanned so far, and passing Cursor back as `cursor` counts the
+	// rest.
+	Complete bool
+	Cursor   string
+	Error    string
+}
+
+// Aggregates the MusicInfo of music links: how many came from each source,
+// and the most common artists and genres (`top` of each, default 10).
+func MusicStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	top := MUSIC_STATS_DEFAULT_TOP
+	if sTop := r.FormValue("top"); sTop != "" {
+		var err error
+		if top, err = strconv.Atoi(sTop); err != nil || top < 0 {
+			writeMusicStatsError(w, http.StatusBadRequest, "top must be a non-negative number.")
+			return
+		}
+	}
+
+	// Links without music info have an empty title, so this skips them.
+	q := datastore.NewQuery("Link").Filter("MusicInfo.Title >", "")
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			writeMusicStatsError(w, http.StatusBadRequest, "Bad cursor.")
+			return
+		}
+		q = q.Start(decoded)
+	}
+
+	artists := make(map[string]int)
+	genres := make(map[string]int)
+	resp := MusicStatsResponse{
+		Success:  true,
+		Sources:  make(map[string]int),
+		Complete: true,
+	}
+
+	deadline := time.Now().Add(MUSIC_STATS_BUDGET)
+	for {
+		it := q.Limit(MUSIC_STATS_BATCH_SIZE).Run(c)
+		scanned := 0
+		for {
+			var link Link
+			_, err := it.Next(&link)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				writeMusicStatsError(w, http.StatusInternalServerError, fmt.Sprintf("error! %s", err.Error()))
+				return
+			}
+			scanned++
+
+			resp.Links++
+			resp.Sources[link.MusicInfo.SourceType.String()]++
+			for _, artist := range link.MusicInfo.Artists {
+				artists[artist]++
+			}
+			for _, genre := range link.MusicInfo.Genres {
+				genres[genre]++
+			}
+		}
+
+		if scanned < MUSIC_STATS_BATCH_SIZE {
+			break
+		}
+		next, err := it.Cursor()
+		if err != nil {
+			writeMusicStatsError(w, http.StatusInternalServerError, fmt.Sprintf("error! %s", err.Error()))
+			return
+		}
+		if time.Now().After(deadline) {
+			resp.Complete = false
+			resp.Cursor = next.String()
+			break
+		}
+		q = q.Start(next)
+	}
+
+	resp.TopArtists = topMusicStats(artists, top)
+	resp.TopGenres = topMusicStats(genres, top)
+	setPaginationLinks(w, r, resp.Cursor)
+	respJSON, _ := json.Marshal(&resp)
+	w.Write(respJSON)
+}
+
+func writeMusicStatsError(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	respJSON, _ := json.Marshal(&MusicStatsResponse{Error: message})
+	w.Write(respJSON)
+}
+
+// Returns the n names with the highest counts, highest first. Ties are
+// broken alphabetically so the result is stable.
+func topMusicStats(counts map[string]int, n int) []MusicStatCount {
+	result := make([]MusicStatCount, 0, len(counts))
+	for name, count := range counts {
+		result = append(result, MusicStatCount{name, count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Name < result[j].Name
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
@@ -0,0 +1,22 @@
+package hms
+
+import "testing"
+
+func TestTopMusicStats(t *testing.T) {
+	counts := map[string]int{"b": 2, "a": 2, "c": 5, "d": 1}
+	expected := []MusicStatCount{{"c", 5}, {"a", 2}, {"b", 2}}
+
+	result := topMusicStats(counts, 3)
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d results, got %v", len(expected), result)
+	}
+	for i := range expected {
+		if result[i] != expected[i] {
+			t.Errorf("At %d, expected %v but got %v", i, expected[i], result[i])
+		}
+	}
+
+	if result = topMusicStats(counts, 10); len(result) != len(counts) {
+		t.Errorf("Expected all %d names, got %v", len(counts), result)
+	}
+}
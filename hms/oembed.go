@@ -0,0 +1,203 @@
+package hms
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	FLAG_OEMBED = "oembed"
+
+	OEMBED_FETCH_TIMEOUT = 10 * time.Second
+	// Most bytes read from a target page when looking for its oEmbed
+	// endpoint, and from the endpoint's response.
+	OEMBED_MAX_PAGE_BYTES     = 512 * 1024
+	OEMBED_MAX_RESPONSE_BYTES = 64 * 1024
+)
+
+// The parts of an oEmbed response (https://oembed.com) worth keeping for
+// previews.
+type OEmbedInfo struct {
+	Type         string `json:"type" datastore:",noindex"`
+	Title        string `json:"title,omitempty" datastore:",noindex"`
+	AuthorName   string `json:"author_name,omitempty" datastore:",noindex"`
+	ProviderName string `json:"provider_name,omitempty" datastore:",noindex"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty" datastore:",noindex"`
+	HTML         string `json:"html,omitempty" datastore:",noindex"`
+	Width        int    `json:"width,omitempty" datastore:",noindex"`
+	Height       int    `json:"height,omitempty" datastore:",noindex"`
+}
+
+// oEmbed endpoints of providers whose pages don't all advertise one, keyed
+// by host.
+var knownOEmbedProviders = map[string]string{
+	"www.youtube.com":  "https://www.youtube.com/oembed",
+	"youtube.com":      "https://www.youtube.com/oembed",
+	"youtu.be":         "https://www.youtube.com/oembed",
+	"twitter.com":      "https://publish.twitter.com/oembed",
+	"x.com":            "https://publish.twitter.com/oembed",
+	"vimeo.com":        "https://vimeo.com/api/oembed.json",
+	"soundcloud.com":   "https://soundcloud.com/oembed",
+	"open.spotify.com": "https://open.spotify.com/oembed",
+}
+
+func knownOEmbedEndpoint(target *url.URL) string {
+	endpoint, ok := knownOEmbedProviders[strings.ToLower(target.Hostname())]
+	if !ok {
+		return ""
+	}
+	return endpoint + "?format=json&url=" + url.QueryEscape(target.String())
+}
+
+var (
+	linkTagRegex = regexp.MustCompile(`(?is)<link\s[^>]*>`)
+	tagAttrRegex = regexp.MustCompile(`(?is)([a-z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// Returns the JSON oEmbed endpoint a page advertises with
+// <link rel="alternate" type="application/json+oembed" href="...">, or ""
+// if it doesn't.
+func findOEmbedEndpoint(page []byte) string {
+	for _, tag := range linkTagRegex.FindAll(page, -1) {
+		attrs := make(map[string]string)
+		for _, attr := range tagAttrRegex.FindAllSubmatch(tag, -1) {
+			attrs[strings.ToLower(string(attr[1]))] = string(attr[2]) + string(attr[3])
+		}
+		if strings.EqualFold(attrs["type"], "application/json+oembed") && attrs["href"] != "" {
+			return html.UnescapeString(attrs["href"])
+		}
+	}
+	return ""
+}
+
+// Queues a task to fill in the link's OEmbedInfo. Failing to queue only
+// costs the preview, so it's just logged.
+func queueOEmbedFetch(c context.Context, key *datastore.Key) {
+	t := newOEmbedFetchTask(c, key)
+	if t == nil {
+		return
+	}
+	if _, err := taskqueue.Add(c, t, ""); err != nil {
+		log.Errorf(c, "Failed to queue oEmbed fetch for link %v: %v", key, err)
+	}
+}
+
+// Returns the task queueOEmbedFetch queues, or nil if oEmbed is off.
+func newOEmbedFetchTask(c context.Context, key *datastore.Key) *taskqueue.Task {
+	if !isFeatureEnabled(c, FLAG_OEMBED) {
+		return nil
+	}
+	return taskqueue.NewPOSTTask("/fetch_oembed", url.Values{"id": {strconv.FormatInt(key.IntID(), 10)}})
+}
+
+// Fetches and stores the oEmbed info of one link. Links whose target has no
+// oEmbed endpoint are left alone.
+func FetchOEmbedHandler(w http.ResponseWriter, r *http.Request) {
+	if !isInternalRequest(r) && !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid link ID."))
+		return
+	}
+	key := datastore.NewKey(c, "Link", "", id, nil)
+
+	var link Link
+	if err = datastore.Get(c, key, &link); err != nil {
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+
+	info, err := fetchOEmbedInfo(c, link.TargetURL)
+	if err != nil {
+		// Returning a 200 keeps the task queue from retrying; most of these
+		// won't get better with time.
+		log.Infof(c, "No oEmbed info for %v: %v", link.TargetURL, err)
+		w.Write([]byte(fmt.Sprintf("No oEmbed info: %s", err.Error())))
+		return
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		var current Link
+		if err := datastore.Get(tc, key, &current); err != nil {
+			return err
+		}
+		current.OEmbedInfo = *info
+		_, err := datastore.Put(tc, key, &current)
+		return err
+	}, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+	w.Write([]byte("Success!"))
+}
+
+func fetchOEmbedInfo(c context.Context, target string) (*OEmbedInfo, error) {
+	tc, cancel := context.WithTimeout(c, OEMBED_FETCH_TIMEOUT)
+	defer cancel()
+	client := urlfetch.Client(tc)
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := knownOEmbedEndpoint(parsed)
+	if endpoint == "" {
+		page, err := fetchLimited(client, target, OEMBED_MAX_PAGE_BYTES)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint = findOEmbedEndpoint(page); endpoint == "" {
+			return nil, fmt.Errorf("no oEmbed endpoint")
+		}
+	}
+
+	body, err := fetchLimited(client, endpoint, OEMBED_MAX_RESPONSE_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	var info OEmbedInfo
+	if err = json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("invalid oEmbed response: %v", err)
+	} else if info.Type == "" {
+		return nil, fmt.Errorf("oEmbed response has no type")
+	}
+	return &info, nil
+}
+
+// GETs target and returns at most limit bytes of its body.
+func fetchLimited(client *http.Client, target string, limit int64) ([]byte, error) {
+	resp, err := client.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s returned %d", target, resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+}
@@ -0,0 +1,34 @@
+package hms
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestFindOEmbedEndpoint(t *testing.T) {
+	cases := map[string]string{
+		`<head><link rel="alternate" type="application/json+oembed" href="https://example.com/oembed?url=a&amp;format=json"></head>`: "https://example.com/oembed?url=a&format=json",
+		`<LINK type='application/json+oembed' href='https://example.com/o' rel='alternate' />`:                                       "https://example.com/o",
+		`<link rel="alternate" type="text/xml+oembed" href="https://example.com/o.xml">`:                                             "",
+		`<link rel="stylesheet" href="/style.css">`:                                                                                  "",
+	}
+
+	for page, expected := range cases {
+		if result := findOEmbedEndpoint([]byte(page)); result != expected {
+			t.Errorf("For %s, expected %q but got %q", page, expected, result)
+		}
+	}
+}
+
+func TestKnownOEmbedEndpoint(t *testing.T) {
+	target, _ := url.Parse("https://www.youtube.com/watch?v=abc")
+	expected := "https://www.youtube.com/oembed?format=json&url=" + url.QueryEscape(target.String())
+	if result := knownOEmbedEndpoint(target); result != expected {
+		t.Errorf("Expected %q but got %q", expected, result)
+	}
+
+	target, _ = url.Parse("https://example.com/")
+	if result := knownOEmbedEndpoint(target); result != "" {
+		t.Errorf("Expected no endpoint for an unknown provider, got %q", result)
+	}
+}
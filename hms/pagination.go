@@ -0,0 +1,70 @@
+package hms
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Returns the URL clients should use to reach us: config.BaseURL, or
+// http:// and linkHost when that's unset.
+func requestBaseURL(r *http.Request) string {
+	if config.BaseURL != "" {
+		return config.BaseURL
+	}
+	return "http://" + linkHost(r)
+}
+
+// Sets an RFC 5988 Link header on w pointing at the first, next and (when
+// known) previous pages of the cursor-paginated listing r asked for. next is
+// the cursor of the next page, empty on the last page. The body's cursor
+// keeps working for clients that prefer it.
+func setPaginationLinks(w http.ResponseWriter, r *http.Request, next string) {
+	if header := paginationLinkHeader(requestBaseURL(r)+r.URL.Path, r.URL.Query(), next); header != "" {
+		w.Header().Set("Link", header)
+	}
+}
+
+// Builds setPaginationLinks' header for the page at pageURL with params.
+//
+// Cursors only go forward, so each next link carries the current cursor as
+// `prevCursor`. A page only has a prev link if it was reached that way.
+func paginationLinkHeader(pageURL string, params url.Values, next string) string {
+	page := func(cursor string, prevCursor *string) string {
+		q := url.Values{}
+		for name, values := range params {
+			if name != "cursor" && name != "prevCursor" {
+				q[name] = values
+			}
+		}
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		if prevCursor != nil {
+			q.Set("prevCursor", *prevCursor)
+		}
+		if len(q) == 0 {
+			return pageURL
+		}
+		return pageURL + "?" + q.Encode()
+	}
+
+	current := params.Get("cursor")
+	links := []string{`<` + page("", nil) + `>; rel="first"`}
+	if next != "" {
+		links = append(links, `<`+page(next, &current)+`>; rel="next"`)
+	}
+	if prev, ok := prevPageCursor(params); ok {
+		links = append(links, `<`+page(prev, nil)+`>; rel="prev"`)
+	}
+	return strings.Join(links, ", ")
+}
+
+// Returns the cursor of the page before the one params asked for (empty for
+// the first page), and false if there's no previous page or it isn't known.
+func prevPageCursor(params url.Values) (string, bool) {
+	if _, ok := params["prevCursor"]; !ok || params.Get("cursor") == "" {
+		return "", false
+	}
+	return params.Get("prevCursor"), true
+}
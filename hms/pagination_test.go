@@ -0,0 +1,57 @@
+package hms
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPaginationLinkHeader(t *testing.T) {
+	base := "https://hms.space/api/links"
+	cases := []struct {
+		query    string
+		next     string
+		expected string
+	}{
+		{"has_music=true", "C2",
+			`<https://hms.space/api/links?has_music=true>; rel="first", ` +
+				`<https://hms.space/api/links?cursor=C2&has_music=true&prevCursor=>; rel="next"`},
+		{"cursor=C2&prevCursor=", "C3",
+			`<https://hms.space/api/links>; rel="first", ` +
+				`<https://hms.space/api/links?cursor=C3&prevCursor=C2>; rel="next", ` +
+				`<https://hms.space/api/links>; rel="prev"`},
+		{"cursor=C3&prevCursor=C2", "",
+			`<https://hms.space/api/links>; rel="first", ` +
+				`<https://hms.space/api/links?cursor=C2>; rel="prev"`},
+		// Without prevCursor, the previous page isn't known.
+		{"cursor=C3", "",
+			`<https://hms.space/api/links>; rel="first"`},
+	}
+
+	for _, tc := range cases {
+		params, _ := url.ParseQuery(tc.query)
+		if header := paginationLinkHeader(base, params, tc.next); header != tc.expected {
+			t.Errorf("For %q and next %q, expected\n%s\nbut got\n%s", tc.query, tc.next, tc.expected, header)
+		}
+	}
+}
+
+func TestPrevPageCursor(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected string
+		ok       bool
+	}{
+		{"", "", false},
+		{"prevCursor=C1", "", false},
+		{"cursor=C2", "", false},
+		{"cursor=C2&prevCursor=", "", true},
+		{"cursor=C3&prevCursor=C2", "C2", true},
+	}
+
+	for _, tc := range cases {
+		params, _ := url.ParseQuery(tc.query)
+		if prev, ok := prevPageCursor(params); prev != tc.expected || ok != tc.ok {
+			t.Errorf("For %q, expected %q, %v but got %q, %v", tc.query, tc.expected, tc.ok, prev, ok)
+		}
+	}
+}
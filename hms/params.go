@@ -0,0 +1,88 @@
+package hms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const MAX_INJECTED_PARAMS = 20
+
+// Parses and validates a serialized set of query params to inject into a
+// link's target, e.g. {"ref": "hms", "campaign": "fall"}.
+func parseQueryParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	if err := json.Unmarshal([]byte(s), &params); err != nil {
+		return nil, fmt.Errorf("Invalid params: %v", err)
+	}
+
+	if len(params) > MAX_INJECTED_PARAMS {
+		return nil, fmt.Errorf("Too many params; at most %d are allowed", MAX_INJECTED_PARAMS)
+	}
+
+	for name, value := range params {
+		if name == "" {
+			return nil, errors.New("Param names can't be empty")
+		}
+		if strings.ContainsAny(name, "&=#?") || strings.IndexFunc(name, unicode.IsSpace) != -1 {
+			return nil, fmt.Errorf("Invalid param name %q", name)
+		}
+		if strings.IndexFunc(name+value, unicode.IsControl) != -1 {
+			return nil, fmt.Errorf("Param %q contains control characters", name)
+		}
+	}
+	return params, nil
+}
+
+// Merges params into target's query string. Params already present on the
+// target are left alone unless override is set. The target's own query is
+// kept byte for byte, apart from the params override replaces, since some
+// sites care how it's encoded or ordered; injected params not already
+// there are appended in name order.
+func injectQueryParams(target string, params map[string]string, override bool) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	pairs := make([]string, 0)
+	present := make(map[string]bool)
+	if u.RawQuery != "" {
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			name := pair
+			if i := strings.Index(name, "="); i != -1 {
+				name = name[:i]
+			}
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+
+			if value, ok := params[name]; ok && override {
+				if present[name] {
+					// Replaced by its first occurrence already.
+					continue
+				}
+				pair = url.QueryEscape(name) + "=" + url.QueryEscape(value)
+			}
+			present[name] = true
+			pairs = append(pairs, pair)
+		}
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if !present[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(params[name]))
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+	return u.String(), nil
+}
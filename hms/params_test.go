@@ -0,0 +1,72 @@
+package hms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInjectQueryParams(t *testing.T) {
+	params := map[string]string{"ref": "hms", "q": "a b&c"}
+
+	cases := []struct {
+		target   string
+		override bool
+		expected string
+	}{
+		{"http://example.com/", false, "http://example.com/?q=a+b%26c&ref=hms"},
+		{"http://example.com/?ref=me", false, "http://example.com/?ref=me&q=a+b%26c"},
+		{"http://example.com/?ref=me", true, "http://example.com/?ref=hms&q=a+b%26c"},
+		{"http://example.com/p#frag", false, "http://example.com/p?q=a+b%26c&ref=hms#frag"},
+		// The target's own query isn't re-encoded or reordered.
+		{"http://example.com/?z=%7e&flag&a=1;2", false, "http://example.com/?z=%7e&flag&a=1;2&q=a+b%26c&ref=hms"},
+		{"http://example.com/?z=%7e&ref=1&ref=2", true, "http://example.com/?z=%7e&ref=hms&q=a+b%26c"},
+	}
+
+	for _, tc := range cases {
+		result, err := injectQueryParams(tc.target, params, tc.override)
+		if err != nil {
+			t.Errorf("For %s, got unexpected error: %v", tc.target, err)
+		} else if result != tc.expected {
+			t.Errorf("For %s (override=%v), expected %s, got %s", tc.target, tc.override, tc.expected, result)
+		}
+	}
+}
+
+func TestParseQueryParamsRejectsInvalid(t *testing.T) {
+	invalid := []string{
+		`not json`,
+		`{"": "x"}`,
+		`{"a=b": "x"}`,
+		`{"a b": "x"}`,
+		`{"a": "line\nbreak"}`,
+		`{"a": 1}`,
+	}
+
+	for _, s := range invalid {
+		if _, err := parseQueryParams(s); err == nil {
+			t.Errorf("Expected an error for params %s", s)
+		}
+	}
+}
+
+func TestRedirectURLWithinBudget(t *testing.T) {
+	l := Link{
+		TargetURL:   "http://example.com/",
+		QueryParams: `{"ref": "hms"}`,
+	}
+
+	if target := l.RedirectURLWithin(0, time.Hour); target != "http://example.com/?ref=hms" {
+		t.Errorf("Expected params to be injected without a budget, got %s", target)
+	}
+	if target := l.RedirectURLWithin(time.Second, time.Millisecond); target != "http://example.com/?ref=hms" {
+		t.Errorf("Expected params to be injected within the budget, got %s", target)
+	}
+	if target := l.RedirectURLWithin(time.Second, 2*time.Second); target != "http://example.com/" {
+		t.Errorf("Expected the plain target once the budget is spent, got %s", target)
+	}
+
+	l.RedirectBudgetMs = 5000
+	if target := l.RedirectURLWithin(time.Second, 2*time.Second); target != "http://example.com/?ref=hms" {
+		t.Errorf("Expected the link's own budget to win, got %s", target)
+	}
+}
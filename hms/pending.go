@@ -0,0 +1,147 @@
+package hms
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const PUBLISH_BATCH_SIZE = 50
+
+// A link that's been prepared ahead of time and will be created once
+// PublishAt has passed.
+type PendingLink struct {
+	// URL-encoded creation parameters, as they would be sent to /api/add.
+	Form    string `datastore:",noindex"`
+	Host    string `datastore:",noindex"`
+	ChatID  int64  // -1 for NoChat; see storedPendingChatID.
+	Creator string
+	// The API key the link was scheduled through.
+	APIKeyID *datastore.Key
+	// The link's credentials, already encrypted like Link.AuthCredentials.
+	// They're never kept in Form.
+	AuthCredentials []byte `datastore:",noindex"`
+	AuthMode        string `datastore:",noindex"`
+	// Why the last attempt to publish failed, if it did.
+	LastError string `datastore:",noindex"`
+	PublishAt time.Time
+	Created   time.Time
+}
+
+// PendingLink.ChatID predates ChatID and is stored as a plain int64, with -1
+// for NoChat. Facebook chat IDs are never negative.
+// Form values that aren't kept in PendingLink.Form: the API key and
+// schedule were already used, and credentials are kept encrypted instead.
+var unstoredPendingFields = []string{"apiKey", "publishAt", "authUser", "authPassword", "authMode"}
+
+// Returns what's stored to publish u, validated from form, at publishAt.
+func newPendingLink(form url.Values, host string, chatID ChatID, u *Link, publishAt time.Time) PendingLink {
+	stored := url.Values{}
+	for name, values := range form {
+		stored[name] = values
+	}
+	for _, name := range unstoredPendingFields {
+		delete(stored, name)
+	}
+
+	return PendingLink{
+		Form:            stored.Encode(),
+		Host:            host,
+		ChatID:          storedPendingChatID(chatID),
+		Creator:         u.Creator,
+		APIKeyID:        u.APIKeyID,
+		AuthCredentials: u.AuthCredentials,
+		AuthMode:        u.AuthMode,
+		PublishAt:       publishAt,
+		Created:         time.Now(),
+	}
+}
+
+func storedPendingChatID(chatID ChatID) int64 {
+	if !chatID.Valid {
+		return -1
+	}
+	return chatID.ID
+}
+
+func (p *PendingLink) chatID() ChatID {
+	if p.ChatID < 0 {
+		return NoChat
+	}
+	return SomeChat(p.ChatID)
+}
+
+func (p *PendingLink) linkRequest() (linkRequest, error) {
+	form, err := url.ParseQuery(p.Form)
+	if err != nil {
+		return linkRequest{}, err
+	}
+	return linkRequest{
+		Form:     form,
+		Host:     p.Host,
+		ChatID:   p.chatID(),
+		Creator:  p.Creator,
+		APIKeyID: p.APIKeyID,
+
+		AuthCredentials: p.AuthCredentials,
+		AuthMode:        p.AuthMode,
+	}, nil
+}
+
+// Creates the links of all pending links that are due. Links that fail to
+// publish stay pending, with the error recorded, and are retried next run.
+func PublishPendingLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !isInternalRequest(r) && !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	w.Header().Set("Content-Type", "text/plain")
+
+	pending := make([]PendingLink, 0, PUBLISH_BATCH_SIZE)
+	keys, err := datastore.NewQuery("PendingLink").
+		Filter("PublishAt <=", time.Now()).Limit(PUBLISH_BATCH_SIZE).GetAll(c, &pending)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+		return
+	}
+
+	published := 0
+	for i := range pending {
+		if err := publishPendingLink(c, keys[i], &pending[i]); err != nil {
+			log.Errorf(c, "Failed to publish pending link %v: %v", keys[i], err)
+			pending[i].LastError = err.Error()
+			if _, err = datastore.Put(c, keys[i], &pending[i]); err != nil {
+				log.Errorf(c, "Failed to record error for pending link %v: %v", keys[i], err)
+			}
+		} else {
+			published++
+		}
+	}
+
+	w.Write([]byte(fmt.Sprintf("Published %d of %d links.", published, len(keys))))
+}
+
+func publishPendingLink(c context.Context, key *datastore.Key, p *PendingLink) error {
+	req, err := p.linkRequest()
+	if err != nil {
+		return err
+	}
+
+	u, err := newLink(c, req)
+	if err != nil {
+		return err
+	}
+	if _, err = putNewLink(c, u); err != nil {
+		return err
+	}
+	return datastore.Delete(c, key)
+}
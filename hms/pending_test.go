@@ -0,0 +1,49 @@
+package hms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewPendingLinkKeepsNoPassword(t *testing.T) {
+	defer func(enabled bool, key string) {
+		config.BasicAuthLinks, config.CredentialsKey = enabled, key
+	}(config.BasicAuthLinks, config.CredentialsKey)
+	config.BasicAuthLinks = true
+	config.CredentialsKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+	form := url.Values{
+		"target":       {"https://example.com/private"},
+		"path":         {"docs"},
+		"apiKey":       {"k"},
+		"publishAt":    {"2030-01-01T00:00:00Z"},
+		"authUser":     {"alice"},
+		"authPassword": {"hunter2"},
+		"authMode":     {AUTH_MODE_URL},
+	}
+	var link Link
+	if err := link.setCredentials("alice", "hunter2", AUTH_MODE_URL); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := newPendingLink(form, "hms.space", NoChat, &link, time.Now())
+	if strings.Contains(pending.Form, "hunter2") || strings.Contains(pending.Form, "auth") || strings.Contains(pending.Form, "apiKey") {
+		t.Errorf("Expected no credentials in the stored form, got %s", pending.Form)
+	}
+	if bytes.Contains(pending.AuthCredentials, []byte("hunter2")) {
+		t.Errorf("Expected the stored credentials to be encrypted")
+	}
+
+	req, err := pending.linkRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := Link{AuthCredentials: req.AuthCredentials, AuthMode: req.AuthMode}
+	if username, password, err := published.credentials(); err != nil || username != "alice" || password != "hunter2" || published.AuthMode != AUTH_MODE_URL {
+		t.Errorf("Expected the credentials to survive publishing, got %q, %q, %v", username, password, err)
+	}
+}
@@ -0,0 +1,182 @@
+package hms
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// Bounds on the `size`, in pixels, of codes served by /qr/{path}.
+const (
+	QR_DEFAULT_SIZE = 256
+	QR_MIN_SIZE     = 64
+	QR_MAX_SIZE     = 1024
+)
+
+// The most codes QRZipHandler makes per request, and the name of the file in
+// its archive listing what was skipped.
+const (
+	QR_ZIP_MAX_CODES = 100
+	QR_ZIP_MANIFEST  = "manifest.txt"
+)
+
+// Serves a PNG QR code of the link's short URL, for printing.
+func handleQRCode(w http.ResponseWriter, r *http.Request, params []string) *appError {
+	if _, ok := handleUserAuth(w, r); !ok {
+		return &appError{nil, "Unauthorized.", 403}
+	}
+
+	size, err := parseQRSize(r.FormValue("size"))
+	if err != nil {
+		return &appError{err, err.Error(), 400}
+	}
+
+	c := appengine.NewContext(r)
+	path := strings.TrimSpace(params[0])
+	target, appErr := qrCodeTarget(c, linkHost(r), path, r.FormValue("chatID"))
+	if appErr != nil {
+		return appErr
+	}
+
+	png, err := qrcode.Encode(target, qrcode.Medium, size)
+	if err != nil {
+		return &appError{err, err.Error(), 500}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(png)
+	return nil
+}
+
+// Returns the short URL a QR code for path (in strChatID, if given) encodes,
+// or an error if there's no such link.
+func qrCodeTarget(c context.Context, host string, path string, strChatID string) (string, *appError) {
+	if _, err := getMatchingLinkChatString(c, strChatID, path); err != nil {
+		if _, ok := err.(*strconv.NumError); ok {
+			return "", &appError{nil, "Invalid FB chat ID", 401}
+		} else if _, link := getAutoLinkByPath(c, path); link == nil {
+			return "", &appError{err, "Invalid short url.", 404}
+		}
+		strChatID = ""
+	}
+
+	target := shortURL(host, path)
+	if strChatID != "" {
+		target += "?chatID=" + strChatID
+	}
+	return target, nil
+}
+
+// Serves a ZIP of QR codes, one PNG named after each `path` (repeated, in
+// `chatID` if given) at `size`, for printing many at once. Paths that aren't
+// links are left out and listed in the archive's QR_ZIP_MANIFEST.
+func QRZipHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if _, ok := handleUserAuth(w, r); !ok {
+		return &appError{nil, "Unauthorized.", 403}
+	}
+
+	size, err := parseQRSize(r.FormValue("size"))
+	if err != nil {
+		return &appError{err, err.Error(), 400}
+	}
+	paths := uniqueQRPaths(r.Form["path"])
+	if len(paths) == 0 {
+		return &appError{nil, "Missing path.", 400}
+	} else if len(paths) > QR_ZIP_MAX_CODES {
+		return &appError{nil, fmt.Sprintf("At most %d codes can be made at once.", QR_ZIP_MAX_CODES), 400}
+	}
+
+	// Everything is looked up before the archive is started, since errors
+	// can't be reported once it has.
+	c := appengine.NewContext(r)
+	targets := make(map[string]string, len(paths))
+	var skipped []string
+	for _, path := range paths {
+		target, appErr := qrCodeTarget(c, linkHost(r), path, r.FormValue("chatID"))
+		if appErr != nil && appErr.Code == 404 {
+			skipped = append(skipped, path)
+			continue
+		} else if appErr != nil {
+			return appErr
+		}
+		targets[path] = target
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="qr-codes.zip"`)
+	archive := zip.NewWriter(w)
+	for _, path := range paths {
+		target, ok := targets[path]
+		if !ok {
+			continue
+		}
+		png, err := qrcode.Encode(target, qrcode.Medium, size)
+		if err != nil {
+			log.Errorf(c, "Failed to make a QR code for %v: %v", path, err)
+			skipped = append(skipped, path)
+			continue
+		}
+		if f, err := archive.Create(path + ".png"); err == nil {
+			f.Write(png)
+		}
+	}
+	if f, err := archive.Create(QR_ZIP_MANIFEST); err == nil {
+		writeQRZipManifest(f, paths, skipped)
+	}
+	if err := archive.Close(); err != nil {
+		log.Errorf(c, "Failed to finish QR code archive: %v", err)
+	}
+	return nil
+}
+
+// Returns paths trimmed, without empty or repeated ones, in order.
+func uniqueQRPaths(paths []string) []string {
+	seen := make(map[string]bool, len(paths))
+	unique := make([]string, 0, len(paths))
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		unique = append(unique, path)
+	}
+	return unique
+}
+
+// Writes which of paths are in the archive and which were skipped, one per
+// line.
+func writeQRZipManifest(w io.Writer, paths []string, skipped []string) {
+	isSkipped := make(map[string]bool, len(skipped))
+	for _, path := range skipped {
+		isSkipped[path] = true
+	}
+	for _, path := range paths {
+		if isSkipped[path] {
+			fmt.Fprintf(w, "skipped\t%s\n", path)
+		} else {
+			fmt.Fprintf(w, "included\t%s.png\n", path)
+		}
+	}
+}
+
+// Parses the `size` parameter, defaulting to QR_DEFAULT_SIZE.
+func parseQRSize(value string) (int, error) {
+	if value == "" {
+		return QR_DEFAULT_SIZE, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < QR_MIN_SIZE || size > QR_MAX_SIZE {
+		return 0, fmt.Errorf("size must be between %d and %d", QR_MIN_SIZE, QR_MAX_SIZE)
+	}
+	return size, nil
+}
@@ -0,0 +1,43 @@
+package hms
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseQRSize(t *testing.T) {
+	cases := map[string]int{
+		"":     QR_DEFAULT_SIZE,
+		"64":   64,
+		"512":  512,
+		"1024": 1024,
+	}
+	for value, expected := range cases {
+		if size, err := parseQRSize(value); err != nil || size != expected {
+			t.Errorf("For %q, expected %d but got %d, %v", value, expected, size, err)
+		}
+	}
+
+	for _, value := range []string{"big", "0", "63", "1025", "-256"} {
+		if size, err := parseQRSize(value); err == nil {
+			t.Errorf("Expected %q to be refused, got %d", value, size)
+		}
+	}
+}
+
+func TestUniqueQRPaths(t *testing.T) {
+	paths := uniqueQRPaths([]string{"docs", " docs ", "", "yD", "docs"})
+	if expected := []string{"docs", "yD"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v but got %v", expected, paths)
+	}
+}
+
+func TestWriteQRZipManifest(t *testing.T) {
+	var buf bytes.Buffer
+	writeQRZipManifest(&buf, []string{"docs", "missing", "yD"}, []string{"missing"})
+	expected := "included\tdocs.png\nskipped\tmissing\nincluded\tyD.png\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,57 @@
+package hms
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// Default for APIKey.RateLimit.
+const API_KEY_RATE_LIMIT = 200
+
+// Counts a request against bucket (e.g. an endpoint and client address) and
+// returns whether it's within limit requests for the current minute. Counts
+// live in memcache, so an eviction can let a few extra requests through, and
+// if memcache is down requests are let through rather than refused.
+func allowRequest(c context.Context, bucket string, limit int) bool {
+	allowed, _ := allowRequestIn(c, bucket, limit, time.Minute)
+	return allowed
+}
+
+// Like allowRequest, but for a fixed window of any length. When the request
+// isn't allowed, also returns how long until the window resets.
+func allowRequestIn(c context.Context, bucket string, limit int, window time.Duration) (bool, time.Duration) {
+	now := time.Now()
+	windowSecs := int64(window / time.Second)
+	start := now.Unix() / windowSecs
+	key := fmt.Sprintf("rate:%s:%d", bucket, start)
+	count, err := memcache.Increment(c, key, 1, 0)
+	if err != nil {
+		log.Warningf(c, "Rate limit check for %v failed: %v", bucket, err)
+		return true, 0
+	}
+	if count <= uint64(limit) {
+		return true, 0
+	}
+	return false, time.Unix((start+1)*windowSecs, 0).Sub(now)
+}
+
+// Wraps an API handler that creates links so that each API key can only use
+// it (and every other wrapped handler) APIKey.creationLimit() times an hour.
+func creationRateLimited(handler apiHandler) apiHandler {
+	return func(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+		allowed, retryAfter := allowRequestIn(c, "create:"+apiKey.APIKey, apiKey.creationLimit(), time.Hour)
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			return &appError{nil, "This API key has created too many links. Try again later.", http.StatusTooManyRequests}
+		}
+		return handler(c, w, r, apiKey)
+	}
+}
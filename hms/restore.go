@@ -0,0 +1,372 @@
+package hms
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// One line of a BackupLinksHandler backup.
+type backupLine struct {
+	Path     string
+	Target   string
+	Creator  string
+	Created  time.Time
+	HasChat  bool
+	FbChatID int64
+	ChatName string
+	ID       int64
+	Original string
+	Notes    string
+}
+
+// Checks the path and target of a link being restored. Auto-encoded paths
+// are allowed, unlike for new links.
+func validateBackupLink(path string, target string) error {
+	if path == "" || strings.Contains(path, "/") {
+		return fmt.Errorf("invalid path %q", path)
+	}
+	parsed, err := (&Link{TargetURL: target}).parseTarget()
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("invalid target %q", target)
+	}
+	return nil
+}
+
+// Parses a line of the text backup. Lines from before the id, code and
+// originalTarget fields existed, and lines with no chat fields at all, are
+// accepted too.
+func parseBackupLine(line string) (*backupLine, error) {
+	fields := strings.Split(line, "|||")
+	if len(fields) < 4 {
+		return nil, errors.New("too few fields")
+	}
+
+	parsed := backupLine{Path: fields[0], Target: fields[1], Creator: fields[2]}
+	if err := validateBackupLink(parsed.Path, parsed.Target); err != nil {
+		return nil, err
+	}
+	created, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid created time %q", fields[3])
+	}
+	parsed.Created = time.Unix(created, 0)
+
+	if len(fields) > 4 && fields[4] != "" {
+		if parsed.FbChatID, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid chat ID %q", fields[4])
+		}
+		parsed.HasChat = true
+	}
+	if len(fields) > 5 {
+		parsed.ChatName = fields[5]
+	}
+	if len(fields) > 6 && fields[6] != "" {
+		if parsed.ID, err = strconv.ParseInt(fields[6], 10, 64); err != nil || parsed.ID <= 0 {
+			return nil, fmt.Errorf("invalid id %q", fields[6])
+		}
+		if len(fields) > 7 && fields[7] != autoLinkPath(parsed.ID) && ShortURLDecode(fields[7]) != parsed.ID {
+			return nil, fmt.Errorf("code %q doesn't match id %d", fields[7], parsed.ID)
+		}
+	}
+	if len(fields) > 8 {
+		parsed.Original = fields[8]
+	}
+	if len(fields) > 9 {
+		if parsed.Notes, err = strconv.Unquote(fields[9]); err != nil {
+			return nil, errors.New("invalid private notes")
+		}
+	}
+	return &parsed, nil
+}
+
+// Collects the links being restored, merging ones that appear more than once
+// (like a link's lines for each of its chats) by id.
+type restorer struct {
+	c        context.Context
+	links    []*Link
+	keys     []*datastore.Key
+	byID     map[int64]*Link
+	chatKeys map[int64]*datastore.Key
+	failures []string
+}
+
+func newRestorer(c context.Context) *restorer {
+	return &restorer{c: c, byID: make(map[int64]*Link), chatKeys: make(map[int64]*datastore.Key)}
+}
+
+func (rs *restorer) fail(where string, err error) {
+	rs.failures = append(rs.failures, fmt.Sprintf("%s: %v", where, err))
+}
+
+// Adds link, with the datastore ID id (0 for a new one), in chats (nil
+// entries meaning no chat).
+func (rs *restorer) add(where string, id int64, link *Link, chats []*Chat) {
+	chatKeys := make([]*datastore.Key, 0, len(chats))
+	for _, chat := range chats {
+		key, err := rs.restoreChat(chat)
+		if err != nil {
+			rs.fail(where, err)
+			return
+		}
+		chatKeys = append(chatKeys, key)
+	}
+
+	if existing, ok := rs.byID[id]; ok && id != 0 {
+		existing.ChatKeys = append(existing.ChatKeys, chatKeys...)
+		return
+	}
+
+	link.ChatKeys = chatKeys
+	link.setPath(link.Path)
+	key := datastore.NewIncompleteKey(rs.c, "Link", nil)
+	if id != 0 {
+		key = datastore.NewKey(rs.c, "Link", "", id, nil)
+		rs.byID[id] = link
+	}
+	rs.links = append(rs.links, link)
+	rs.keys = append(rs.keys, key)
+}
+
+// Returns the key of chat, creating it (with its name) if needed, or nil if
+// chat is nil.
+func (rs *restorer) restoreChat(chat *Chat) (*datastore.Key, error) {
+	if chat == nil {
+		return nil, nil
+	}
+	if key, ok := rs.chatKeys[chat.FacebookChatID]; ok {
+		return key, nil
+	}
+
+	var key *datastore.Key
+	stored, err := getOrCreateChat(rs.c, chat.FacebookChatID, &key)
+	if err != nil {
+		return nil, err
+	}
+	if stored.ChatName == "" && chat.ChatName != "" {
+		stored.ChatName = chat.ChatName
+		if _, err = datastore.Put(rs.c, key, stored); err != nil {
+			return nil, err
+		}
+	}
+	rs.chatKeys[chat.FacebookChatID] = key
+	return key, nil
+}
+
+// Reads a text backup, one line at a time.
+func (rs *restorer) readText(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		where := fmt.Sprintf("line %d", lineNum)
+		line, err := parseBackupLine(scanner.Text())
+		if err != nil {
+			rs.fail(where, err)
+			continue
+		}
+
+		var chat *Chat
+		if line.HasChat {
+			chat = &Chat{ChatName: line.ChatName, FacebookChatID: line.FbChatID}
+		}
+		rs.add(where, line.ID, &Link{
+			Path:           line.Path,
+			TargetURL:      line.Target,
+			OriginalTarget: line.Original,
+			Creator:        line.Creator,
+			Created:        line.Created,
+			PrivateNotes:   line.Notes,
+			SchemaVersion:  LINK_SCHEMA_VERSION,
+		}, []*Chat{chat})
+	}
+	return scanner.Err()
+}
+
+// Reads a JSON backup's BackupRecords, either as an array or one per line.
+func (rs *restorer) readJSON(r io.Reader, asArray bool) error {
+	dec := json.NewDecoder(r)
+	if asArray {
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	for n := 1; dec.More(); n++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			// The decoder can't resync after malformed JSON.
+			return fmt.Errorf("record %d: %v", n, err)
+		}
+		record, chats, err := decodeBackupRecord(raw)
+		if err != nil {
+			return fmt.Errorf("record %d: %v", n, err)
+		}
+
+		where := fmt.Sprintf("record %d", n)
+		link, err := linkFromBackupRecord(record)
+		if err != nil {
+			rs.fail(where, err)
+			continue
+		}
+		if record.APIKeyID > 0 {
+			link.APIKeyID = datastore.NewKey(rs.c, "APIKey", "", record.APIKeyID, nil)
+		}
+		rs.add(where, record.ID, link, chats)
+	}
+	return nil
+}
+
+// Decodes one BackupRecord, returning the chats to restore its link in.
+// Records from before chats were backed up have no "chats" at all and are
+// restored without a chat; an empty or null "chats" means the link was in
+// no chats and stays that way.
+func decodeBackupRecord(data []byte) (*BackupRecord, []*Chat, error) {
+	var record BackupRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, err
+	}
+	if _, ok := fields["chats"]; !ok {
+		return &record, []*Chat{nil}, nil
+	}
+	return &record, record.Chats, nil
+}
+
+// Validates record and returns its link, brought up to date.
+func linkFromBackupRecord(record *BackupRecord) (*Link, error) {
+	if err := validateBackupLink(record.Path, record.TargetURL); err != nil {
+		return nil, err
+	}
+	if record.ID < 0 {
+		return nil, fmt.Errorf("invalid id %d", record.ID)
+	}
+
+	link := record.Link
+	link.PrivateNotes = record.PrivateNotes
+	if len(record.Metadata) > 0 {
+		serialized, _ := json.Marshal(record.Metadata)
+		metadata, err := parseMetadata(string(serialized))
+		if err != nil {
+			return nil, err
+		}
+		link.Metadata = metadata
+	}
+	// Chats are filled in by the restorer; this only catches up on
+	// everything else.
+	link.ChatKeys = []*datastore.Key{nil}
+	migrateLink(&link)
+	return &link, nil
+}
+
+// Stores everything read, in batches. Returns how many links were stored.
+func (rs *restorer) store() int {
+	restored := 0
+	for i := 0; i < len(rs.links); i += MIGRATION_BATCH_SIZE {
+		end := i + MIGRATION_BATCH_SIZE
+		if end > len(rs.links) {
+			end = len(rs.links)
+		}
+		if err := rs.bumpVersions(rs.keys[i:end], rs.links[i:end]); err != nil {
+			rs.fail(fmt.Sprintf("links %d to %d", i+1, end), err)
+			continue
+		}
+		if _, err := datastore.PutMulti(rs.c, rs.keys[i:end], rs.links[i:end]); err != nil {
+			rs.fail(fmt.Sprintf("links %d to %d", i+1, end), err)
+			continue
+		}
+		// Restored links can replace ones that are cached.
+		uncacheLinks(rs.c, rs.keys[i:end]...)
+		restored += end - i
+	}
+	return restored
+}
+
+// Gives each link a Version past both its backed-up one and that of the link
+// it overwrites, if any, so clients holding the old version see the change.
+func (rs *restorer) bumpVersions(keys []*datastore.Key, links []*Link) error {
+	existingKeys := make([]*datastore.Key, 0, len(keys))
+	existingLinks := make([]*Link, 0, len(keys))
+	for i, key := range keys {
+		if !key.Incomplete() {
+			existingKeys = append(existingKeys, key)
+			existingLinks = append(existingLinks, links[i])
+		}
+	}
+
+	existing := make([]Link, len(existingKeys))
+	err := datastore.GetMulti(rs.c, existingKeys, existing)
+	errs, _ := err.(appengine.MultiError)
+	if err != nil && errs == nil {
+		return err
+	}
+	for i, link := range existingLinks {
+		if errs != nil && errs[i] != nil {
+			if errs[i] != datastore.ErrNoSuchEntity {
+				return errs[i]
+			}
+		} else if existing[i].Version > link.Version {
+			link.Version = existing[i].Version
+		}
+	}
+	for _, link := range links {
+		link.Version++
+	}
+	return nil
+}
+
+// Re-creates the links in a backup POSTed in BackupLinksHandler's format, or
+// in a JSON format with format=json or format=jsonl. A link's entries are
+// grouped by id, since text backups have a line per chat, and stored under
+// their original IDs so their auto-encoded codes keep working; existing
+// links with those IDs are overwritten. Entries without ids (from older
+// backups) each get a new link. Malformed entries are reported and skipped;
+// nothing is written for them.
+func RestoreLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleAdminAuth(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Backups have to be POSTed."))
+		return
+	}
+
+	c := appengine.NewContext(r)
+	w.Header().Set("Content-Type", "text/plain")
+
+	rs := newRestorer(c)
+	var err error
+	switch format := r.URL.Query().Get("format"); format {
+	case BACKUP_FORMAT_JSON, BACKUP_FORMAT_JSONL:
+		err = rs.readJSON(r.Body, format == BACKUP_FORMAT_JSON)
+	default:
+		err = rs.readText(r.Body)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Failed to read the backup: " + err.Error()))
+		return
+	}
+
+	restored := rs.store()
+	w.Write([]byte(fmt.Sprintf("Restored %d of %d links.\n", restored, len(rs.links))))
+	for _, failure := range rs.failures {
+		w.Write([]byte(failure + "\n"))
+	}
+}
@@ -0,0 +1,105 @@
+package hms
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBackupLine(t *testing.T) {
+	code := autoLinkPath(7)
+	line, err := parseBackupLine("docs|||https://example.com/|||a@example.com|||1456833600|||42|||Friends|||7|||" +
+		code + `|||example.com|||"see \"ticket\""`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line.Path != "docs" || !line.Created.Equal(time.Unix(1456833600, 0)) || !line.HasChat || line.FbChatID != 42 ||
+		line.ChatName != "Friends" || line.ID != 7 || line.Original != "example.com" || line.Notes != `see "ticket"` {
+		t.Errorf("Unexpected line %+v", line)
+	}
+
+	// Analytics fields after the notes are ignored.
+	line, err = parseBackupLine("docs|||https://example.com/|||a@example.com|||1456833600|||||||||7|||" +
+		code + `||||||""|||12|||1456833600|||3`)
+	if err != nil || line.Notes != "" || line.ID != 7 {
+		t.Errorf("Unexpected line with analytics %+v, %v", line, err)
+	}
+
+	// A chatless line from before ids were written.
+	line, err = parseBackupLine("docs|||https://example.com/|||a@example.com|||1456833600||||||")
+	if err != nil || line.HasChat || line.ID != 0 {
+		t.Errorf("Unexpected line %+v, %v", line, err)
+	}
+
+	for _, bad := range []string{
+		"docs|||https://example.com/|||a@example.com",
+		"a/b|||https://example.com/|||a@example.com|||1456833600",
+		"docs|||not a url|||a@example.com|||1456833600",
+		"docs|||https://example.com/|||a@example.com|||yesterday",
+		"docs|||https://example.com/|||a@example.com|||1456833600|||chat|||",
+		"docs|||https://example.com/|||a@example.com|||1456833600||||||7|||yB",
+	} {
+		if _, err = parseBackupLine(bad); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestLinkFromBackupRecordRoundTrip(t *testing.T) {
+	original := BackupRecord{
+		ID:           7,
+		Code:         autoLinkPath(7),
+		Chats:        []*Chat{{ChatName: "Friends", FacebookChatID: 42}, nil},
+		PrivateNotes: "a ||| b",
+		Metadata:     map[string]string{"crmID": "1234"},
+		Link: Link{
+			Path:          "docs",
+			TargetURL:     "https://example.com/a|||b",
+			Created:       time.Unix(1456833600, 0).UTC(),
+			MusicInfo:     MusicInfo{Title: "Song", SourceType: SOURCE_SPOTIFY},
+			HasMusic:      true,
+			SchemaVersion: 1,
+		},
+	}
+	encoded, _ := json.Marshal(&original)
+	var decoded BackupRecord
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Chats, original.Chats) {
+		t.Errorf("Expected chats %v but got %v", original.Chats, decoded.Chats)
+	}
+
+	link, err := linkFromBackupRecord(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Path != "docs" || link.TargetURL != original.TargetURL || !link.Created.Equal(original.Created) ||
+		link.MusicInfo.Title != "Song" || link.PrivateNotes != "a ||| b" || link.Metadata != `{"crmID":"1234"}` {
+		t.Errorf("Unexpected link %+v", link)
+	}
+	if link.SchemaVersion != LINK_SCHEMA_VERSION || link.PathLower != "docs" {
+		t.Errorf("Expected the restored link to be migrated, got version %d", link.SchemaVersion)
+	}
+
+	decoded.TargetURL = "not a url"
+	if _, err = linkFromBackupRecord(&decoded); err == nil {
+		t.Errorf("Expected a record with a bad target to be refused")
+	}
+}
+
+func TestDecodeBackupRecordChats(t *testing.T) {
+	cases := map[string][]*Chat{
+		`{"Path":"old","TargetURL":"https://example.com/"}`:                     {nil},
+		`{"Path":"detached","TargetURL":"https://example.com/","chats":null}`:   nil,
+		`{"Path":"detached","TargetURL":"https://example.com/","chats":[]}`:     {},
+		`{"Path":"chatless","TargetURL":"https://example.com/","chats":[null]}`: {nil},
+	}
+	for data, expected := range cases {
+		_, chats, err := decodeBackupRecord([]byte(data))
+		if err != nil || len(chats) != len(expected) || (len(chats) == 1 && chats[0] != nil) {
+			t.Errorf("For %s, expected chats %v but got %v, %v", data, expected, chats, err)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package hms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	SAFE_BROWSING_URL     = "https://safebrowsing.googleapis.com/v4/threatMatches:find"
+	SAFE_BROWSING_TIMEOUT = 3 * time.Second
+
+	// How long a link's SafeBrowsingStatus is trusted before
+	// RecheckSafeBrowsingHandler looks it up again.
+	SAFE_BROWSING_RECHECK_AFTER      = 7 * 24 * time.Hour
+	SAFE_BROWSING_RECHECK_BATCH_SIZE = 100
+)
+
+// Values for Link.SafeBrowsingStatus. Unknown (empty) covers links never
+// checked and ones checked while Safe Browsing was off or unreachable.
+const (
+	SAFE_BROWSING_UNKNOWN = ""
+	SAFE_BROWSING_PASSED  = "passed"
+	SAFE_BROWSING_FLAGGED = "flagged"
+)
+
+var safeBrowsingThreatTypes = []string{
+	"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION",
+}
+
+// The parts of the Safe Browsing Lookup API (v4) request and response used
+// here.
+type safeBrowsingRequest struct {
+	Client struct {
+		ClientID      string `json:"clientId"`
+		ClientVersion string `json:"clientVersion"`
+	} `json:"client"`
+	ThreatInfo struct {
+		ThreatTypes      []string            `json:"threatTypes"`
+		PlatformTypes    []string            `json:"platformTypes"`
+		ThreatEntryTypes []string            `json:"threatEntryTypes"`
+		ThreatEntries    []safeBrowsingEntry `json:"threatEntries"`
+	} `json:"threatInfo"`
+}
+
+type safeBrowsingEntry struct {
+	URL string `json:"url"`
+}
+
+type safeBrowsingResponse struct {
+	Matches []struct {
+		ThreatType string            `json:"threatType"`
+		Threat     safeBrowsingEntry `json:"threat"`
+	} `json:"matches"`
+}
+
+func newSafeBrowsingRequest(targets []string) *safeBrowsingRequest {
+	req := &safeBrowsingRequest{}
+	req.Client.ClientID = "hms"
+	req.Client.ClientVersion = "1"
+	req.ThreatInfo.ThreatTypes = safeBrowsingThreatTypes
+	req.ThreatInfo.PlatformTypes = []string{"ANY_PLATFORM"}
+	req.ThreatInfo.ThreatEntryTypes = []string{"URL"}
+	for _, target := range targets {
+		req.ThreatInfo.ThreatEntries = append(req.ThreatInfo.ThreatEntries, safeBrowsingEntry{target})
+	}
+	return req
+}
+
+// Returns the targets a lookup response flags, each with why.
+func safeBrowsingMatches(body []byte) (map[string]string, error) {
+	var resp safeBrowsingResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	flagged := make(map[string]string, len(resp.Matches))
+	for _, match := range resp.Matches {
+		flagged[match.Threat.URL] = match.ThreatType
+	}
+	return flagged, nil
+}
+
+// Refuses targets that Google Safe Browsing flags as malicious, and returns
+// the SafeBrowsingStatus of the ones it lets through. Does nothing unless
+// config.SafeBrowsingKey is set, and lets the targets through if the lookup
+// itself fails, so the shortener keeps working while it's down.
+func checkSafeBrowsing(c context.Context, targets []string) (string, error) {
+	flagged, checked := lookupSafeBrowsing(c, targets)
+	for _, target := range targets {
+		if threatType, ok := flagged[target]; ok {
+			return SAFE_BROWSING_FLAGGED, safeBrowsingError(target, threatType)
+		}
+	}
+	return safeBrowsingStatus(targets, flagged, checked), nil
+}
+
+// Returns the SafeBrowsingStatus of a link with targets, from a lookup that
+// found flagged, if checked says it happened at all.
+func safeBrowsingStatus(targets []string, flagged map[string]string, checked bool) string {
+	if !checked {
+		return SAFE_BROWSING_UNKNOWN
+	}
+	for _, target := range targets {
+		if _, ok := flagged[target]; ok {
+			return SAFE_BROWSING_FLAGGED
+		}
+	}
+	return SAFE_BROWSING_PASSED
+}
+
+// Records the result of a Safe Browsing check on the link at now.
+func (l *Link) setSafeBrowsingStatus(status string, now time.Time) {
+	l.SafeBrowsingStatus = status
+	if status != SAFE_BROWSING_UNKNOWN {
+		l.SafeBrowsingCheckedAt = now
+	}
+}
+
+// The targets of the link Safe Browsing checks.
+func (l *Link) safeBrowsingTargets() []string {
+	return append([]string{l.TargetURL}, l.FallbackTargets...)
+}
+
+// Returns whether the link's Safe Browsing status is due to be looked up
+// again by now.
+func (l *Link) safeBrowsingRecheckDue(now time.Time) bool {
+	return now.Sub(l.SafeBrowsingCheckedAt) >= SAFE_BROWSING_RECHECK_AFTER
+}
+
+func safeBrowsingError(target string, threatType string) error {
+	return fmt.Errorf("%s is flagged by Google Safe Browsing (%s) and can't be linked to.", target, threatType)
+}
+
+// Looks up all of targets in one request, returning the flagged ones with
+// why, and whether the lookup happened. Like checkSafeBrowsing, flags
+// nothing if the lookup fails or isn't configured.
+func lookupSafeBrowsing(c context.Context, targets []string) (map[string]string, bool) {
+	if config.SafeBrowsingKey == "" {
+		return nil, false
+	} else if len(targets) == 0 {
+		return nil, true
+	}
+
+	reqJSON, _ := json.Marshal(newSafeBrowsingRequest(targets))
+	tc, cancel := context.WithTimeout(c, SAFE_BROWSING_TIMEOUT)
+	defer cancel()
+
+	resp, err := urlfetch.Client(tc).Post(SAFE_BROWSING_URL+"?key="+url.QueryEscape(config.SafeBrowsingKey),
+		"application/json", bytes.NewReader(reqJSON))
+	if err != nil {
+		log.Warningf(c, "Safe Browsing lookup for %v failed, allowing: %v", targets, err)
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Warningf(c, "Safe Browsing lookup for %v failed with status %d, allowing: %v", targets, resp.StatusCode, err)
+		return nil, false
+	}
+
+	flagged, err := safeBrowsingMatches(body)
+	if err != nil {
+		log.Warningf(c, "Couldn't parse Safe Browsing response for %v, allowing: %v", targets, err)
+		return nil, false
+	}
+	return flagged, true
+}
+
+// Looks up the Safe Browsing status of one batch of links that haven't been
+// checked in SAFE_BROWSING_RECHECK_AFTER and, if there are more links, queues
+// a task for the next batch. Run by cron, since a target can turn malicious
+// after the link was made.
+func RecheckSafeBrowsingHandler(w http.ResponseWriter, r *http.Request) {
+	if !isInternalRequest(r) && !handleAdminAuth(w, r) {
+		return
+	}
+
+	c := appengine.NewContext(r)
+	w.Header().Set("Content-Type", "text/plain")
+	if config.SafeBrowsingKey == "" {
+		w.Write([]byte("Safe Browsing isn't configured."))
+		return
+	}
+
+	q := datastore.NewQuery("Link")
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Bad cursor."))
+			return
+		}
+		q = q.Start(decoded)
+	}
+
+	// Filtered here rather than in the query, which would skip links
+	// stored before SafeBrowsingCheckedAt existed.
+	now := time.Now()
+	keys := make([]*datastore.Key, 0, SAFE_BROWSING_RECHECK_BATCH_SIZE)
+	linkTargets := make([][]string, 0, SAFE_BROWSING_RECHECK_BATCH_SIZE)
+	targets := make([]string, 0, SAFE_BROWSING_RECHECK_BATCH_SIZE)
+	read := 0
+	it := q.Limit(SAFE_BROWSING_RECHECK_BATCH_SIZE).Run(c)
+	for {
+		var link Link
+		key, err := it.Next(&link)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("error! %s", err.Error())))
+			return
+		}
+		read++
+		if link.AliasOf == nil && link.safeBrowsingRecheckDue(now) {
+			keys = append(keys, key)
+			linkTargets = append(linkTargets, link.safeBrowsingTargets())
+			targets = append(targets, link.safeBrowsingTargets()...)
+		}
+	}
+
+	flagged, checked := lookupSafeBrowsing(c, targets)
+	if !checked {
+		// Tried again on the next run.
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Safe Browsing lookup failed."))
+		return
+	}
+	for i, key := range keys {
+		if err := recordSafeBrowsingStatus(c, key, linkTargets[i], flagged, now); err != nil {
+			log.Errorf(c, "Failed to record Safe Browsing status of link %v: %v", key, err)
+		}
+	}
+
+	if read == SAFE_BROWSING_RECHECK_BATCH_SIZE {
+		next, err := it.Cursor()
+		if err == nil {
+			t := taskqueue.NewPOSTTask(r.URL.Path, url.Values{"cursor": {next.String()}})
+			_, err = taskqueue.Add(c, t, "")
+		}
+		if err != nil {
+			log.Errorf(c, "Failed to queue next Safe Browsing batch: %v", err)
+		}
+	}
+
+	w.Write([]byte(fmt.Sprintf("Rechecked %d of %d links.", len(keys), read)))
+}
+
+// Stores the status of the link at key from a lookup of its targets, unless
+// they've changed since (and were checked by the change).
+func recordSafeBrowsingStatus(c context.Context, key *datastore.Key, targets []string, flagged map[string]string, now time.Time) error {
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		var link Link
+		if err := datastore.Get(tc, key, &link); err != nil {
+			return err
+		}
+		if strings.Join(link.safeBrowsingTargets(), "\n") != strings.Join(targets, "\n") {
+			return nil
+		}
+		status := safeBrowsingStatus(targets, flagged, true)
+		if status != link.SafeBrowsingStatus {
+			link.Version++
+		}
+		link.setSafeBrowsingStatus(status, now)
+		_, err := datastore.Put(tc, key, &link)
+		return err
+	}, nil)
+	if err == nil {
+		uncacheLinks(c, key)
+	}
+	return err
+}
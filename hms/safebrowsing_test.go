@@ -0,0 +1,78 @@
+package hms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSafeBrowsingMatches(t *testing.T) {
+	flagged, err := safeBrowsingMatches([]byte(`{
+		"matches": [{
+			"threatType": "SOCIAL_ENGINEERING",
+			"platformType": "ANY_PLATFORM",
+			"threat": {"url": "http://phish.example/login"},
+			"threatEntryType": "URL"
+		}, {
+			"threatType": "MALWARE",
+			"platformType": "ANY_PLATFORM",
+			"threat": {"url": "http://malware.example/"},
+			"threatEntryType": "URL"
+		}]
+	}`))
+	if err != nil || len(flagged) != 2 || flagged["http://phish.example/login"] != "SOCIAL_ENGINEERING" ||
+		flagged["http://malware.example/"] != "MALWARE" {
+		t.Errorf("Unexpected matches %v, %v", flagged, err)
+	}
+
+	// Safe Browsing answers with an empty object when nothing matches.
+	if flagged, err = safeBrowsingMatches([]byte(`{}`)); err != nil || len(flagged) != 0 {
+		t.Errorf("Expected no match, got %v, %v", flagged, err)
+	}
+
+	if _, err = safeBrowsingMatches([]byte(`<html>`)); err == nil {
+		t.Errorf("Expected a non-JSON response to be an error")
+	}
+}
+
+func TestNewSafeBrowsingRequest(t *testing.T) {
+	req := newSafeBrowsingRequest([]string{"http://a.example/", "http://b.example/"})
+	entries := req.ThreatInfo.ThreatEntries
+	if len(entries) != 2 || entries[0].URL != "http://a.example/" || entries[1].URL != "http://b.example/" {
+		t.Errorf("Unexpected threat entries %v", entries)
+	}
+}
+
+func TestSafeBrowsingStatus(t *testing.T) {
+	targets := []string{"http://a.example/", "http://b.example/"}
+	if status := safeBrowsingStatus(targets, nil, false); status != SAFE_BROWSING_UNKNOWN {
+		t.Errorf("Expected a skipped lookup to be unknown but got %q", status)
+	}
+	if status := safeBrowsingStatus(targets, map[string]string{"http://c.example/": "MALWARE"}, true); status != SAFE_BROWSING_PASSED {
+		t.Errorf("Expected unflagged targets to pass but got %q", status)
+	}
+	if status := safeBrowsingStatus(targets, map[string]string{"http://b.example/": "MALWARE"}, true); status != SAFE_BROWSING_FLAGGED {
+		t.Errorf("Expected a flagged fallback to flag the link but got %q", status)
+	}
+}
+
+func TestSafeBrowsingRecheckDue(t *testing.T) {
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	var link Link
+	if !link.safeBrowsingRecheckDue(now) {
+		t.Errorf("Expected a never-checked link to be due")
+	}
+
+	link.setSafeBrowsingStatus(SAFE_BROWSING_PASSED, now.Add(-time.Hour))
+	if link.safeBrowsingRecheckDue(now) {
+		t.Errorf("Expected a link checked an hour ago not to be due")
+	}
+	if !link.safeBrowsingRecheckDue(now.Add(SAFE_BROWSING_RECHECK_AFTER)) {
+		t.Errorf("Expected a link to be due %v after its check", SAFE_BROWSING_RECHECK_AFTER)
+	}
+
+	// Failed lookups leave the last check standing.
+	link.setSafeBrowsingStatus(SAFE_BROWSING_UNKNOWN, now)
+	if !link.SafeBrowsingCheckedAt.Equal(now.Add(-time.Hour)) {
+		t.Errorf("Expected an unknown status to keep CheckedAt but got %v", link.SafeBrowsingCheckedAt)
+	}
+}
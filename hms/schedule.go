@@ -0,0 +1,112 @@
+package hms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Describes when a link is allowed to redirect. A link with no schedule is
+// always active.
+//
+// Serialized as JSON on the Link, e.g.
+//
+//	{"timezone": "America/Los_Angeles",
+//	 "windows": [{"days": ["mon", "tue"], "start": "09:00", "end": "17:00"}]}
+type Schedule struct {
+	Timezone string           `json:"timezone"`
+	Windows  []ScheduleWindow `json:"windows"`
+
+	location *time.Location
+}
+
+// A single range of time during which the link is active. An empty Days
+// means every day.
+type ScheduleWindow struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+
+	days       map[time.Weekday]bool
+	start, end int
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Parses and validates a serialized schedule.
+func parseSchedule(s string) (*Schedule, error) {
+	var sched Schedule
+	if err := json.Unmarshal([]byte(s), &sched); err != nil {
+		return nil, fmt.Errorf("Invalid schedule: %v", err)
+	}
+
+	if len(sched.Windows) == 0 {
+		return nil, errors.New("Invalid schedule: at least one window is required")
+	}
+
+	var err error
+	if sched.Timezone == "" {
+		sched.location = time.UTC
+	} else if sched.location, err = time.LoadLocation(sched.Timezone); err != nil {
+		return nil, fmt.Errorf("Invalid schedule timezone %q", sched.Timezone)
+	}
+
+	for i := range sched.Windows {
+		win := &sched.Windows[i]
+		win.days = make(map[time.Weekday]bool)
+		for _, d := range win.Days {
+			day, ok := weekdayNames[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("Invalid schedule day %q", d)
+			}
+			win.days[day] = true
+		}
+
+		if win.start, err = parseClock(win.Start); err != nil {
+			return nil, err
+		}
+		if win.end, err = parseClock(win.End); err != nil {
+			return nil, err
+		}
+		if win.start >= win.end {
+			return nil, fmt.Errorf("Invalid schedule window: %s is not before %s", win.Start, win.End)
+		}
+	}
+
+	return &sched, nil
+}
+
+// Parses "HH:MM" into minutes since midnight. "24:00" is allowed as an end.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("Invalid schedule time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// Returns whether t falls into any of the schedule's windows.
+func (s *Schedule) IsActive(t time.Time) bool {
+	local := t.In(s.location)
+	minute := local.Hour()*60 + local.Minute()
+
+	for _, win := range s.Windows {
+		if len(win.days) != 0 && !win.days[local.Weekday()] {
+			continue
+		}
+		if win.start <= minute && minute < win.end {
+			return true
+		}
+	}
+	return false
+}
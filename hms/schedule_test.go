@@ -0,0 +1,49 @@
+package hms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleIsActive(t *testing.T) {
+	sched, err := parseSchedule(`{"timezone": "America/New_York",
+		"windows": [{"days": ["mon", "Tue"], "start": "09:00", "end": "17:30"}]}`)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing schedule: %v", err)
+	}
+
+	ny, _ := time.LoadLocation("America/New_York")
+	cases := map[time.Time]bool{
+		time.Date(2015, 11, 2, 9, 0, 0, 0, ny):        true,  // Monday, opening
+		time.Date(2015, 11, 3, 17, 29, 0, 0, ny):      true,  // Tuesday, just before close
+		time.Date(2015, 11, 3, 17, 30, 0, 0, ny):      false, // Tuesday, closed
+		time.Date(2015, 11, 4, 12, 0, 0, 0, ny):       false, // Wednesday
+		time.Date(2015, 11, 2, 14, 0, 0, 0, time.UTC): true,  // 9am in New York
+		time.Date(2015, 11, 2, 13, 0, 0, 0, time.UTC): false, // 8am in New York
+	}
+
+	for when, expected := range cases {
+		if sched.IsActive(when) != expected {
+			t.Errorf("For %v, expected active=%v", when, expected)
+		}
+	}
+}
+
+func TestParseScheduleRejectsInvalid(t *testing.T) {
+	invalid := []string{
+		``,
+		`{}`,
+		`{"windows": []}`,
+		`{"timezone": "Nowhere/Special", "windows": [{"start": "09:00", "end": "17:00"}]}`,
+		`{"windows": [{"days": ["funday"], "start": "09:00", "end": "17:00"}]}`,
+		`{"windows": [{"start": "9am", "end": "17:00"}]}`,
+		`{"windows": [{"start": "17:00", "end": "09:00"}]}`,
+		`{"windows": [{"start": "09:00", "end": "25:00"}]}`,
+	}
+
+	for _, s := range invalid {
+		if _, err := parseSchedule(s); err == nil {
+			t.Errorf("Expected an error for schedule %s", s)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package hms
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What an API key may be allowed to do. Each API route needs one.
+const (
+	SCOPE_READ   = "read"
+	SCOPE_CREATE = "create"
+	SCOPE_UPDATE = "update"
+	SCOPE_DELETE = "delete"
+)
+
+var allScopes = []string{SCOPE_READ, SCOPE_CREATE, SCOPE_UPDATE, SCOPE_DELETE}
+
+// The scope each route in apiRoutes needs. /api/batch needs none itself,
+// since each of its ops is checked against its own route.
+var apiRouteScopes = map[string]string{
+	"/api/add":         SCOPE_CREATE,
+	"/api/resolve":     SCOPE_READ,
+	"/api/list":        SCOPE_READ,
+	"/api/links":       SCOPE_READ,
+	"/api/search":      SCOPE_READ,
+	"/api/link":        SCOPE_CREATE,
+	"/api/remove":      SCOPE_DELETE,
+	"/api/share":       SCOPE_UPDATE,
+	"/api/getorcreate": SCOPE_CREATE,
+	"/api/schedule":    SCOPE_CREATE,
+	"/api/batch":       "",
+	"/api/export":      SCOPE_READ,
+	"/api/alias":       SCOPE_CREATE,
+	"/api/card":        SCOPE_READ,
+
+	"/api/links/expiry": SCOPE_UPDATE,
+
+	"/api/domains/register": SCOPE_CREATE,
+	"/api/domains/verify":   SCOPE_CREATE,
+}
+
+// Returns the scope a request for path with method needs. Paths without a
+// known scope need every scope, so routes added without one fail closed.
+func requiredScope(path string, method string) string {
+	if strings.HasPrefix(path, "/api/link/") {
+		switch method {
+		case "PUT":
+			return SCOPE_UPDATE
+		case "DELETE":
+			return SCOPE_DELETE
+		}
+		return SCOPE_READ
+	}
+	if scope, ok := apiRouteScopes[path]; ok {
+		return scope
+	}
+	return "*"
+}
+
+// Parses the comma-separated `scopes` of a new API key. Empty means every
+// scope, which is stored as no scopes.
+func parseScopes(s string) ([]string, error) {
+	scopes := make([]string, 0)
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !isKnownScope(scope) {
+			return nil, fmt.Errorf("Unknown scope %q; scopes are %s", scope, strings.Join(allScopes, ", "))
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, nil
+	}
+	return scopes, nil
+}
+
+func isKnownScope(scope string) bool {
+	for _, known := range allScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the key may make requests needing scope. Keys without
+// scopes, including every key made before scopes existed, may do anything.
+func (k *APIKey) hasScope(scope string) bool {
+	if len(k.Scopes) == 0 || scope == "" {
+		return true
+	}
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the 403 for a request to path the key isn't scoped for, or nil.
+func checkScope(k *APIKey, path string, method string) *appError {
+	scope := requiredScope(path, method)
+	if k.hasScope(scope) {
+		return nil
+	}
+	if scope == "*" {
+		return &appError{nil, "This API key isn't allowed to do that.", 403}
+	}
+	return &appError{nil, fmt.Sprintf("This API key doesn't have the %q scope.", scope), 403}
+}
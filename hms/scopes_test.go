@@ -0,0 +1,67 @@
+package hms
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadOnlyKeyScopes(t *testing.T) {
+	readOnly := APIKey{Scopes: []string{SCOPE_READ}}
+	allowed := [][2]string{
+		{"/api/list", "GET"},
+		{"/api/resolve", "GET"},
+		{"/api/links", "GET"},
+		{"/api/batch", "POST"},
+	}
+	refused := [][2]string{
+		{"/api/add", "POST"},
+		{"/api/link", "POST"},
+		{"/api/remove", "DELETE"},
+		{"/api/link/docs", "DELETE"},
+		{"/api/link/docs", "PUT"},
+		{"/api/new-route", "GET"},
+	}
+	for _, req := range allowed {
+		if e := checkScope(&readOnly, req[0], req[1]); e != nil {
+			t.Errorf("Expected a read-only key to be allowed %s %s, got %v", req[1], req[0], e.Message)
+		}
+	}
+	for _, req := range refused {
+		if e := checkScope(&readOnly, req[0], req[1]); e == nil || e.Code != 403 {
+			t.Errorf("Expected a read-only key to be refused %s %s", req[1], req[0])
+		}
+	}
+
+	// Keys from before scopes may do anything.
+	legacy := APIKey{}
+	for _, req := range append(allowed, refused...) {
+		if e := checkScope(&legacy, req[0], req[1]); e != nil {
+			t.Errorf("Expected an unscoped key to be allowed %s %s", req[1], req[0])
+		}
+	}
+}
+
+func TestEveryRouteHasAScope(t *testing.T) {
+	for path := range apiRoutes {
+		if _, ok := apiRouteScopes[path]; !ok {
+			t.Errorf("%s has no scope in apiRouteScopes", path)
+		}
+	}
+	for name, route := range batchRoutes {
+		if requiredScope(route.path, route.method) == "" {
+			t.Errorf("Batch op %s needs no scope", name)
+		}
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	if scopes, err := parseScopes(" read, delete "); err != nil || !reflect.DeepEqual(scopes, []string{"read", "delete"}) {
+		t.Errorf("Unexpected scopes %v, %v", scopes, err)
+	}
+	if scopes, err := parseScopes(""); err != nil || scopes != nil {
+		t.Errorf("Expected no scopes to mean all of them, got %v, %v", scopes, err)
+	}
+	if _, err := parseScopes("read,admin"); err == nil {
+		t.Errorf("Expected an unknown scope to be refused")
+	}
+}
@@ -0,0 +1,101 @@
+package hms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Most links a single /api/search request looks at. Searches that match
+// rarely can end a page early; the cursor picks up where they stopped.
+const SEARCH_MAX_SCAN = 1000
+
+type SearchResponse struct {
+	Success bool
+	Links   []Link
+	// Pass back as `cursor` for the next page. Empty once every link has
+	// been searched.
+	Cursor string
+}
+
+// Returns whether the link's path or target contains q, ignoring case. q must
+// already be lowercase.
+func linkMatchesSearch(link *Link, q string) bool {
+	return strings.Contains(strings.ToLower(link.Path), q) ||
+		strings.Contains(strings.ToLower(link.TargetURL), q)
+}
+
+// Finds links by `creator` (exactly) and/or `q`, a substring of the path or
+// target, newest first and up to `limit` a page. The datastore can only do
+// the creator filter, so q is checked here, over at most SEARCH_MAX_SCAN
+// links a request.
+func handleSearch(c context.Context, w http.ResponseWriter, r *http.Request, apiKey APIKey) *appError {
+	if r.Method != "GET" {
+		return &appError{nil, fmt.Sprintf("Invalid request method: %s", r.Method), 401}
+	}
+
+	creator := r.FormValue("creator")
+	q := strings.ToLower(strings.TrimSpace(r.FormValue("q")))
+	if creator == "" && q == "" {
+		return &appError{nil, "At least one of `creator` and `q` is required.", 400}
+	}
+
+	limit := API_BATCH_AMT
+	if sLimit := r.FormValue("limit"); sLimit != "" {
+		n, err := strconv.Atoi(sLimit)
+		if err != nil || n <= 0 {
+			return &appError{err, "Bad limit.", 400}
+		} else if n < limit {
+			limit = n
+		}
+	}
+
+	query := datastore.NewQuery("Link")
+	if creator != "" {
+		query = query.Filter("Creator =", creator)
+	}
+	query = query.Order("-Created")
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return &appError{err, "Bad cursor.", 400}
+		}
+		query = query.Start(decoded)
+	}
+
+	resp := SearchResponse{Success: true, Links: make([]Link, 0)}
+	it := query.Run(c)
+	done := false
+	for scanned := 0; scanned < SEARCH_MAX_SCAN && len(resp.Links) < limit; scanned++ {
+		var link Link
+		_, err := it.Next(&link)
+		if err == datastore.Done {
+			done = true
+			break
+		} else if err != nil {
+			return &appError{err, "Datastore error: " + err.Error(), 500}
+		}
+		if q == "" || linkMatchesSearch(&link, q) {
+			resp.Links = append(resp.Links, link)
+		}
+	}
+
+	if !done {
+		next, err := it.Cursor()
+		if err != nil {
+			return &appError{err, "Datastore error: " + err.Error(), 500}
+		}
+		resp.Cursor = next.String()
+	}
+
+	setPaginationLinks(w, r, resp.Cursor)
+	respJSON, _ := json.Marshal(&resp)
+	w.Write(respJSON)
+	return nil
+}
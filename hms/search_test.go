@@ -0,0 +1,18 @@
+package hms
+
+import "testing"
+
+func TestLinkMatchesSearch(t *testing.T) {
+	link := Link{Path: "standup", TargetURL: "https://meet.example.com/Team-Sync"}
+
+	for _, q := range []string{"stand", "up", "meet.example", "team-sync", "https://"} {
+		if !linkMatchesSearch(&link, q) {
+			t.Errorf("Expected %q to match", q)
+		}
+	}
+	for _, q := range []string{"standups", "zoom", "team sync"} {
+		if linkMatchesSearch(&link, q) {
+			t.Errorf("Expected %q not to match", q)
+		}
+	}
+}
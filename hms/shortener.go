@@ -1,11 +1,11 @@
 package hms
 
 import (
-	"encoding/json"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -18,10 +18,11 @@ import (
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 	"google.golang.org/appengine/user"
 )
 
+const MAX_REDIRECT_BUDGET_MS = 10000
+
 type routeHandler func(http.ResponseWriter, *http.Request, []string) *appError
 
 var (
@@ -35,52 +36,285 @@ type IndexTemplateParams struct {
 	CreatedURL string
 	Host       string
 	PastLinks  []Link
+	// Existing paths similar to a requested path that doesn't exist.
+	Suggestions []string
+	// Sent back with the form; see checkCSRFToken.
+	CSRFToken string
+	// config.BasePath, for building links.
+	BasePath string
+	// See CreationResult.
+	Warnings []string
+	// How many links the logged-in user has made, or -1 if unknown.
+	CreatorLinkCount int64
+	// The listing's search, and the cursor of its next page (empty on the
+	// last page).
+	Query      string
+	NextCursor string
+	// The cursor of the page being shown, passed on as the next page's
+	// prevCursor (see paginationLinkHeader).
+	Cursor string
+	// The cursor of the previous page, if HasPrev. There's none on the
+	// first page, or when the page wasn't reached through a next link.
+	PrevCursor string
+	HasPrev    bool
+	// Whether there are more links after this page.
+	HasNext bool
+}
+
+// Templates that can replace the index page as the response to a successful
+// creation, for when the form is embedded in other sites.
+var createdTemplates = map[string]*template.Template{
+	"embed": template.Must(getTemplate("created_embed.html")),
+}
+
+// Picks the template for a successful creation from createdTemplates, based
+// on the `embed` form value (a template name, or "1" for "embed") or on the
+// referrer being one of config.EmbedReferrers. Returns nil to use the index.
+func selectCreatedTemplate(r *http.Request) *template.Template {
+	name := r.FormValue("embed")
+	if name == "1" {
+		name = "embed"
+	}
+
+	if name == "" && isEmbedReferrer(r) {
+		name = "embed"
+	}
+
+	if name == "" {
+		return nil
+	}
+	tmpl, ok := createdTemplates[name]
+	if !ok {
+		c := appengine.NewContext(r)
+		log.Warningf(c, "No creation template named %q; using the index", name)
+		return nil
+	}
+	return tmpl
+}
+
+// Returns whether the request came from a page on one of
+// config.EmbedReferrers.
+func isEmbedReferrer(r *http.Request) bool {
+	referrer, err := url.Parse(r.Referer())
+	if err != nil || referrer.Host == "" {
+		return false
+	}
+	for _, host := range config.EmbedReferrers {
+		if strings.EqualFold(referrer.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fields of Link used by the index template's listing. ClickCount isn't
+// projected: a projection only sees entities storing every field it names,
+// and links stored before clicks were counted don't have one until they're
+// migrated. getIndexListing fetches it separately.
+var indexListingFields = []string{"Path", "TargetURL", "Created", "Creator"}
+
+const INDEX_PAGE_SIZE = 100
+
+// Returns a page of the index listing, starting at cursor (if given), and the
+// cursor of the next page. An empty query lists the most recent links; any
+// other lists links whose path starts with it, in path order. Only the
+// fields the listing shows are fetched, which needs the composite indexes in
+// index.yaml, plus the page's click counts.
+func getIndexListing(c context.Context, query string, cursor string) ([]Link, string, error) {
+	q := datastore.NewQuery("Link").Project(indexListingFields...)
+	if query == "" {
+		q = q.Order("-Created")
+	} else {
+		q = q.Filter("Path >=", query).Filter("Path <", query+"\ufffd").Order("Path")
+	}
+	if cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(decoded)
+	}
+
+	links := make([]Link, 0, INDEX_PAGE_SIZE)
+	keys := make([]*datastore.Key, 0, INDEX_PAGE_SIZE)
+	it := q.Limit(INDEX_PAGE_SIZE).Run(c)
+	for {
+		var link Link
+		key, err := it.Next(&link)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		links = append(links, link)
+		keys = append(keys, key)
+	}
+	if err := fillListingDetails(c, keys, links); err != nil {
+		return nil, "", err
+	}
+
+	if len(links) < INDEX_PAGE_SIZE {
+		return links, "", nil
+	}
+	next, err := it.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return links, next.String(), nil
+}
+
+// Copies the fields the listing shows but doesn't project (ClickCount and
+// SafeBrowsingStatus) from the entity at each link's key. Links deleted since
+// they were listed are left without them.
+func fillListingDetails(c context.Context, keys []*datastore.Key, links []Link) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	full := make([]Link, len(keys))
+	err := datastore.GetMulti(c, keys, full)
+	errs, _ := err.(appengine.MultiError)
+	if err != nil && errs == nil {
+		return err
+	}
+	for i := range links {
+		if errs != nil && errs[i] != nil {
+			if errs[i] != datastore.ErrNoSuchEntity {
+				return errs[i]
+			}
+			continue
+		}
+		links[i].ClickCount = full[i].ClickCount
+		links[i].SafeBrowsingStatus = full[i].SafeBrowsingStatus
+	}
+	return nil
 }
 
-var shortenerRoutes = map[*regexp.Regexp]routeHandler{
-	regexp.MustCompile("/([yA-Z0-9-]+)[/]?$"): handleAutoShortURL,
-	regexp.MustCompile("/([a-z].*)$"):         handleManualShortURL,
-	regexp.MustCompile("/$"):                  handleChatIndex,
+// Auto-encoded codes and manual paths overlap: a path like "yD" is valid as
+// either. Such paths are looked up both ways, in the order set by
+// config.AmbiguousPaths.
+const (
+	AMBIGUOUS_PREFER_AUTO   = "auto"
+	AMBIGUOUS_PREFER_MANUAL = "manual"
+)
+
+var (
+	autoCodeRegex   = regexp.MustCompile("/([yA-Z0-9-]+)[/]?$")
+	manualPathRegex = regexp.MustCompile("/([a-z].*)$")
+	// Manual paths typed with different capitalization, like /MyLink for
+	// /mylink. Tried after autoCodeRegex, so codes still win.
+	mixedCasePathRegex = regexp.MustCompile("/([A-Za-z].*)$")
+	chatIndexRegex     = regexp.MustCompile("/$")
+	qrCodeRegex        = regexp.MustCompile("^/qr/([^/]+)$")
+)
+
+type shortenerRoute struct {
+	Name    string
+	Regex   *regexp.Regexp
+	Handler routeHandler
+}
+
+// Returns the routes in the order they're tried, which decides how an
+// ambiguous path is looked up first.
+func shortenerRoutes(preference string) []shortenerRoute {
+	auto := shortenerRoute{"auto", autoCodeRegex, handleAutoShortURL}
+	manual := shortenerRoute{"manual", manualPathRegex, handleManualShortURL}
+	mixedCase := shortenerRoute{"manual", mixedCasePathRegex, handleManualShortURL}
+	index := shortenerRoute{"index", chatIndexRegex, handleChatIndex}
+	// Paths can't contain slashes, so this never hides a link.
+	qr := shortenerRoute{"qr", qrCodeRegex, handleQRCode}
+	if preference == AMBIGUOUS_PREFER_MANUAL {
+		return []shortenerRoute{qr, manual, auto, mixedCase, index}
+	}
+	return []shortenerRoute{qr, auto, manual, mixedCase, index}
+}
+
+// Returns the first route matching reqPath and its captured parameters.
+func matchShortenerRoute(reqPath string, preference string) (*shortenerRoute, []string) {
+	for _, route := range shortenerRoutes(preference) {
+		urlComponents := route.Regex.FindStringSubmatch(reqPath)
+		if urlComponents != nil {
+			return &route, urlComponents[1:]
+		}
+	}
+	return nil, nil
 }
 
 // Base handler for all requests handled by the URL shortenening/archiving code.
 func ShortenerHandler(w http.ResponseWriter, r *http.Request) *appError {
 	reqPath := r.URL.Path
-
-	for routeRegex, handler := range shortenerRoutes {
-		urlComponents := routeRegex.FindStringSubmatch(reqPath)
-		if urlComponents != nil {
-			return handler(w, r, urlComponents[1:])
+	if config.BasePath != "" {
+		if !strings.HasPrefix(reqPath, config.BasePath+"/") {
+			return &appError{nil, "Invalid URL", 404}
 		}
+		reqPath = strings.TrimPrefix(reqPath, config.BasePath)
+	}
+
+	if !isHostAllowed(appengine.NewContext(r), r.Host) {
+		return &appError{nil, "This domain hasn't been verified yet.", 404}
+	}
+
+	if route, params := matchShortenerRoute(reqPath, config.AmbiguousPaths); route != nil {
+		return route.Handler(w, r, params)
 	}
 
 	return &appError{nil, "Invalid URL", 404}
 }
 
 func handleChatIndex(w http.ResponseWriter, r *http.Request, params []string) *appError {
-	if _, ok := handleUserAuth(w, r); !ok {
+	u, ok := handleUserAuth(w, r)
+	if !ok {
 		return &appError{nil, "Unauthorized.", 403}
 	}
 
 	c := appengine.NewContext(r)
 
+	var userID string
+	if u != nil {
+		userID = u.ID
+	}
+
 	var resultURL string
 	var message string
+	var warnings []string
 	if r.Method == "POST" {
+		// Embedding sites can't get a token from us, so the ones listed in
+		// config.EmbedReferrers are trusted instead.
+		if !isEmbedReferrer(r) {
+			valid, err := checkCSRFToken(c, r.PostFormValue(CSRF_FIELD), userID)
+			if err != nil {
+				return &appError{err, err.Error(), http.StatusInternalServerError}
+			} else if !valid {
+				return &appError{nil, "This form has expired. Reload the page and try again.", 403}
+			}
+		}
+
 		if r.FormValue("path") != "" && !IsLowercase(r.FormValue("path")[0]) {
 			message = "Custom paths must begin with a lowercase letter."
 		} else {
-			resultPath, err := createShortenedURL(r, -1)
-			if err != nil {
+			result, err := createShortenedURL(c, r, NoChat, nil)
+			if _, ok := err.(*pathTakenError); ok {
+				return &appError{err, err.Error(), http.StatusConflict}
+			} else if err != nil {
 				return &appError{err, err.Error(), http.StatusInternalServerError}
 			}
 
-			resultURL = fmt.Sprintf("http://%s/%s", r.Host, resultPath)
+			resultURL = result.ShortURL
+			warnings = result.Warnings
+
+			if tmpl := selectCreatedTemplate(r); tmpl != nil {
+				tmpl.Execute(w, IndexTemplateParams{
+					Host:       linkHost(r),
+					CreatedURL: resultURL,
+					Warnings:   warnings,
+				})
+				return nil
+			}
 		}
 	}
 
-	pastLinks := make([]Link, 0, 100)
-	_, err := datastore.NewQuery("Link").Order("-Created").Limit(100).GetAll(c, &pastLinks)
+	query := strings.TrimSpace(r.FormValue("q"))
+	cursor := r.FormValue("cursor")
+	pastLinks, nextCursor, err := getIndexListing(c, query, cursor)
 	if err != nil {
 		return &appError{err, err.Error(), http.StatusInternalServerError}
 	}
@@ -88,27 +322,65 @@ func handleChatIndex(w http.ResponseWriter, r *http.Request, params []string) *a
 	path := r.FormValue("path")
 	chatID := r.FormValue("chatID")
 
+	var suggestions []string
 	if message == "" && path != "" && r.Method == "GET" {
 		_, err = getMatchingLinkChatString(c, chatID, path)
 		if err != nil {
 			message = "/" + path + " does not exist. Create it?"
+
+			if config.SuggestSimilarPaths {
+				suggestions, err = suggestSimilarPaths(c, chatID, path)
+				if err != nil {
+					log.Errorf(c, "Failed to find similar paths for %v: %v", path, err)
+				}
+			}
 		}
 	}
 
+	var creatorLinkCount int64 = -1
+	if u != nil {
+		if creatorLinkCount, err = getCreatorLinkCount(c, u.Email); err != nil {
+			log.Errorf(c, "Failed to get link count for %v: %v", u.Email, err)
+			creatorLinkCount = -1
+		}
+	}
+
+	csrfToken, err := newCSRFToken(c, userID)
+	if err != nil {
+		return &appError{err, err.Error(), http.StatusInternalServerError}
+	}
+	prevCursor, hasPrev := prevPageCursor(r.Form)
+
 	indexTmpl.Execute(w, IndexTemplateParams{
-		Path:       path,
-		TargetURL:  r.FormValue("target"),
-		Host:       r.Host,
-		PastLinks:  pastLinks,
-		CreatedURL: resultURL,
-		Message:    message,
+		CSRFToken:   csrfToken,
+		BasePath:    config.BasePath,
+		Path:        path,
+		TargetURL:   r.FormValue("target"),
+		Host:        linkHost(r),
+		PastLinks:   pastLinks,
+		CreatedURL:  resultURL,
+		Warnings:    warnings,
+		Message:     message,
+		Suggestions: suggestions,
+
+		CreatorLinkCount: creatorLinkCount,
+		Query:            query,
+		NextCursor:       nextCursor,
+		Cursor:           cursor,
+		PrevCursor:       prevCursor,
+		HasPrev:          hasPrev,
+		HasNext:          nextCursor != "",
 	})
 	return nil
 }
 
 func handleAutoShortURL(w http.ResponseWriter, r *http.Request, params []string) *appError {
-	if _, ok := handleUserAuth(w, r); !ok {
-		return &appError{nil, "Unauthorized.", 403}
+	// With anonymous redirects, serveLinkRedirect checks once it knows
+	// whether the link needs it.
+	if !config.AnonymousRedirects {
+		if _, ok := handleUserAuth(w, r); !ok {
+			return &appError{nil, "Unauthorized.", 403}
+		}
 	}
 
 	urlPath := strings.TrimSpace(params[0])
@@ -122,164 +394,735 @@ func handleAutoShortURL(w http.ResponseWriter, r *http.Request, params []string)
 
 	log.Infof(c, "%d", key.IntID())
 
-	var link Link
-	err := datastore.Get(c, key, &link)
+	link, err := getRedirectLink(c, key)
 	if err == datastore.ErrNoSuchEntity {
-		return &appError{err, "Invalid short url.", 404}
+		if manual := autoCodeMissRoute(urlPath, config.AmbiguousPaths); manual != nil {
+			return handleManualShortURL(w, r, manual)
+		}
+		// Manual paths typed in capitals, like /MYLINK, look like codes.
+		// Looked up here rather than by handleManualShortURL, which would
+		// hand them straight back.
+		if key, link, err := getRedirectLinkByPath(c, r.FormValue("chatID"), urlPath); err == nil {
+			return serveLinkRedirect(w, r, key, link)
+		}
+		return linkNotFound(c, r.FormValue("chatID"), urlPath)
 	} else if err != nil {
 		return &appError{err, err.Error(), 500}
 	}
 
-	http.Redirect(w, r, link.TargetURL, http.StatusFound)
+	return serveLinkRedirect(w, r, key, link)
+}
+
+// Returns the manual route's params for a code with no link, if it should be
+// looked up as a manual path by handleManualShortURL: when that route hasn't
+// been tried yet and matches. Otherwise nil, and it's looked up as a path
+// directly.
+func autoCodeMissRoute(urlPath string, preference string) []string {
+	if preference == AMBIGUOUS_PREFER_MANUAL {
+		return nil
+	}
+	if manual := manualPathRegex.FindStringSubmatch("/" + urlPath); manual != nil {
+		return manual[1:]
+	}
 	return nil
 }
 
 func handleManualShortURL(w http.ResponseWriter, r *http.Request, params []string) *appError {
-	if _, ok := handleUserAuth(w, r); !ok {
-		return &appError{nil, "Unauthorized.", 403}
+	if !config.AnonymousRedirects {
+		if _, ok := handleUserAuth(w, r); !ok {
+			return &appError{nil, "Unauthorized.", 403}
+		}
 	}
 
 	urlPath := params[0]
 	strChatID := r.FormValue("chatID")
 
 	c := appengine.NewContext(r)
-	target, err := getMatchingLinkChatString(c, strChatID, urlPath)
+	key, target, err := getRedirectLinkByPath(c, strChatID, urlPath)
 	if err != nil {
 		if _, ok := err.(*strconv.NumError); ok {
 			return &appError{nil, "Invalid FB chat ID", 401}
+		} else if config.AmbiguousPaths == AMBIGUOUS_PREFER_MANUAL {
+			if auto := autoCodeRegex.FindStringSubmatch("/" + urlPath); auto != nil {
+				return handleAutoShortURL(w, r, auto[1:])
+			}
+		}
+		// Codes typed in the wrong case, like /yd for /yD, come here
+		// since they don't match autoCodeRegex.
+		if config.CaseInsensitiveCodes {
+			if key, link := getAutoLinkByPath(c, urlPath); key != nil {
+				return serveLinkRedirect(w, r, key, link)
+			}
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s/?path=%s&chatID=%s", config.BasePath, urlPath, strChatID), http.StatusFound)
+		return nil
+	}
+
+	return serveLinkRedirect(w, r, key, target)
+}
+
+// Redirects to the link once it's been looked up, by either kind of path.
+func serveLinkRedirect(w http.ResponseWriter, r *http.Request, key *datastore.Key, link *Link) *appError {
+	started := time.Now()
+	c := appengine.NewContext(r)
+	if link.AliasOf != nil {
+		// Clicks on an alias count towards the original.
+		key = link.AliasOf
+	}
+	link, err := resolveAlias(c, link)
+	if err == datastore.ErrNoSuchEntity {
+		return &appError{err, "This link points to a link that no longer exists.", 404}
+	} else if err != nil {
+		return &appError{err, err.Error(), 500}
+	}
+
+	if config.AnonymousRedirects && link.requiresAuth() {
+		u, ok := handleUserAuth(w, r)
+		if !ok {
+			return &appError{nil, "Unauthorized.", 403}
+		} else if u == nil {
+			// Sent to the login page.
+			return nil
+		}
+	}
+
+	link.setFrameHeaders(w)
+
+	if link.IsExpiredAt(time.Now()) {
+		return &appError{nil, "This link has expired and doesn't go anywhere anymore.", http.StatusGone}
+	}
+	if !link.IsActiveAt(time.Now()) {
+		return &appError{nil, "This link is closed right now. Try again later.", 503}
+	}
+
+	target := link.RedirectURLWithin(config.RedirectBudget, time.Since(started))
+	if link.Templated {
+		target = expandTargetTemplate(target, r)
+	}
+	usingFallback := false
+	if len(link.FallbackTargets) > 0 && !isHealthyStatus(link.LastHealthStatus) {
+		fallback, ok := link.healthyFallback()
+		if !ok {
+			return &appError{nil, "This link and all of its fallbacks are down right now.", 502}
+		}
+		target, usingFallback = fallback, true
+	}
+	if config.RecheckSchemes {
+		if err := checkRedirectScheme(config.SchemePolicy, target); err != nil {
+			return &appError{err, "This link is unavailable: its target isn't allowed here anymore.", 403}
+		}
+	}
+
+	// Credentials are only ever sent to the target they were given for.
+	if len(link.AuthCredentials) > 0 && config.BasicAuthLinks && !usingFallback {
+		username, password, err := link.credentials()
+		if err != nil {
+			return &appError{err, "Couldn't read this link's credentials.", 500}
+		}
+		if link.AuthMode == AUTH_MODE_URL {
+			if target, err = injectCredentials(target, username, password); err != nil {
+				return &appError{err, err.Error(), 500}
+			}
 		} else {
-			http.Redirect(w, r, fmt.Sprintf("/?path=%s&chatID=%s", urlPath, strChatID), http.StatusFound)
+			if appErr := proxyWithCredentials(c, w, r, target, username, password); appErr != nil {
+				return appErr
+			}
+			queueClick(c, r, key, link)
 			return nil
 		}
 	}
 
-	http.Redirect(w, r, target.TargetURL, http.StatusFound)
+	status := link.RedirectStatus()
+	if usingFallback {
+		// The fallback is only for while the target is down.
+		temporary := *link
+		temporary.Permanent = false
+		link = &temporary
+		status = link.RedirectStatus()
+	}
+	// Anyone can ask for the interstitial with ?preview=1, to see where a
+	// link goes before going there. Only the link's own interstitial, which
+	// continues by itself, counts as a click.
+	if preview := r.FormValue("preview") == "1"; preview || link.Interstitial {
+		if appErr := renderInterstitial(w, target, !preview, link.TrustBadge(), link.interstitialSnippet(c)); appErr != nil {
+			return appErr
+		}
+		if !preview {
+			queueClick(c, r, key, link)
+		}
+		return nil
+	}
+
+	w.Header().Set("Cache-Control", link.RedirectCacheControl(time.Now()))
+	http.Redirect(w, r, target, status)
+	queueClick(c, r, key, link)
 	return nil
 }
 
-func createShortenedURL(r *http.Request, chatID int64) (string, error) {
-	path := r.FormValue("path")
-	target := r.FormValue("target")
+// What createShortenedURL did with a submission.
+type CreationResult struct {
+	Path     string
+	ShortURL string
+	// Things worth telling the creator that didn't stop the link from being
+	// created, like the target being normalized.
+	Warnings []string
+	// Who the link was attributed to. See creationAudit.
+	Audit *CreationAudit
+}
+
+// Creates a link from the request's form values. apiKey is the key the
+// request was authenticated with, if any.
+func createShortenedURL(c context.Context, r *http.Request, chatID ChatID, apiKey *APIKey) (*CreationResult, error) {
+	return createLink(c, linkRequestFromHTTP(c, r, chatID, apiKey))
+}
+
+// Validates, builds and stores the link req describes. Shared by every way
+// of creating a link.
+func createLink(c context.Context, req linkRequest) (*CreationResult, error) {
+	u, err := newLink(c, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// A requested path is always created, so reuse only applies to
+	// auto-encoded links.
+	if req.Form.Get("reuse") == "true" && req.Form.Get("path") == "" {
+		existing, err := findReusableLink(c, u)
+		if err != nil {
+			return nil, err
+		} else if existing != nil {
+			return &CreationResult{
+				Path:     existing.Path,
+				ShortURL: shortURL(req.Host, existing.Path),
+				Warnings: append(u.warnings, "An existing link to this target was returned instead of creating a new one."),
+			}, nil
+		}
+	}
+
+	if _, err = putNewLink(c, u); err != nil {
+		return nil, err
+	}
+	return &CreationResult{
+		Path:     u.Path,
+		ShortURL: shortURL(req.Host, u.Path),
+		Warnings: u.warnings,
+		Audit:    creationAudit(config.CreatorPrecedence, u),
+	}, nil
+}
+
+// Everything a new link is built from, independent of the HTTP request it
+// arrived in (if any).
+type linkRequest struct {
+	Form   url.Values
+	Host   string
+	ChatID ChatID
+	APIKey *APIKey
+	// The datastore key of the API key the link is created through, if any.
+	APIKeyID *datastore.Key
+	User     *user.User
+	// If set, used as the creator instead of resolving one.
+	Creator string
+	// The address of the client creating the link, for logging.
+	RemoteAddr string
+	// Credentials encrypted by an earlier setCredentials, for links created
+	// without the plaintext ones in Form, like scheduled links.
+	AuthCredentials []byte
+	AuthMode        string
+	// For links created many at a time: Safe Browsing is left to the
+	// caller, which can check every target in one lookup, and music info
+	// is fetched by a task instead of inline.
+	Bulk bool
+}
+
+// Values for config.SchemePolicy.
+const (
+	SCHEME_POLICY_HTTP_HTTPS = "http+https"
+	SCHEME_POLICY_HTTPS_ONLY = "https-only"
+)
+
+// Returns an error if targets with scheme aren't allowed under policy.
+// Unknown policies are treated as SCHEME_POLICY_HTTP_HTTPS.
+func checkTargetScheme(policy string, scheme string) error {
+	if policy == SCHEME_POLICY_HTTPS_ONLY {
+		if scheme != "https" {
+			return errors.New("https links only.")
+		}
+		return nil
+	}
+	if scheme != "http" && scheme != "https" {
+		return errors.New("http[s] links only.")
+	}
+	return nil
+}
+
+// Schemes that run or embed content instead of navigating somewhere, which
+// could turn a stored target into XSS wherever it's rendered as a link. The
+// scheme policy refuses them anyway; they get their own error so the refusal
+// doesn't depend on the policy.
+var dangerousSchemes = map[string]bool{
+	"javascript": true,
+	"vbscript":   true,
+	"data":       true,
+	"blob":       true,
+	"file":       true,
+}
+
+// The Error of the 403 for a link whose target the scheme policy no longer
+// allows. Rendered with errors/link_unavailable.html.
+type linkUnavailableError struct {
+	Scheme string
+}
+
+func (e *linkUnavailableError) Error() string {
+	return fmt.Sprintf("%s targets aren't allowed anymore", e.Scheme)
+}
+
+// Returns an error if target, which a link is about to redirect to, breaks
+// the current scheme policy.
+func checkRedirectScheme(policy string, target string) error {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if dangerousSchemes[parsed.Scheme] || checkTargetScheme(policy, parsed.Scheme) != nil {
+		return &linkUnavailableError{parsed.Scheme}
+	}
+	return nil
+}
+
+// Returns an error if parsed (from parseTarget) can't be a link's target or
+// fallback. host is the host the link is served from, to refuse redirect
+// loops.
+func checkTarget(parsed *url.URL, host string) error {
+	if dangerousSchemes[parsed.Scheme] {
+		return fmt.Errorf("%s: links aren't allowed.", parsed.Scheme)
+	} else if err := checkTargetScheme(config.SchemePolicy, parsed.Scheme); err != nil {
+		return err
+	} else if parsed.Host == "" {
+		return errors.New("The target needs a host.")
+	} else if parsed.Host == host {
+		return errors.New("Don't try to make redirect loops.")
+	}
+	return nil
+}
+
+// Validates target and sets it as the link's TargetURL, normalized. host is
+// the host the link is served from, to refuse redirect loops.
+func (l *Link) setTarget(target string, host string) (*url.URL, error) {
+	l.TargetURL = target
+	parsedUrl, err := l.parseTarget()
+	if err != nil {
+		return nil, err
+	}
+	if err = checkTarget(parsedUrl, host); err != nil {
+		return nil, err
+	}
+
+	if config.StoreOriginalTarget {
+		l.OriginalTarget = target
+	}
+	l.TargetURL = parsedUrl.String()
+	if l.TargetURL != target {
+		l.warnings = append(l.warnings, fmt.Sprintf("The target was normalized to %s.", l.TargetURL))
+	}
+	return parsedUrl, nil
+}
+
+// Returned when creating a link whose path is already used in its chat.
+type pathTakenError struct {
+	Path     string
+	Existing *Link
+}
+
+func (e *pathTakenError) Error() string {
+	return "There already exists a link with that path. "
+}
+
+// Validates the request's form values and builds the link they describe,
+// without storing it.
+func newLinkFromRequest(c context.Context, r *http.Request, chatID ChatID, apiKey *APIKey) (*Link, error) {
+	return newLink(c, linkRequestFromHTTP(c, r, chatID, apiKey))
+}
+
+// Reads the linkRequest for a form submission.
+func linkRequestFromHTTP(c context.Context, r *http.Request, chatID ChatID, apiKey *APIKey) linkRequest {
+	r.ParseForm()
+	req := linkRequest{
+		Form:       r.Form,
+		Host:       linkHost(r),
+		ChatID:     chatID,
+		APIKey:     apiKey,
+		User:       user.Current(c),
+		RemoteAddr: r.RemoteAddr,
+	}
+	if apiKey != nil {
+		req.APIKeyID = apiKey.key
+	}
+	return req
+}
+
+// Validates req and builds the link it describes, without storing it.
+func newLink(c context.Context, req linkRequest) (*Link, error) {
+	chatID := req.ChatID
+	path := req.Form.Get("path")
+	target := req.Form.Get("target")
 
 	if target == "" {
-		return "", errors.New("empty target")
+		return nil, errors.New("empty target")
 	} else {
 		if !isValidPath(path) {
-			return "", errors.New("invalid path")
+			return nil, errors.New("invalid path: paths can't contain slashes or be valid auto-generated codes")
 		}
 
 		u := Link{
-			Path:      path,
-			TargetURL: target,
-			Created:   time.Now(),
+			TargetURL:     target,
+			Created:       time.Now(),
+			SchemaVersion: LINK_SCHEMA_VERSION,
+			Version:       1,
+		}
+		u.setPath(path)
+
+		if expires := req.Form.Get("expires"); expires != "" {
+			expiresAt, err := parseExpiry(expires, u.Created)
+			if err != nil {
+				return nil, err
+			}
+			u.ExpiresAt = expiresAt
+		}
+
+		if schedule := req.Form.Get("schedule"); schedule != "" {
+			if _, err := parseSchedule(schedule); err != nil {
+				return nil, err
+			}
+			u.Schedule = schedule
+		}
+
+		if params := req.Form.Get("params"); params != "" {
+			if _, err := parseQueryParams(params); err != nil {
+				return nil, err
+			}
+			u.QueryParams = params
+			u.OverrideParams = req.Form.Get("overrideParams") == "true"
+		}
+
+		u.PreserveMethod = req.Form.Get("preserveMethod") == "true"
+		u.Permanent = req.Form.Get("permanent") == "true"
+		u.Private = req.Form.Get("private") == "true"
+		u.AllowAnonymous = req.Form.Get("allowAnonymous") == "true"
+		u.Interstitial = req.Form.Get("interstitial") == "true"
+
+		if snippet := req.Form.Get("interstitialSnippet"); snippet != "" {
+			parsed, err := parseSnippet(snippet, config.AllowSnippetScripts)
+			if err != nil {
+				return nil, err
+			}
+			u.InterstitialSnippet = parsed
+		}
+
+		if notes := req.Form.Get("privateNotes"); notes != "" {
+			if err := validatePrivateNotes(notes); err != nil {
+				return nil, err
+			}
+			u.PrivateNotes = notes
+		}
+
+		if metadata := req.Form.Get("metadata"); metadata != "" {
+			serialized, err := parseMetadata(metadata)
+			if err != nil {
+				return nil, err
+			}
+			u.Metadata = serialized
+		}
+
+		if frameOptions := req.Form.Get("frameOptions"); frameOptions != "" {
+			if !isValidFrameOption(frameOptions) {
+				return nil, fmt.Errorf("frameOptions must be %q, %q or %q",
+					FRAME_DENY, FRAME_SAME_ORIGIN, FRAME_ALLOW)
+			}
+			u.FrameOptions = frameOptions
+		}
+
+		if every := req.Form.Get("clickSampleEvery"); every != "" {
+			n, err := strconv.Atoi(every)
+			if err != nil || n < 1 || n > MAX_CLICK_SAMPLE_EVERY {
+				return nil, fmt.Errorf("clickSampleEvery must be between 1 and %d", MAX_CLICK_SAMPLE_EVERY)
+			}
+			u.ClickSampleEvery = n
+		}
+
+		u.NoAnalytics = config.NoAnalytics
+		if noAnalytics := req.Form.Get("noAnalytics"); noAnalytics != "" {
+			u.NoAnalytics = noAnalytics == "true"
 		}
 
-		parsedUrl, err := u.parseTarget()
+		if budget := req.Form.Get("redirectBudgetMs"); budget != "" {
+			ms, err := strconv.Atoi(budget)
+			if err != nil || ms < 0 || ms > MAX_REDIRECT_BUDGET_MS {
+				return nil, fmt.Errorf("redirectBudgetMs must be between 0 and %d", MAX_REDIRECT_BUDGET_MS)
+			}
+			u.RedirectBudgetMs = ms
+		}
+
+		// Templates' placeholders wouldn't survive their query being
+		// rewritten.
+		u.canonicalTarget = req.Form.Get("reuse") == "true" && req.Form.Get("templated") != "true"
+		parsedUrl, err := u.setTarget(target, req.Host)
 
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
-		u.TargetURL = parsedUrl.String()
+		if req.Form.Get("templated") == "true" {
+			if err = validateTargetTemplate(parsedUrl); err != nil {
+				return nil, err
+			}
+			u.Templated = true
+		}
+		if u.Permanent && (u.Templated || u.Schedule != "") {
+			return nil, errors.New("Templated and scheduled links can't be permanent, since clients would cache a single redirect.")
+		}
 
-		if parsedUrl.Host == r.Host {
-			return "", errors.New("Don't try to make redirect loops.")
-		} else if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
-			return "", errors.New("http[s] links only.")
+		if authUser := req.Form.Get("authUser"); authUser != "" {
+			if err = u.setCredentials(authUser, req.Form.Get("authPassword"), req.Form.Get("authMode")); err != nil {
+				return nil, err
+			}
+		} else if len(req.AuthCredentials) > 0 {
+			if _, err = credentialsKey(); err != nil {
+				return nil, err
+			}
+			u.AuthCredentials, u.AuthMode = req.AuthCredentials, req.AuthMode
 		}
 
-		c := appengine.NewContext(r)
-		_, err = getMatchingLink(c, chatID, path)
+		for _, fallback := range req.Form["fallback"] {
+			parsedFallback, err := (&Link{TargetURL: fallback}).parseTarget()
+			if err != nil {
+				return nil, err
+			} else if err = checkTarget(parsedFallback, req.Host); err != nil {
+				return nil, err
+			}
+			u.FallbackTargets = append(u.FallbackTargets, parsedFallback.String())
+		}
+
+		if !req.Bulk {
+			status, err := checkSafeBrowsing(c, u.safeBrowsingTargets())
+			if err != nil {
+				return nil, err
+			}
+			u.setSafeBrowsingStatus(status, u.Created)
+		}
+
+		existing, err := getMatchingLink(c, chatID, path)
 
 		if err == nil {
-			return "", errors.New("There already exists a link with that path. ")
+			return nil, &pathTakenError{path, existing}
 		}
 
-		currUser := user.Current(c)
-		var creator string
-		if currUser == nil {
-			creator = r.FormValue("creator")
-			if creator == "" {
-				return "", errors.New("No creator provided.")
+		creator, source := req.Creator, CREATOR_SOURCE_PRESET
+		if creator == "" {
+			creator, source, err = resolveCreator(config.CreatorPrecedence, req.APIKey, req.User, req.Form.Get("creator"))
+			if err != nil {
+				return nil, err
 			}
-		} else {
-			creator = currUser.Email
 		}
 
 		u.Creator = creator
+		u.APIKeyID = req.APIKeyID
+		u.creatorSource = source
+		u.createdFrom = req.RemoteAddr
 
 		var chatKey *datastore.Key
-		if chatID >= 0 {
-			_, err = getOrCreateChat(c, chatID, &chatKey)
+		if chatID.Valid {
+			_, err = getOrCreateChat(c, chatID.ID, &chatKey)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 		} else {
 			chatKey = nil
 		}
 
-		u.ChatKey = chatKey
+		u.ChatKeys = []*datastore.Key{chatKey}
 
-		if u.IsLikelyMusicLink() {
-			var info MusicInfo
-			client := urlfetch.Client(c)
-			params := url.Values{}
-			params.Set("link", u.TargetURL)
+		if req.Bulk {
+			u.musicInfoPending = u.IsLikelyMusicLink() && isFeatureEnabled(c, FLAG_MUSIC_INFO)
+		} else {
+			fillMusicInfo(c, &u)
+		}
 
-			// TODO implement a task queue operation to fill in the info if this request fails.
-			resp, err := client.Get("http://music.hms.space/get_music_info?" + params.Encode())
-			if err != nil {
-				log.Errorf(c, "Request for music info for %v failed. Error: %v", u.TargetURL, err.Error())
-			} else {
-				defer resp.Body.Close()
-				body, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					log.Errorf(c, "Failed to read body: %v", err.Error())
-				} else {
-					err = json.Unmarshal(body, &info)
-					if err != nil {
-						log.Errorf(c, "Failed to parse music response json: %v; json was %v", err.Error(), body)
-					} else {
-						u.MusicInfo = info
-					}
-				}
+		return &u, nil
+	}
+}
+
+// Fills in u's MusicInfo from the music provider (or the cache), if u
+// looks like a music link. If the provider can't be reached, u is marked for
+// queueMusicInfoFetch to retry once it's stored.
+func fillMusicInfo(c context.Context, u *Link) {
+	if !u.IsLikelyMusicLink() || !isFeatureEnabled(c, FLAG_MUSIC_INFO) {
+		return
+	}
+
+	defer func() { u.HasMusic = !u.MusicInfo.IsEmpty() }()
+
+	if cached := getCachedMusicInfo(c, u.TargetURL); cached != nil {
+		u.MusicInfo = *cached
+		return
+	}
+
+	info, err := fetchMusicInfo(c, u.TargetURL)
+	if err != nil {
+		log.Errorf(c, "Request for music info for %v failed. Error: %v", u.TargetURL, err.Error())
+		u.musicInfoPending = true
+		u.warnings = append(u.warnings, "Music info isn't available for this link yet.")
+		return
+	}
+	u.MusicInfo = *info
+	cacheMusicInfo(c, u.TargetURL, info)
+}
+
+// Stores a new link, giving it an auto-encoded path if it doesn't have one.
+func putNewLink(c context.Context, u *Link) (*datastore.Key, error) {
+	path := u.Path
+	var finalKey *datastore.Key
+
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		u.setPath(path)
+		key := datastore.NewIncompleteKey(c, "Link", nil)
+		newKey, err1 := datastore.Put(c, key, u)
+		if err1 != nil {
+			return err1
+		}
+		finalKey = newKey
+
+		if path == "" {
+			// Since this can be re-run multiple times,
+			// this function has to be idempotent
+			u.setPath(autoLinkPath(newKey.IntID()))
+			_, err2 := datastore.Put(c, newKey, u)
+			if err2 != nil {
+				return err2
 			}
 		}
+		return nil
+	}, nil)
 
-		finalPath := path
+	if err != nil {
+		return nil, err
+	}
+	linkStored(c, finalKey, u)
+	return finalKey, nil
+}
 
-		err = datastore.RunInTransaction(c, func(tc context.Context) error {
-			key := datastore.NewIncompleteKey(c, "Link", nil)
-			newKey, err1 := datastore.Put(c, key, &u)
-			if err1 != nil {
-				return err1
-			}
+// Does the bookkeeping for a new link once it's been stored.
+func linkStored(c context.Context, key *datastore.Key, u *Link) {
+	logCreation(c, key, u)
+	adjustCreatorLinkCount(c, u.Creator, 1)
+	queueOEmbedFetch(c, key)
+	queueMusicInfoFetch(c, key, u)
+}
 
-			if path == "" {
-				newPath := ShortURLEncode(newKey.IntID())
-				// Since this can be re-run multiple times,
-				// this function has to be idempotent
-				linkCopy := Link{
-					Path:      newPath,
-					TargetURL: u.TargetURL,
-					Creator:   u.Creator,
-					Created:   u.Created,
-					ChatKey:   u.ChatKey,
-					MusicInfo: u.MusicInfo,
-				}
-				_, err2 := datastore.Put(c, newKey, &linkCopy)
-				if err2 != nil {
-					return err2
-				}
-				finalPath = newPath
+// Logs who created a link and from where, for tracking down abuse. Only the
+// creator's email is logged, never any credentials.
+func logCreation(c context.Context, key *datastore.Key, u *Link) {
+	if !config.LogCreations {
+		return
+	}
+	log.Infof(c, "link created: creator=%q source=%s client=%s path=%q code=%s",
+		u.Creator, u.creatorSource, u.createdFrom, u.Path, autoLinkPath(key.IntID()))
+}
+
+// Returns an existing link by u's creator to u's exact target in u's chat,
+// or nil if there isn't one.
+func findReusableLink(c context.Context, u *Link) (*Link, error) {
+	existing := make([]Link, 0, 1)
+	_, err := datastore.NewQuery("Link").
+		Filter("TargetURL =", u.TargetURL).Filter("ChatKeys =", u.PrimaryChatKey()).
+		Filter("Creator =", u.Creator).Limit(1).GetAll(c, &existing)
+	if err != nil || len(existing) == 0 {
+		return nil, err
+	}
+	return &existing[0], nil
+}
+
+// Records which link getOrCreateLink handed out for a target in a chat.
+// Keyed by targetIndexKeyName.
+type LinkTargetIndex struct {
+	LinkKey *datastore.Key
+}
+
+func targetIndexKeyName(chatKey *datastore.Key, target string) string {
+	chat := ""
+	if chatKey != nil {
+		chat = chatKey.Encode()
+	}
+	sum := sha1.Sum([]byte(chat + "\n" + target))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns an existing link to u's target in u's chat, or stores u if there
+// isn't one. The bool result reports whether u was created. Concurrent calls
+// for the same target and chat all get the same link: the lookup and the
+// write happen in one transaction on a LinkTargetIndex entity.
+func getOrCreateLink(c context.Context, u *Link) (*datastore.Key, *Link, bool, error) {
+	chatKey := u.PrimaryChatKey()
+
+	// Links made through other flows aren't in the index, so look for
+	// those first.
+	existing := make([]Link, 0, 1)
+	keys, err := datastore.NewQuery("Link").
+		Filter("TargetURL =", u.TargetURL).Filter("ChatKeys =", chatKey).
+		Limit(1).GetAll(c, &existing)
+	if err != nil {
+		return nil, nil, false, err
+	} else if len(keys) != 0 {
+		return keys[0], &existing[0], false, nil
+	}
+
+	low, _, err := datastore.AllocateIDs(c, "Link", nil, 1)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	newKey := datastore.NewKey(c, "Link", "", low, nil)
+	if u.Path == "" {
+		u.setPath(autoLinkPath(low))
+	}
+
+	indexKey := datastore.NewKey(c, "LinkTargetIndex", targetIndexKeyName(chatKey, u.TargetURL), 0, nil)
+	var resultKey *datastore.Key
+	var result *Link
+	var created bool
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		var index LinkTargetIndex
+		err := datastore.Get(tc, indexKey, &index)
+		if err == nil {
+			var link Link
+			err = datastore.Get(tc, index.LinkKey, &link)
+			if err == nil && link.TargetURL == u.TargetURL {
+				resultKey, result, created = index.LinkKey, &link, false
+				return nil
+			} else if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
 			}
-			return nil
-		}, nil)
+			// The indexed link was deleted or has been given a new target,
+			// so make a new one.
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
 
-		if err != nil {
-			return "", err
+		if _, err = datastore.Put(tc, newKey, u); err != nil {
+			return err
+		}
+		if _, err = datastore.Put(tc, indexKey, &LinkTargetIndex{newKey}); err != nil {
+			return err
 		}
+		resultKey, result, created = newKey, u, true
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
 
-		return finalPath, nil
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if created {
+		linkStored(c, resultKey, u)
 	}
+	return resultKey, result, created, nil
 }
@@ -0,0 +1,203 @@
+package hms
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestCheckTargetScheme(t *testing.T) {
+	cases := []struct {
+		policy string
+		scheme string
+		ok     bool
+	}{
+		{SCHEME_POLICY_HTTP_HTTPS, "http", true},
+		{SCHEME_POLICY_HTTP_HTTPS, "https", true},
+		{SCHEME_POLICY_HTTP_HTTPS, "ftp", false},
+		{SCHEME_POLICY_HTTPS_ONLY, "https", true},
+		{SCHEME_POLICY_HTTPS_ONLY, "http", false},
+		{SCHEME_POLICY_HTTPS_ONLY, "ftp", false},
+		{"nonsense", "http", true},
+	}
+
+	for _, tc := range cases {
+		err := checkTargetScheme(tc.policy, tc.scheme)
+		if (err == nil) != tc.ok {
+			t.Errorf("For policy %q and scheme %q, expected ok=%v but got %v", tc.policy, tc.scheme, tc.ok, err)
+		}
+	}
+}
+
+func TestMatchShortenerRoute(t *testing.T) {
+	cases := []struct {
+		path       string
+		preference string
+		route      string
+		param      string
+	}{
+		{"/ABC", AMBIGUOUS_PREFER_AUTO, "auto", "ABC"},
+		{"/ABC", AMBIGUOUS_PREFER_MANUAL, "auto", "ABC"},
+		{"/abc", AMBIGUOUS_PREFER_AUTO, "manual", "abc"},
+		{"/abc", AMBIGUOUS_PREFER_MANUAL, "manual", "abc"},
+		// Valid both as a code and as a manual path.
+		{"/yD", AMBIGUOUS_PREFER_AUTO, "auto", "yD"},
+		{"/yD", AMBIGUOUS_PREFER_MANUAL, "manual", "yD"},
+		{"/y", AMBIGUOUS_PREFER_AUTO, "auto", "y"},
+		{"/y", AMBIGUOUS_PREFER_MANUAL, "manual", "y"},
+		// Manual paths are case-insensitive.
+		{"/MyLink", AMBIGUOUS_PREFER_AUTO, "manual", "MyLink"},
+		{"/MyLink", AMBIGUOUS_PREFER_MANUAL, "manual", "MyLink"},
+		{"/", AMBIGUOUS_PREFER_AUTO, "index", ""},
+		{"/qr/abc", AMBIGUOUS_PREFER_AUTO, "qr", "abc"},
+		{"/qr/ABC", AMBIGUOUS_PREFER_MANUAL, "qr", "ABC"},
+	}
+
+	for _, tc := range cases {
+		route, params := matchShortenerRoute(tc.path, tc.preference)
+		if route == nil {
+			t.Errorf("For %q, no route matched", tc.path)
+			continue
+		}
+		param := ""
+		if len(params) > 0 {
+			param = params[0]
+		}
+		if route.Name != tc.route || param != tc.param {
+			t.Errorf("For %q preferring %s, expected %s(%q) but got %s(%q)",
+				tc.path, tc.preference, tc.route, tc.param, route.Name, param)
+		}
+	}
+}
+
+func TestAutoCodeMissRoute(t *testing.T) {
+	if manual := autoCodeMissRoute("yD", AMBIGUOUS_PREFER_AUTO); len(manual) != 1 || manual[0] != "yD" {
+		t.Errorf("Expected a missing ambiguous code to be tried as a manual path, got %v", manual)
+	}
+	if manual := autoCodeMissRoute("yD", AMBIGUOUS_PREFER_MANUAL); manual != nil {
+		t.Errorf("Expected the manual route not to be tried twice, got %v", manual)
+	}
+	// All-caps manual paths only match the auto route, and are looked up
+	// as paths directly in both modes.
+	for _, preference := range []string{AMBIGUOUS_PREFER_AUTO, AMBIGUOUS_PREFER_MANUAL} {
+		if route, _ := matchShortenerRoute("/MYLINK", preference); route == nil || route.Name != "auto" {
+			t.Errorf("Expected /MYLINK to match the auto route preferring %s", preference)
+		}
+		if manual := autoCodeMissRoute("MYLINK", preference); manual != nil {
+			t.Errorf("Expected MYLINK preferring %s to be looked up directly, got %v", preference, manual)
+		}
+	}
+}
+
+func TestMatchShortenerRouteIsStable(t *testing.T) {
+	for _, path := range []string{"/y", "/a", "/yD", "/MyLink", "/qr/y"} {
+		for _, preference := range []string{AMBIGUOUS_PREFER_AUTO, AMBIGUOUS_PREFER_MANUAL} {
+			first, _ := matchShortenerRoute(path, preference)
+			for i := 0; i < 100; i++ {
+				if route, _ := matchShortenerRoute(path, preference); route.Name != first.Name {
+					t.Fatalf("For %q preferring %s, got %s and then %s", path, preference, first.Name, route.Name)
+				}
+			}
+		}
+	}
+}
+
+func TestSetTargetSchemes(t *testing.T) {
+	normalized := map[string]string{
+		"example.com/a":          "http://example.com/a",
+		"//example.com/a":        "http://example.com/a",
+		"HTTPS://Example.com/a":  "https://example.com/a",
+		"https://example.com/?q": "https://example.com/?q",
+	}
+	for target, expected := range normalized {
+		var link Link
+		if _, err := link.setTarget(target, "hms.space"); err != nil || link.TargetURL != expected {
+			t.Errorf("For %q, expected %q but got %q, %v", target, expected, link.TargetURL, err)
+		}
+	}
+
+	refused := []string{
+		"javascript:alert(1)",
+		"JavaScript:alert(document.cookie)",
+		" javascript:alert(1)",
+		"data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==",
+		"vbscript:msgbox(1)",
+		"file:///etc/passwd",
+		"mailto:someone@example.com",
+		"http:example.com",
+		"http:///path",
+		"///example.com",
+		"//hms.space/loop",
+	}
+	for _, target := range refused {
+		var link Link
+		if _, err := link.setTarget(target, "hms.space"); err == nil {
+			t.Errorf("Expected %q to be refused, got %q", target, link.TargetURL)
+		}
+	}
+}
+
+func TestManualPathsCantShadowAutoCodes(t *testing.T) {
+	for _, path := range []string{"y", "yD", "yB4-", "yy"} {
+		if isValidPath(path) {
+			t.Errorf("Expected %q to be refused, since it decodes to link %d", path, ShortURLDecode(path))
+		}
+	}
+	for _, path := range []string{"", "docs", "yes", "y.z", "ys"} {
+		if !isValidPath(path) {
+			t.Errorf("Expected %q to be a valid path", path)
+		}
+	}
+
+	// Every code is refused as a manual path, whichever route it's
+	// matched by.
+	for id := int64(1); id < 5000; id++ {
+		code := autoLinkPath(id)
+		if isValidPath(code) {
+			t.Fatalf("Expected the code for link %d, %q, to be refused as a manual path", id, code)
+		}
+	}
+}
+
+func TestNormalizeAutoCodeRoundTrip(t *testing.T) {
+	for id := int64(1); id < 5000; id++ {
+		code := autoLinkPath(id)
+		if normalized := normalizeAutoCode(code); normalized != code {
+			t.Fatalf("Expected the code for link %d, %q, to already be canonical, got %q", id, code, normalized)
+		}
+
+		// Anything but Y can be typed in lowercase.
+		typed := strings.Map(func(r rune) rune {
+			if r == 'Y' {
+				return r
+			}
+			return unicode.ToLower(r)
+		}, code)
+		if decoded := ShortURLDecode(normalizeAutoCode(typed)); decoded != id {
+			t.Fatalf("Expected %q to find link %d like %q does, got %d", typed, id, code, decoded)
+		}
+	}
+
+	if normalizeAutoCode("yd") != "yD" || normalizeAutoCode("Yd") != "YD" {
+		t.Errorf("Expected y and Y to keep their case")
+	}
+}
+
+func TestCheckRedirectScheme(t *testing.T) {
+	cases := []struct {
+		policy      string
+		target      string
+		unavailable bool
+	}{
+		{SCHEME_POLICY_HTTP_HTTPS, "http://example.com/", false},
+		{SCHEME_POLICY_HTTPS_ONLY, "https://example.com/", false},
+		{SCHEME_POLICY_HTTPS_ONLY, "http://example.com/", true},
+		{SCHEME_POLICY_HTTP_HTTPS, "javascript:alert(1)", true},
+	}
+	for _, tc := range cases {
+		err := checkRedirectScheme(tc.policy, tc.target)
+		if _, unavailable := err.(*linkUnavailableError); unavailable != tc.unavailable {
+			t.Errorf("For %q under %q, expected unavailable=%v but got %v", tc.target, tc.policy, tc.unavailable, err)
+		}
+	}
+}
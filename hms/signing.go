@@ -0,0 +1,83 @@
+package hms
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	SIGNATURE_HEADER = "X-HMS-Signature"
+	TIMESTAMP_HEADER = "X-HMS-Timestamp"
+
+	// How far a signed request's timestamp may be from our clock.
+	MAX_SIGNATURE_AGE = 5 * time.Minute
+)
+
+// Computes the signature for a request, for use by automation that can't go
+// through the interactive admin login:
+//
+//	hex(HMAC-SHA256(secret, method + "\n" + requestURI + "\n" + timestamp + "\n" + body))
+//
+// where timestamp is the Unix time sent in the X-HMS-Timestamp header.
+func computeSignature(secret string, method string, requestURI string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the request's signature against the admin secret. A signature can
+// only be used once, and only within MAX_SIGNATURE_AGE of its timestamp.
+func verifyRequestSignature(c context.Context, r *http.Request) error {
+	if config.AdminSigningSecret == "" {
+		return errors.New("request signing is not enabled")
+	}
+
+	timestamp := r.Header.Get(TIMESTAMP_HEADER)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid timestamp")
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > MAX_SIGNATURE_AGE || age < -MAX_SIGNATURE_AGE {
+		return errors.New("stale timestamp")
+	}
+
+	// The body has to be read to be verified, so put it back afterwards
+	// for the handler.
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	signature := r.Header.Get(SIGNATURE_HEADER)
+	expected := computeSignature(config.AdminSigningSecret, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errors.New("signature mismatch")
+	}
+
+	err = memcache.Add(c, &memcache.Item{
+		Key:        "signature:" + signature,
+		Value:      []byte{},
+		Expiration: 2 * MAX_SIGNATURE_AGE,
+	})
+	if err == memcache.ErrNotStored {
+		return errors.New("signature already used")
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package hms
+
+import (
+	"testing"
+)
+
+func TestComputeSignature(t *testing.T) {
+	sig := computeSignature("secret", "POST", "/add_chat?name=a&fbID=1", "1446000000", []byte(""))
+
+	if sig != computeSignature("secret", "POST", "/add_chat?name=a&fbID=1", "1446000000", nil) {
+		t.Errorf("Signature should be deterministic")
+	}
+
+	changed := []string{
+		computeSignature("other", "POST", "/add_chat?name=a&fbID=1", "1446000000", nil),
+		computeSignature("secret", "GET", "/add_chat?name=a&fbID=1", "1446000000", nil),
+		computeSignature("secret", "POST", "/add_chat?name=b&fbID=1", "1446000000", nil),
+		computeSignature("secret", "POST", "/add_chat?name=a&fbID=1", "1446000001", nil),
+		computeSignature("secret", "POST", "/add_chat?name=a&fbID=1", "1446000000", []byte("x")),
+	}
+	for i, other := range changed {
+		if other == sig {
+			t.Errorf("Case %d: changing the request should change the signature", i)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package hms
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+
+	"google.golang.org/appengine/log"
+)
+
+// Most bytes an interstitial snippet may take.
+const MAX_SNIPPET_SIZE = 4096
+
+// Tags an interstitial snippet may use, with the attributes each may have.
+// <script> is only allowed with config.AllowSnippetScripts.
+var SNIPPET_TAGS = map[string]map[string]bool{
+	"a":        {"href": true, "rel": true, "target": true},
+	"br":       {},
+	"div":      {},
+	"img":      {"src": true, "alt": true, "width": true, "height": true},
+	"noscript": {},
+	"p":        {},
+	"script":   {"src": true, "async": true, "defer": true, "type": true},
+	"span":     {},
+}
+
+// Attributes any snippet tag may have.
+var SNIPPET_GLOBAL_ATTRS = map[string]bool{"id": true, "class": true, "title": true}
+
+// Tags with no end tag.
+var SNIPPET_VOID_TAGS = map[string]bool{"br": true, "img": true}
+
+// Parses an HTML snippet for the interstitial, like an analytics pixel,
+// refusing anything outside SNIPPET_TAGS, URLs that aren't http(s) and
+// unbalanced tags. Returns it re-serialized, so only markup that was checked
+// reaches the page.
+func parseSnippet(snippet string, allowScripts bool) (string, error) {
+	if len(snippet) > MAX_SNIPPET_SIZE {
+		return "", fmt.Errorf("Snippets are limited to %d bytes.", MAX_SNIPPET_SIZE)
+	}
+	var out bytes.Buffer
+	if err := writeSnippet(&out, snippet, allowScripts, true); err != nil {
+		return "", fmt.Errorf("Invalid snippet: %v", err)
+	}
+	return out.String(), nil
+}
+
+func writeSnippet(out *bytes.Buffer, snippet string, allowScripts, allowNoscript bool) error {
+	z := html.NewTokenizer(strings.NewReader(snippet))
+	var open []string
+	// What's inside a <noscript>, which the tokenizer reads as text but
+	// browsers without scripts read as markup.
+	var noscript bytes.Buffer
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return z.Err()
+			} else if len(open) > 0 {
+				return fmt.Errorf("<%s> isn't closed", open[len(open)-1])
+			}
+			return nil
+		}
+
+		tok := z.Token()
+		inside := ""
+		if len(open) > 0 {
+			inside = open[len(open)-1]
+		}
+		switch tt {
+		case html.TextToken:
+			if inside == "script" {
+				// The tokenizer ends it at the first </script.
+				out.WriteString(tok.Data)
+			} else if inside == "noscript" {
+				noscript.WriteString(tok.Data)
+			} else {
+				out.WriteString(html.EscapeString(tok.Data))
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if err := checkSnippetTag(tok, allowScripts, allowNoscript); err != nil {
+				return err
+			}
+			if SNIPPET_VOID_TAGS[tok.Data] {
+				tok.Type = html.SelfClosingTagToken
+				out.WriteString(tok.String())
+			} else if tt == html.SelfClosingTagToken {
+				// Browsers ignore the slash on other tags.
+				tok.Type = html.StartTagToken
+				out.WriteString(tok.String() + "</" + tok.Data + ">")
+			} else {
+				out.WriteString(tok.String())
+				open = append(open, tok.Data)
+			}
+
+		case html.EndTagToken:
+			if tok.Data != inside {
+				return fmt.Errorf("</%s> doesn't close an open tag", tok.Data)
+			}
+			open = open[:len(open)-1]
+			if tok.Data == "noscript" {
+				if err := writeSnippet(out, noscript.String(), allowScripts, false); err != nil {
+					return err
+				}
+				noscript.Reset()
+			}
+			out.WriteString(tok.String())
+
+		default:
+			return fmt.Errorf("only tags and text are allowed")
+		}
+	}
+}
+
+func checkSnippetTag(tok html.Token, allowScripts, allowNoscript bool) error {
+	attrs, ok := SNIPPET_TAGS[tok.Data]
+	if !ok || (tok.Data == "script" && !allowScripts) || (tok.Data == "noscript" && !allowNoscript) {
+		return fmt.Errorf("<%s> isn't allowed", tok.Data)
+	}
+	for _, attr := range tok.Attr {
+		if attr.Namespace != "" || (!attrs[attr.Key] && !SNIPPET_GLOBAL_ATTRS[attr.Key]) {
+			return fmt.Errorf("<%s %s> isn't allowed", tok.Data, attr.Key)
+		}
+		if attr.Key == "src" || attr.Key == "href" {
+			parsed, err := url.Parse(attr.Val)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("<%s %s> has to be an http or https URL", tok.Data, attr.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the snippet the link's interstitial embeds: its own
+// InterstitialSnippet, or else config.InterstitialSnippet. Checked again as
+// it's served, since config.AllowSnippetScripts may have been turned off
+// since; a snippet that no longer passes is left out.
+func (l *Link) interstitialSnippet(c context.Context) template.HTML {
+	snippet := l.InterstitialSnippet
+	if snippet == "" {
+		snippet = config.InterstitialSnippet
+	}
+	if snippet == "" {
+		return ""
+	}
+	parsed, err := parseSnippet(snippet, config.AllowSnippetScripts)
+	if err != nil {
+		log.Errorf(c, "Leaving out interstitial snippet: %v", err)
+		return ""
+	}
+	return template.HTML(parsed)
+}
@@ -0,0 +1,50 @@
+package hms
+
+import "testing"
+
+func TestParseSnippet(t *testing.T) {
+	valid := map[string]string{
+		`<img src="https://stats.example/p.gif?id=1&amp;v=2" width=1 height=1>`: `<img src="https://stats.example/p.gif?id=1&amp;v=2" width="1" height="1"/>`,
+		`<div class="ad">Views & clicks</div>`:                                  `<div class="ad">Views &amp; clicks</div>`,
+		`<noscript><img src="http://stats.example/p.gif"/></noscript>`:          `<noscript><img src="http://stats.example/p.gif"/></noscript>`,
+		`<span/>`: `<span></span>`,
+	}
+	for snippet, expected := range valid {
+		if parsed, err := parseSnippet(snippet, false); err != nil || parsed != expected {
+			t.Errorf("For %q, expected %q but got %q, %v", snippet, expected, parsed, err)
+		}
+	}
+
+	invalid := []string{
+		`<script>track()</script>`,
+		`<SCRIPT src="https://stats.example/t.js"></SCRIPT>`,
+		`<img src="https://stats.example/p.gif" onerror="track()">`,
+		`<img src="javascript:track()">`,
+		`<a href="/relative">x</a>`,
+		`<iframe src="https://stats.example/"></iframe>`,
+		`<style>body { display: none }</style>`,
+		`<div>`,
+		`</div>`,
+		`<div><span></div></span>`,
+		`<!-- hidden -->`,
+		`<noscript><script>track()</script></noscript>`,
+		`<noscript><noscript></noscript></noscript>`,
+	}
+	for _, snippet := range invalid {
+		if parsed, err := parseSnippet(snippet, false); err == nil {
+			t.Errorf("Expected %q to be refused but got %q", snippet, parsed)
+		}
+	}
+}
+
+func TestParseSnippetScripts(t *testing.T) {
+	snippet := `<script async src="https://stats.example/t.js"></script><script>track("a < b")</script>`
+	expected := `<script async="" src="https://stats.example/t.js"></script><script>track("a < b")</script>`
+	if parsed, err := parseSnippet(snippet, true); err != nil || parsed != expected {
+		t.Errorf("Expected scripts to be allowed when configured, got %q, %v", parsed, err)
+	}
+
+	if parsed, err := parseSnippet(`<script onload="x()"></script>`, true); err == nil {
+		t.Errorf("Expected script event handlers to be refused but got %q", parsed)
+	}
+}
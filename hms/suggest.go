@@ -0,0 +1,118 @@
+package hms
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	MAX_PATH_SUGGESTIONS = 5
+	// How many candidate paths sharing a prefix are considered.
+	SUGGESTION_CANDIDATES = 200
+)
+
+// The Error of the 404 for a well-formed path no link has, as opposed to a
+// malformed one. Rendered with errors/link_not_found.html.
+type linkNotFoundError struct {
+	Path        string
+	BasePath    string
+	Suggestions []string
+}
+
+func (e *linkNotFoundError) Error() string {
+	return fmt.Sprintf("no link with path %q", e.Path)
+}
+
+// Returns the 404 for path, suggesting similar existing paths in the chat
+// if config.SuggestSimilarPaths is on.
+func linkNotFound(c context.Context, strChatID string, path string) *appError {
+	var suggestions []string
+	if config.SuggestSimilarPaths {
+		var err error
+		if suggestions, err = suggestSimilarPaths(c, strChatID, path); err != nil {
+			log.Errorf(c, "Failed to find suggestions for %q: %v", path, err)
+		}
+	}
+	return &appError{&linkNotFoundError{path, config.BasePath, suggestions}, "Invalid short url.", 404}
+}
+
+// Finds up to MAX_PATH_SUGGESTIONS existing paths in the chat (none for
+// "") that are similar to path, closest first. Private links aren't
+// suggested. Only paths sharing path's first character are considered,
+// which keeps this to a single bounded query.
+func suggestSimilarPaths(c context.Context, strChatID string, path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	chatID, err := parseChatID(strChatID)
+	if err != nil {
+		return nil, err
+	}
+	chatKey, err := getChatKey(c, chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := string([]rune(path)[0])
+	candidates := make([]Link, 0, SUGGESTION_CANDIDATES)
+	_, err = datastore.NewQuery("Link").
+		Filter("ChatKeys =", chatKey).
+		Filter("Path >=", prefix).Filter("Path <", prefix+"\ufffd").
+		Limit(SUGGESTION_CANDIDATES).GetAll(c, &candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(candidates))
+	for _, l := range candidates {
+		// Filtered here rather than in the query (or projected), since
+		// links from before Private existed don't have the property at all.
+		if !l.Private {
+			paths = append(paths, l.Path)
+		}
+	}
+	return rankSuggestions(path, paths, MAX_PATH_SUGGESTIONS), nil
+}
+
+// Picks the candidates close enough to path to plausibly be what was meant.
+func rankSuggestions(path string, candidates []string, max int) []string {
+	threshold := len([]rune(path)) / 3
+	if threshold < 2 {
+		threshold = 2
+	}
+
+	type scored struct {
+		path     string
+		distance int
+	}
+	matches := make([]scored, 0)
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		if candidate == path || seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+
+		if d := editDistance(path, candidate); d <= threshold {
+			matches = append(matches, scored{candidate, d})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].path < matches[j].path
+	})
+
+	result := make([]string, 0, max)
+	for i := 0; i < len(matches) && i < max; i++ {
+		result = append(result, matches[i].path)
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+package hms
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	cases := map[[2]string]int{
+		{"", ""}:               0,
+		{"abc", ""}:            3,
+		{"kitten", "sitting"}:  3,
+		{"mylink", "mylink"}:   0,
+		{"mylink", "mylnik"}:   2,
+		{"münchen", "munchen"}: 1,
+	}
+
+	for pair, expected := range cases {
+		if d := editDistance(pair[0], pair[1]); d != expected {
+			t.Errorf("For %v, expected %d, got %d", pair, expected, d)
+		}
+	}
+}
+
+func TestRankSuggestions(t *testing.T) {
+	candidates := []string{"mylink", "mylinks", "mixtape", "mylnik", "my", "mylink", "pics"}
+
+	result := rankSuggestions("mylinkk", candidates, 3)
+	expected := []string{"mylink", "mylinks", "mylnik"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	if result := rankSuggestions("mylink", candidates, 1); !reflect.DeepEqual(result, []string{"mylinks"}) {
+		t.Errorf("Expected the exact match to be excluded and the count bounded, got %v", result)
+	}
+
+	if result := rankSuggestions("zzz", candidates, 5); len(result) != 0 {
+		t.Errorf("Expected no suggestions, got %v", result)
+	}
+}
+
+func TestLinkNotFoundTemplate(t *testing.T) {
+	e := &appError{&linkNotFoundError{"yDX", "/s", []string{"yDQ"}}, "Invalid short url.", 404}
+	tmpl, err := getErrorTemplate(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, e); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `href="/s/yDQ"`) || !strings.Contains(out.String(), `href="/s/"`) {
+		t.Errorf("Expected a suggestion and a link to the index, got %s", out.String())
+	}
+}
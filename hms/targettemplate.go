@@ -0,0 +1,64 @@
+package hms
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Matches a placeholder in a templated target, like {query.q} or
+// {header.Accept-Language}. Normalizing the target escapes braces in its
+// path, so the escaped form is matched too.
+var targetPlaceholderRegex = regexp.MustCompile(`(?i)(?:\{|%7B)([a-z]+)\.([A-Za-z0-9_-]+)(?:\}|%7D)`)
+
+// Checks the placeholders in a templated target: each has to name a query
+// param, or one of config.TemplateHeaders, and they can only appear after
+// the host so they can't change where the link goes.
+func validateTargetTemplate(target *url.URL) error {
+	if targetPlaceholderRegex.MatchString(target.Scheme + "://" + target.Host) {
+		return fmt.Errorf("Placeholders can't be used in the target's scheme or host")
+	}
+
+	for _, match := range targetPlaceholderRegex.FindAllStringSubmatch(target.String(), -1) {
+		switch strings.ToLower(match[1]) {
+		case "query":
+		case "header":
+			if !isTemplateHeader(match[2]) {
+				return fmt.Errorf("The %s header can't be used in targets", match[2])
+			}
+		default:
+			return fmt.Errorf("Unknown placeholder %q", match[0])
+		}
+	}
+	return nil
+}
+
+func isTemplateHeader(name string) bool {
+	for _, allowed := range config.TemplateHeaders {
+		if strings.EqualFold(name, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fills the placeholders in target from r. Values are escaped so they can't
+// add to the URL's structure, and missing ones are left empty.
+func expandTargetTemplate(target string, r *http.Request) string {
+	return targetPlaceholderRegex.ReplaceAllStringFunc(target, func(placeholder string) string {
+		match := targetPlaceholderRegex.FindStringSubmatch(placeholder)
+		var value string
+		switch strings.ToLower(match[1]) {
+		case "query":
+			value = r.URL.Query().Get(match[2])
+		case "header":
+			if isTemplateHeader(match[2]) {
+				value = r.Header.Get(match[2])
+			}
+		}
+		// QueryEscape's "+" for spaces only means a space in the query.
+		return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	})
+}
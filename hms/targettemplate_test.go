@@ -0,0 +1,60 @@
+package hms
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestValidateTargetTemplate(t *testing.T) {
+	defer func(headers []string) { config.TemplateHeaders = headers }(config.TemplateHeaders)
+	config.TemplateHeaders = []string{"Accept-Language"}
+
+	cases := map[string]bool{
+		"http://example.com/search?q={query.q}":             true,
+		"http://example.com/{query.page}":                   true,
+		"http://example.com/?lang={header.accept-language}": true,
+		"http://example.com/?auth={header.Authorization}":   false,
+		"http://example.com/?x={cookie.session}":            false,
+	}
+
+	for target, ok := range cases {
+		parsed, err := url.Parse(target)
+		if err != nil {
+			t.Fatalf("Bad test target %q: %v", target, err)
+		}
+		if err = validateTargetTemplate(parsed); (err == nil) != ok {
+			t.Errorf("For %q, expected ok=%v but got %v", target, ok, err)
+		}
+	}
+
+	// url.Parse already refuses these, but they shouldn't get through
+	// regardless.
+	hostTemplate := &url.URL{Scheme: "http", Host: "{query.host}", Path: "/"}
+	if err := validateTargetTemplate(hostTemplate); err == nil {
+		t.Errorf("Expected a placeholder in the host to be refused")
+	}
+}
+
+func TestExpandTargetTemplate(t *testing.T) {
+	defer func(headers []string) { config.TemplateHeaders = headers }(config.TemplateHeaders)
+	config.TemplateHeaders = []string{"Accept-Language"}
+
+	r := httptest.NewRequest("GET", "/abc?q=cats%20%26%20dogs&page=2", nil)
+	r.Header.Set("Accept-Language", "en-US")
+	r.Header.Set("Authorization", "secret")
+
+	cases := map[string]string{
+		"http://example.com/search?q={query.q}":             "http://example.com/search?q=cats%20%26%20dogs",
+		"http://example.com/%7Bquery.page%7D":               "http://example.com/2",
+		"http://example.com/?lang={header.Accept-Language}": "http://example.com/?lang=en-US",
+		"http://example.com/?auth={header.Authorization}":   "http://example.com/?auth=",
+		"http://example.com/?missing={query.missing}":       "http://example.com/?missing=",
+	}
+
+	for target, expected := range cases {
+		if result := expandTargetTemplate(target, r); result != expected {
+			t.Errorf("For %q, expected %q but got %q", target, expected, result)
+		}
+	}
+}
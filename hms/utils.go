@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"unicode"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/user"
@@ -36,6 +37,38 @@ func ShortURLEncode(n int64) string {
 	return string(chars)
 }
 
+// Left-pads an encoded code to at least minLength characters with
+// ALPHABET[0], which encodes a zero digit, so ShortURLDecode reads padded
+// and unpadded codes alike.
+func PadShortURLCode(code string, minLength int) string {
+	if len(code) >= minLength {
+		return code
+	}
+	return strings.Repeat(ALPHABET[:1], minLength-len(code)) + code
+}
+
+// Returns the full short URL for path on host, under config.BasePath.
+func shortURL(host string, path string) string {
+	return fmt.Sprintf("http://%s%s/%s", host, config.BasePath, path)
+}
+
+// Returns the path of the auto-encoded link with datastore ID id.
+func autoLinkPath(id int64) string {
+	return PadShortURLCode(ShortURLEncode(id), config.AutoCodeMinLength)
+}
+
+// Returns code in the canonical case ShortURLEncode produces: every letter
+// uppercase except y, which is a digit of its own alongside Y and so keeps
+// whichever case it was typed in. Codes from ShortURLEncode are unchanged.
+func normalizeAutoCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == 'y' {
+			return r
+		}
+		return unicode.ToUpper(r)
+	}, code)
+}
+
 func ShortURLDecode(s string) int64 {
 	base := len(ALPHABET)
 
@@ -81,11 +114,54 @@ func handleUserAuth(w http.ResponseWriter, r *http.Request) (*user.User, bool) {
 	return u, true
 }
 
+// Returns whether the request was issued by App Engine's cron service or
+// task queue. App Engine strips these headers from external requests, so
+// they can be trusted.
+func isInternalRequest(r *http.Request) bool {
+	return r.Header.Get("X-Appengine-Cron") != "" || r.Header.Get("X-AppEngine-QueueName") != ""
+}
+
+// Checks that the request comes from an admin, either via the interactive
+// App Engine login or, for automation, via a request signed with the admin
+// secret (see computeSignature). Responds to the request and returns false if
+// it doesn't.
+func handleAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	c := appengine.NewContext(r)
+	if r.Header.Get(SIGNATURE_HEADER) != "" {
+		if err := verifyRequestSignature(c, r); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Bad request signature: " + err.Error()))
+			return false
+		}
+		return true
+	}
+
+	u := user.Current(c)
+	if u == nil {
+		loginUrl, _ := user.LoginURL(c, r.URL.RequestURI())
+		http.Redirect(w, r, loginUrl, http.StatusFound)
+		return false
+	} else if !u.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("You're not an admin. Go away."))
+		return false
+	}
+	return true
+}
+
 func getTemplate(path string) (*template.Template, error) {
 	return template.ParseFiles(templateBaseDir + "/" + path)
 }
 
+// Returns the template for e: a dedicated one for some kinds of error, like
+// linkNotFoundError, and otherwise the one for its code.
 func getErrorTemplate(e *appError) (*template.Template, error) {
+	switch e.Error.(type) {
+	case *linkNotFoundError:
+		return getTemplate("errors/link_not_found.html")
+	case *linkUnavailableError:
+		return getTemplate("errors/link_unavailable.html")
+	}
 	return getTemplate(fmt.Sprintf("errors/%d.html", e.Code))
 }
 
@@ -101,7 +177,44 @@ func randomString(n int) string {
 
 // returns whether path is suitable as a short link path
 func isValidPath(path string) bool {
-	return !(strings.Contains(path, "/"))
+	return !(strings.Contains(path, "/")) && !isAutoCode(path)
+}
+
+// Returns whether path decodes to a link ID, so a manual link with it would
+// be shadowed by (or shadow) the auto-encoded link with that ID. Only the
+// lowercase letter in ALPHABET, y, can start such a path.
+func isAutoCode(path string) bool {
+	return ShortURLDecode(path) > 0
+}
+
+// Returns the Levenshtein edit distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 //func GetRouteHandler(routes map[string])
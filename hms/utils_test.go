@@ -27,3 +27,21 @@ func TestURLEncodeAndDecode(t *testing.T) {
 
 	testInt(t, 4925812092436480)
 }
+
+func TestPadShortURLCode(t *testing.T) {
+	var i int64
+	for i = 1; i < 10000; i++ {
+		e := hms.ShortURLEncode(i)
+		padded := hms.PadShortURLCode(e, 6)
+		if len(padded) < 6 {
+			t.Errorf("For i=%d, padded %s to %s, which is too short", i, e, padded)
+		}
+		if x := hms.ShortURLDecode(padded); x != i {
+			t.Errorf("For i=%d, padded to %s, but decoded to: %d", i, padded, x)
+		}
+	}
+
+	if padded := hms.PadShortURLCode("XDy", 2); padded != "XDy" {
+		t.Errorf("Padding a long enough code changed it to %s", padded)
+	}
+}